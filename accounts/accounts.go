@@ -0,0 +1,181 @@
+// Package accounts keeps registered chat names and their passwords in a
+// JSON file.
+//
+// Passwords are never stored; each account holds a random salt and the
+// PBKDF2-SHA256 hash of its password.
+package accounts
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+const (
+	saltSize          = 16
+	keySize           = 32
+	minPasswordLength = 6
+)
+
+// iterations is the PBKDF2 iteration count of new password hashes.  Existing
+// hashes keep the count they were created with.
+var iterations = 600000
+
+var AlreadyRegisteredErr = errors.New("Name is already registered")
+var NotRegisteredErr = errors.New("Name is not registered")
+var WrongPasswordErr = errors.New("Wrong password")
+var ShortPasswordErr = errors.New(fmt.Sprintf(
+	"Password too short (the minimum is %d characters)", minPasswordLength))
+
+var _ chat.Accounts = (*Accounts)(nil)
+
+// account is a registered name's entry in the accounts file.
+type account struct {
+	Salt       []byte `json:"salt"`
+	Hash       []byte `json:"hash"`
+	Iterations int    `json:"iterations"`
+}
+
+// hash returns the password hash for a salt and iteration count.
+func hash(password string, salt []byte, iterations int) []byte {
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, keySize)
+	if err != nil {
+		// Only invalid parameters (e.g., in FIPS mode) fail
+		panic("accounts: " + err.Error())
+	}
+	return key
+}
+
+// newAccount returns an account for password with a fresh salt.
+func newAccount(password string) (*account, error) {
+	if len(password) < minPasswordLength {
+		return nil, ShortPasswordErr
+	}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &account{salt, hash(password, salt, iterations), iterations}, nil
+}
+
+// check returns a bool indicating whether password is the account's
+// password.
+func (a *account) check(password string) bool {
+	return subtle.ConstantTimeCompare(a.Hash, hash(password, a.Salt, a.Iterations)) == 1
+}
+
+// Accounts is a set of registered names backed by a file.
+type Accounts struct {
+	path  string
+	users map[string]*account
+	mu    sync.Mutex
+}
+
+// Open loads the accounts file at path.  A missing file holds no accounts;
+// it is created when the first name is registered.
+func Open(path string) (*Accounts, error) {
+	a := &Accounts{path, map[string]*account{}, sync.Mutex{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &a.users); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid accounts file %s: %s", path, err))
+	}
+	return a, nil
+}
+
+// save writes the accounts file.  The file is replaced atomically so that a
+// crash can't leave it half written.
+func (a *Accounts) save() error {
+	data, err := json.MarshalIndent(a.users, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(a.path), ".accounts")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), a.path)
+}
+
+// Registered returns a bool indicating whether name is registered.
+func (a *Accounts) Registered(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.users[name]
+	return ok
+}
+
+// Authenticate returns a bool indicating whether password is the password
+// of the registered name.
+func (a *Accounts) Authenticate(name string, password string) bool {
+	a.mu.Lock()
+	acct, ok := a.users[name]
+	a.mu.Unlock()
+	return ok && acct.check(password)
+}
+
+// Register registers name with a password.
+func (a *Accounts) Register(name string, password string) error {
+	acct, err := newAccount(password)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.users[name]; ok {
+		return AlreadyRegisteredErr
+	}
+	a.users[name] = acct
+	if err = a.save(); err != nil {
+		delete(a.users, name)
+		return err
+	}
+	return nil
+}
+
+// SetPassword changes the password of a registered name.
+func (a *Accounts) SetPassword(name string, oldPassword string, newPassword string) error {
+	a.mu.Lock()
+	old, ok := a.users[name]
+	a.mu.Unlock()
+	if !ok {
+		return NotRegisteredErr
+	}
+	if !old.check(oldPassword) {
+		return WrongPasswordErr
+	}
+	acct, err := newAccount(newPassword)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.users[name] = acct
+	if err = a.save(); err != nil {
+		a.users[name] = old
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package accounts
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func init() {
+	// Keep the tests fast
+	iterations = 1000
+}
+
+// tempPath returns the path of an accounts file in a new temporary
+// directory and a function that removes the directory.
+func tempPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gochatd-accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "accounts.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestRegisterReopen(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+	a, err := Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if a.Registered("alice") {
+		t.Error("Expected alice not to be registered")
+	}
+	if err = a.Register("alice", "secret1"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err = a.Register("alice", "secret2"); err != AlreadyRegisteredErr {
+		t.Errorf("Register twice error = %v, want: %s", err, AlreadyRegisteredErr)
+	}
+	if err = a.Register("bob", "short"); err != ShortPasswordErr {
+		t.Errorf("Register short password error = %v, want: %s", err, ShortPasswordErr)
+	}
+
+	a, err = Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !a.Registered("alice") || a.Registered("bob") {
+		t.Error("Expected only alice to be registered")
+	}
+	if !a.Authenticate("alice", "secret1") {
+		t.Error("Expected alice's password to be accepted")
+	}
+	if a.Authenticate("alice", "secret2") || a.Authenticate("bob", "secret1") {
+		t.Error("Expected wrong credentials to be rejected")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 || string(data) == "secret1" {
+		t.Errorf("Unexpected accounts file: %s", data)
+	}
+}
+
+func TestSetPassword(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+	a, err := Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err = a.Register("alice", "secret1"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err = a.SetPassword("alice", "wrong!", "secret2"); err != WrongPasswordErr {
+		t.Errorf("SetPassword error = %v, want: %s", err, WrongPasswordErr)
+	}
+	if err = a.SetPassword("bob", "secret1", "secret2"); err != NotRegisteredErr {
+		t.Errorf("SetPassword error = %v, want: %s", err, NotRegisteredErr)
+	}
+	if err = a.SetPassword("alice", "secret1", "secret2"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	a, err = Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if a.Authenticate("alice", "secret1") || !a.Authenticate("alice", "secret2") {
+		t.Error("Expected only the new password to be accepted")
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Error("Expected an error opening an invalid accounts file")
+	}
+}
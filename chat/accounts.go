@@ -0,0 +1,184 @@
+package chat
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bgmerrell/gochatd/ratelimit"
+)
+
+// By default, an address can fail to log in five times in a row, and once
+// every ten seconds after that (see SetLoginLimit).
+const (
+	defaultLoginRate  = 0.1
+	defaultLoginBurst = 5
+)
+
+var AuthFailedErr = errors.New("Wrong name or password")
+var TooManyLoginsErr = errors.New("Too many failed logins; try again later")
+var RegistrationRequiredErr = errors.New("Registration is required")
+var NameRegisteredErr = errors.New("Name is registered")
+var AccountsDisabledErr = errors.New("Registration is disabled")
+
+// Accounts holds the registered names and their passwords.
+type Accounts interface {
+	// Registered returns a bool indicating whether name is registered.
+	Registered(name string) bool
+	// Authenticate returns a bool indicating whether password is the
+	// password of the registered name.
+	Authenticate(name string, password string) bool
+	// Register registers name with a password.
+	Register(name string, password string) error
+	// SetPassword changes the password of a registered name.
+	SetPassword(name string, oldPassword string, newPassword string) error
+}
+
+// loginThrottle throttles password checks per client address.  Checks from
+// one address are serialized, so that a client can't keep more than one CPU
+// busy checking (deliberately slow) password hashes, and an address whose
+// checks fail too often is refused for a while.
+type loginThrottle struct {
+	failures *ratelimit.Limiter
+	busy     map[string]chan struct{}
+	mu       sync.Mutex
+}
+
+// newLoginThrottle returns a loginThrottle that allows rate failed checks
+// per second per address, in bursts of up to burst failures.
+func newLoginThrottle(rate float64, burst int) *loginThrottle {
+	return &loginThrottle{ratelimit.NewLimiter(rate, burst), map[string]chan struct{}{}, sync.Mutex{}}
+}
+
+// addrKey returns the key that addr (an IP address, with or without a port)
+// is throttled under.
+func addrKey(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// acquire waits until no other check from key is in progress and marks a
+// check from key as in progress.  It returns the failure Limiter to check
+// against.
+func (l *loginThrottle) acquire(key string) *ratelimit.Limiter {
+	for {
+		l.mu.Lock()
+		busy, ok := l.busy[key]
+		if !ok {
+			l.busy[key] = make(chan struct{})
+			failures := l.failures
+			l.mu.Unlock()
+			return failures
+		}
+		l.mu.Unlock()
+		<-busy
+	}
+}
+
+// release ends the check from key that is in progress.
+func (l *loginThrottle) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	close(l.busy[key])
+	delete(l.busy, key)
+}
+
+// check calls authenticate for a client at addr, unless addr has failed too
+// often (in which case TooManyLoginsErr is returned), and returns
+// AuthFailedErr if it fails.
+func (l *loginThrottle) check(addr string, authenticate func() bool) error {
+	key := addrKey(addr)
+	failures := l.acquire(key)
+	defer l.release(key)
+	if ok, _ := failures.Peek(key, time.Now()); !ok {
+		return TooManyLoginsErr
+	}
+	if !authenticate() {
+		failures.Allow(key, time.Now())
+		return AuthFailedErr
+	}
+	return nil
+}
+
+// SetLoginLimit limits failed logins (see Login) to rate per second per
+// client address, in bursts of up to burst failures; once an address is
+// over the limit, its logins fail with TooManyLoginsErr.  A rate of 0
+// disables the limit.  Password checks from one address are serialized
+// either way.
+func (c *ChatManager) SetLoginLimit(rate float64, burst int) {
+	c.logins.mu.Lock()
+	defer c.logins.mu.Unlock()
+	c.logins.failures = ratelimit.NewLimiter(rate, burst)
+}
+
+// SetAccounts sets the Accounts of registered names.  If requireRegistration
+// is set, only registered names can be used.
+func (c *ChatManager) SetAccounts(accounts Accounts, requireRegistration bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.accounts = accounts
+	c.requireRegistration = requireRegistration
+}
+
+// getAccounts returns the Accounts (if any) and whether registration is
+// required.
+func (c *ChatManager) getAccounts() (Accounts, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.accounts, c.requireRegistration
+}
+
+// Registered returns a bool indicating whether name is registered.
+func (c *ChatManager) Registered(name string) bool {
+	accounts, _ := c.getAccounts()
+	return accounts != nil && accounts.Registered(name)
+}
+
+// RegistrationRequired returns a bool indicating whether only registered
+// names can be used.
+func (c *ChatManager) RegistrationRequired() bool {
+	accounts, required := c.getAccounts()
+	return accounts != nil && required
+}
+
+// Login checks that a client at addr (its IP address, with or without a
+// port) may use name.  A registered name requires its password; any other
+// name is accepted unless registration is required.  Password checks are
+// throttled per address (see SetLoginLimit).  Handlers should call Login
+// before joining a client.
+func (c *ChatManager) Login(addr string, name string, password string) error {
+	accounts, required := c.getAccounts()
+	if accounts == nil {
+		return nil
+	}
+	if accounts.Registered(name) {
+		return c.logins.check(addr, func() bool {
+			return accounts.Authenticate(name, password)
+		})
+	}
+	if required {
+		return RegistrationRequiredErr
+	}
+	return nil
+}
+
+// Register registers name with a password.
+func (c *ChatManager) Register(name string, password string) error {
+	accounts, _ := c.getAccounts()
+	if accounts == nil {
+		return AccountsDisabledErr
+	}
+	return accounts.Register(name, password)
+}
+
+// SetPassword changes the password of a registered name.
+func (c *ChatManager) SetPassword(name string, oldPassword string, newPassword string) error {
+	accounts, _ := c.getAccounts()
+	if accounts == nil {
+		return AccountsDisabledErr
+	}
+	return accounts.SetPassword(name, oldPassword, newPassword)
+}
@@ -0,0 +1,132 @@
+package chat_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+	"github.com/bgmerrell/gochatd/dummyconn"
+	"github.com/bgmerrell/gochatd/internal/chattest"
+)
+
+// testAddr is the address that the tests log in from
+const testAddr = "10.1.2.3:4567"
+
+func TestLogin(t *testing.T) {
+	cm := chat.NewChatManager(nil, chat.HistorySize)
+	if err := cm.Login(testAddr, "alice", ""); err != nil {
+		t.Errorf("Login without accounts error = %s", err)
+	}
+	if err := cm.Register("alice", "secret1"); err != chat.AccountsDisabledErr {
+		t.Errorf("Register without accounts error = %v, want: %s", err, chat.AccountsDisabledErr)
+	}
+	cm.SetAccounts(chattest.MemAccounts{"alice": "secret1"}, false)
+	tests := []struct {
+		name     string
+		password string
+		expected error
+	}{
+		{"alice", "secret1", nil},
+		{"alice", "wrong", chat.AuthFailedErr},
+		{"alice", "", chat.AuthFailedErr},
+		{"bob", "", nil},
+	}
+	for _, test := range tests {
+		if err := cm.Login(testAddr, test.name, test.password); err != test.expected {
+			t.Errorf("Login(%s, %s) error = %v, want: %v", test.name, test.password, err, test.expected)
+		}
+	}
+	cm.SetAccounts(chattest.MemAccounts{"alice": "secret1"}, true)
+	if err := cm.Login(testAddr, "bob", ""); err != chat.RegistrationRequiredErr {
+		t.Errorf("Login(bob) error = %v, want: %s", err, chat.RegistrationRequiredErr)
+	}
+	if !cm.RegistrationRequired() {
+		t.Error("Expected registration to be required")
+	}
+}
+
+func TestLoginLimit(t *testing.T) {
+	cm := chat.NewChatManager(nil, chat.HistorySize)
+	cm.SetAccounts(chattest.MemAccounts{"alice": "secret1"}, false)
+	// Slow enough that no failures are forgiven during the test
+	cm.SetLoginLimit(0.001, 2)
+	for i := 0; i < 2; i++ {
+		if err := cm.Login(testAddr, "alice", "wrong"); err != chat.AuthFailedErr {
+			t.Fatalf("Failure %d of the burst error = %v, want: %s", i, err, chat.AuthFailedErr)
+		}
+	}
+	// Not even the right password is checked once the address is over
+	// the limit, whatever the port
+	if err := cm.Login("10.1.2.3:7654", "alice", "secret1"); err != chat.TooManyLoginsErr {
+		t.Errorf("Login over the limit error = %v, want: %s", err, chat.TooManyLoginsErr)
+	}
+	if err := cm.Login("10.9.9.9:4567", "alice", "secret1"); err != nil {
+		t.Errorf("Login from another address error = %s", err)
+	}
+	// Unregistered names don't need a password check
+	if err := cm.Login(testAddr, "bob", ""); err != nil {
+		t.Errorf("Login(bob) error = %s", err)
+	}
+
+	cm.SetLoginLimit(0, 0)
+	if err := cm.Login(testAddr, "alice", "secret1"); err != nil {
+		t.Errorf("Login without a limit error = %s", err)
+	}
+}
+
+// slowAccounts is an Accounts whose password checks record how many of
+// them are in progress at once.
+type slowAccounts struct {
+	chattest.MemAccounts
+	checking int32
+	maxSeen  int32
+}
+
+func (s *slowAccounts) Authenticate(name string, password string) bool {
+	n := atomic.AddInt32(&s.checking, 1)
+	defer atomic.AddInt32(&s.checking, -1)
+	for {
+		seen := atomic.LoadInt32(&s.maxSeen)
+		if n <= seen || atomic.CompareAndSwapInt32(&s.maxSeen, seen, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return s.MemAccounts.Authenticate(name, password)
+}
+
+func TestLoginSerialized(t *testing.T) {
+	cm := chat.NewChatManager(nil, chat.HistorySize)
+	accounts := &slowAccounts{MemAccounts: chattest.MemAccounts{"alice": "secret1"}}
+	cm.SetAccounts(accounts, false)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cm.Login(testAddr, "alice", "secret1")
+		}()
+	}
+	wg.Wait()
+	if accounts.maxSeen != 1 {
+		t.Errorf("%d password checks from one address ran at once, want: 1", accounts.maxSeen)
+	}
+}
+
+func TestRenameRegistered(t *testing.T) {
+	cm := chat.NewChatManager(nil, chat.HistorySize)
+	accounts := chattest.MemAccounts{"alice": "secret1"}
+	cm.SetAccounts(accounts, false)
+	if err := cm.Join(chat.DefaultRoom, "bob", dummyconn.NewDummyConn()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := cm.Rename("bob", "alice"); err != chat.NameRegisteredErr {
+		t.Errorf("Rename to a registered name error = %v, want: %s", err, chat.NameRegisteredErr)
+	}
+	cm.SetAccounts(accounts, true)
+	if err := cm.Rename("bob", "carol"); err != chat.RegistrationRequiredErr {
+		t.Errorf("Rename with registration required error = %v, want: %s", err, chat.RegistrationRequiredErr)
+	}
+}
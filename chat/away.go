@@ -0,0 +1,100 @@
+package chat
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+var NotAwayErr = errors.New("Not away")
+
+// Away is the away status of a user.  Reason is optional.
+type Away struct {
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// SetAway marks a connected user as away, with an optional reason.  Private
+// messages to the user, and messages that mention the user, get an
+// automatic reply with the reason (see KindAway) until the user is back.
+// Setting a user that is already away as away again replaces the reason.
+func (c *ChatManager) SetAway(name string, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cl, ok := c.nameToClient[name]
+	if !ok {
+		return &NotConnectedError{name}
+	}
+	cl.away = &Away{reason, c.clock()}
+	log.Printf("%s is away: %s", name, reason)
+	c.publishPresence(PresenceUpdate, "", cl)
+	return nil
+}
+
+// Back marks a connected user that is away as back.  NotAwayErr is returned
+// if the user isn't away.
+func (c *ChatManager) Back(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cl, ok := c.nameToClient[name]
+	if !ok {
+		return &NotConnectedError{name}
+	}
+	if cl.away == nil {
+		return NotAwayErr
+	}
+	cl.away = nil
+	log.Printf("%s is back", name)
+	c.publishPresence(PresenceUpdate, "", cl)
+	return nil
+}
+
+// isWordByte returns a bool indicating whether b can be part of a word (see
+// mentions).  Bytes of multi-byte characters count as word bytes.
+func isWordByte(b byte) bool {
+	return b >= 0x80 || b == '_' || ('0' <= b && b <= '9') ||
+		('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
+}
+
+// mentions returns a bool indicating whether body mentions name, i.e.,
+// whether name appears in it as a word of its own (e.g., "alice: hi" or
+// "thanks, @Alice"), ignoring case.
+func mentions(body string, name string) bool {
+	body, name = strings.ToLower(body), strings.ToLower(name)
+	if name == "" {
+		return false
+	}
+	for start := 0; ; {
+		i := strings.Index(body[start:], name)
+		if i < 0 {
+			return false
+		}
+		i += start
+		end := i + len(name)
+		if (i == 0 || !isWordByte(body[i-1])) && (end == len(body) || !isWordByte(body[end])) {
+			return true
+		}
+		start = i + 1
+	}
+}
+
+// autoReply sends a user (to) the away reason of cl, if cl is away (but
+// does not lock any shared state; it should only be used if you already
+// hold the appropriate locks).  Users that aren't connected can't be
+// replied to, and away users aren't replied to about themselves.
+func (c *ChatManager) autoReply(to string, cl *client) {
+	if cl.away == nil || to == cl.name {
+		return
+	}
+	toCl, ok := c.nameToClient[to]
+	if !ok {
+		return
+	}
+	reply := c.newMessage(KindAway, cl.name, "", cl.away.Reason)
+	reply.To = to
+	c.appendStore(reply)
+	if !c.deliver(toCl, reply) {
+		c.dropSlow(toCl)
+	}
+}
@@ -0,0 +1,100 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/dummyconn"
+)
+
+func TestMentions(t *testing.T) {
+	tests := map[string]bool{
+		"alice: hi":           true,
+		"thanks, @Alice!":     true,
+		"ask alice":           true,
+		"malice aforethought": false,
+		"alice_2 is here":     false,
+		"":                    false,
+	}
+	for body, expected := range tests {
+		if got := mentions(body, "alice"); got != expected {
+			t.Errorf("mentions(%q, alice) = %t, want: %t", body, got, expected)
+		}
+	}
+	if !mentions("alice_2 is here", "alice_2") {
+		t.Error("Expected alice_2 to be mentioned")
+	}
+}
+
+func TestAway(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	aliceConn := dummyconn.NewDummyConn()
+	if err := cm.Join(DefaultRoom, "alice", aliceConn); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	readLine(t, aliceConn)
+	bobConn := dummyconn.NewDummyConn()
+	joinAs(t, cm, aliceConn, "bob", bobConn)
+
+	if err := cm.SetAway("carol", ""); err == nil {
+		t.Error("Expected an error for a user that isn't connected")
+	}
+	if err := cm.Back("bob"); err != NotAwayErr {
+		t.Errorf("Back(bob) error = %v, want: %s", err, NotAwayErr)
+	}
+	cm.SetClock(func() time.Time { return testNow.Add(5 * time.Minute) })
+	if err := cm.SetAway("bob", "lunch"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	p, err := cm.UserPresence("bob")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if p.Away == nil || p.Away.Reason != "lunch" || !p.Away.Since.Equal(testNow.Add(5*time.Minute)) {
+		t.Errorf("Away = %+v, want lunch since %s", p.Away, testNow.Add(5*time.Minute))
+	}
+	expectedWho := "bob (raw from remote) in lobby; connected 02-Jan-06 15:04, idle 0s, away since 02-Jan-06 15:09: lunch"
+	if who := p.Format(p.LastActive); who != expectedWho {
+		t.Errorf("Format = %q, want: %q", who, expectedWho)
+	}
+
+	// A private message gets an automatic reply
+	go cm.Whisper("alice", "bob", []byte("hi"))
+	readLine(t, bobConn)
+	expected := "02-Jan-06 15:09 *alice -> bob* hi\n"
+	if msg := readLine(t, aliceConn); msg != expected {
+		t.Errorf("Echo = %q, want: %q", msg, expected)
+	}
+	expected = "02-Jan-06 15:09 *** bob is away: lunch\n"
+	if msg := readLine(t, aliceConn); msg != expected {
+		t.Errorf("Auto-reply = %q, want: %q", msg, expected)
+	}
+
+	// So does a mention, but bob mentioning himself doesn't
+	go cm.Broadcast(DefaultRoom, "alice", []byte("@Bob, are you there?"))
+	readLine(t, bobConn)
+	readLine(t, aliceConn)
+	if msg := readLine(t, aliceConn); msg != expected {
+		t.Errorf("Auto-reply = %q, want: %q", msg, expected)
+	}
+	go cm.Broadcast(DefaultRoom, "bob", []byte("bob is away"))
+	readLine(t, aliceConn)
+	readLine(t, bobConn)
+
+	if err = cm.Back("bob"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if p, _ = cm.UserPresence("bob"); p.Away != nil {
+		t.Errorf("Away = %+v after Back, want nil", p.Away)
+	}
+	go cm.Whisper("alice", "bob", []byte("welcome back"))
+	readLine(t, bobConn)
+	readLine(t, aliceConn)
+	// Nothing but the next message follows the echo
+	go cm.Broadcast(DefaultRoom, "bob", []byte("thanks"))
+	expected = "02-Jan-06 15:09 <bob> thanks\n"
+	if msg := readLine(t, aliceConn); msg != expected {
+		t.Errorf("Message = %q, want: %q", msg, expected)
+	}
+	readLine(t, bobConn)
+}
@@ -1,62 +1,67 @@
 package chat
 
 import (
-	"bytes"
 	"container/ring"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 )
 
-// Based on Go's reference time
-const timestampLayout = "02-Jan-06 15:04"
-
-// overwritable for testing
-var Timestamp func() string = _timestamp
-
-func _timestamp() string {
-	return time.Now().UTC().Format(timestampLayout)
-}
-
 // history contains a history of messages in a circular buffer.
 type history struct {
 	message *ring.Ring
 	head    *ring.Ring
 	maxSize int
+	// dropped is the ID of the newest message dropped from the history
+	// to make room for new ones (0 if none were).
+	dropped uint64
 	mu      sync.Mutex
 }
 
 // newHistory returns a new history object reference.  The size indicates
-// the size of the history in number of lines.
+// the size of the history in number of messages.
 func newHistory(size int) *history {
 	r := ring.New(size)
-	return &history{r, r, size, sync.Mutex{}}
+	return &history{r, r, size, 0, sync.Mutex{}}
 }
 
-// insert inserts a line into the chat history
-func (h *history) insert(msg []byte) {
+// insert inserts a message into the chat history
+func (h *history) insert(msg *Message) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	if h.message.Value != nil {
+		h.dropped = h.message.Value.(*Message).ID
 		h.head = h.message.Next()
 	}
 	h.message.Value = msg
 	h.message = h.message.Next()
 }
 
-// messages returns n lines of ordered chat messages from the history
-func (h *history) messages(n int) []byte {
+// since returns the ordered chat messages from the history with IDs greater
+// than id.
+func (h *history) since(id uint64) []*Message {
+	msgs := h.messages(h.maxSize)
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].ID > id })
+	return msgs[i:]
+}
+
+// messages returns the last n ordered chat messages from the history
+func (h *history) messages(n int) []*Message {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	// don't allow requests greated than maxSize
 	if n > h.maxSize {
 		n = h.maxSize
 	}
-	msgs := []byte{}
+	msgs := []*Message{}
 	tmp := h.message.Move(-1 * n)
 	if tmp.Value == nil {
 		// No messages in the chat
@@ -67,7 +72,7 @@ func (h *history) messages(n int) []byte {
 	}
 	// this isn't super efficient, but it should work for our purposes.
 	for {
-		msgs = append(msgs, tmp.Value.([]byte)...)
+		msgs = append(msgs, tmp.Value.(*Message))
 		tmp = tmp.Next()
 		if tmp == h.message {
 			break
@@ -76,80 +81,754 @@ func (h *history) messages(n int) []byte {
 	return msgs
 }
 
+// resize changes the size of the history, keeping the newest messages that
+// fit.
+func (h *history) resize(size int) {
+	msgs := h.messages(h.maxSize)
+	h.mu.Lock()
+	if len(msgs) > size {
+		h.dropped = msgs[len(msgs)-size-1].ID
+		msgs = msgs[len(msgs)-size:]
+	}
+	r := ring.New(size)
+	h.message = r
+	h.head = r
+	h.maxSize = size
+	h.mu.Unlock()
+	for _, msg := range msgs {
+		h.insert(msg)
+	}
+}
+
+// DefaultRoom is the room that always exists.  Clients are placed in it
+// unless they ask for another room.
+const DefaultRoom = "lobby"
+
+// maxRoomNameLen is the maximum allowed length of a room name
+const maxRoomNameLen = 32
+
+var RoomNotFoundErr = errors.New("No such room")
+var RoomExistsErr = errors.New("Room already exists")
+var InvalidRoomNameErr = errors.New("Invalid room name")
+
+// NotConnectedError is returned when a user that isn't connected is
+// addressed.
+type NotConnectedError struct {
+	Name string
+}
+
+func (e *NotConnectedError) Error() string {
+	return fmt.Sprintf("\"%s\" is not connected", e.Name)
+}
+
+// reservedRoomNames can't be used as room names, since the HTTP API uses
+// them for the resources of the DefaultRoom (e.g., "/chat/stream").
+var reservedRoomNames = map[string]bool{
+	"stream": true,
+	"search": true,
+	"users":  true,
+}
+
+// ValidRoomName returns a bool indicating whether name is acceptable as a
+// room name.  Room names may contain letters, digits, '-' and '_', and
+// can't be one of the reservedRoomNames.
+func ValidRoomName(name string) bool {
+	if len(name) == 0 || len(name) > maxRoomNameLen || reservedRoomNames[name] {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidName returns a bool indicating whether name is acceptable as a user
+// name.  User names must be printable and can't contain whitespace, so that
+// they can't break up (or fake) the lines that they are written into.
+func ValidName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// room is a named channel with its own set of members and its own history.
+type room struct {
+	name        string
+	members     map[string]bool
+	history     *history
+	subscribers map[*Subscription]bool
+}
+
+// newRoom returns a new room object reference with an empty history of
+// historySize lines.
+func newRoom(name string, historySize int) *room {
+	return &room{name, map[string]bool{}, newHistory(historySize), map[*Subscription]bool{}}
+}
+
+// Store persists room messages so that history survives restarts and can
+// reach further back than the in-memory history.
+type Store interface {
+	// Append stores a message.  Messages are appended in ID order.  Private
+	// messages (those without a room) aren't read back, but their IDs count
+	// towards LastID, so that they aren't handed out again after a restart.
+	Append(m *Message) error
+	// Before returns up to n of a room's messages with IDs lower than id,
+	// oldest first.
+	Before(roomName string, id uint64, n int) ([]*Message, error)
+	// After returns up to n of a room's messages with IDs greater than id,
+	// oldest first.
+	After(roomName string, id uint64, n int) ([]*Message, error)
+	// Rooms returns the names of the rooms that have stored messages.
+	Rooms() []string
+	// LastID returns the ID of the newest appended message.
+	LastID() uint64
+}
+
 // ChatManager keeps track of clients connected to the chat service and is
 // responsible for communications between them.
 type ChatManager struct {
-	nameToConn map[string]net.Conn
-	chatLog    io.Writer
-	history    *history
-	mu         sync.Mutex
+	nameToClient    map[string]*client
+	rooms           map[string]*room
+	chatLog         io.Writer
+	logFormatter    Formatter
+	maxHistoryLines int
+	logWhispers     bool
+	store           Store
+	index           Index
+	accounts        Accounts
+	// Only registered names can be used if requireRegistration is set
+	requireRegistration bool
+	logins              *loginThrottle
+	tokens              Tokens
+	guestPrefix         string
+	moderation          Moderation
+	operators           map[string]bool
+	presenceSubs        map[*PresenceSubscription]bool
+	queueSize           int
+	policy              OverflowPolicy
+	dropped             uint64
+	lastID              uint64
+	// now is the clock (see SetClock); nil means Now
+	now func() time.Time
+	// Set by Shutdown
+	closed bool
+	mu     sync.Mutex
 }
 
-// NewChatManager returns an initialized ChatManager
+// NewChatManager returns an initialized ChatManager.  The DefaultRoom is
+// created up front; maxHistoryLines is the history size of every room.
 func NewChatManager(chatLog io.Writer, maxHistoryLines int) *ChatManager {
 	return &ChatManager{
-		map[string]net.Conn{},
-		chatLog,
-		newHistory(maxHistoryLines),
-		sync.Mutex{}}
+		nameToClient:    map[string]*client{},
+		rooms:           map[string]*room{DefaultRoom: newRoom(DefaultRoom, maxHistoryLines)},
+		chatLog:         chatLog,
+		logFormatter:    LogFormatter,
+		maxHistoryLines: maxHistoryLines,
+		logins:          newLoginThrottle(defaultLoginRate, defaultLoginBurst),
+		operators:       map[string]bool{},
+		presenceSubs:    map[*PresenceSubscription]bool{},
+		queueSize:       defaultQueueSize,
+		policy:          defaultPolicy,
+	}
+}
+
+// SetQueuePolicy sets the size of the outbound queue of clients that join
+// from now on, and what happens when a client's queue is full.  By default
+// queues hold 256 messages and the oldest message is dropped.
+func (c *ChatManager) SetQueuePolicy(queueSize int, policy OverflowPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queueSize = queueSize
+	c.policy = policy
+}
+
+// Dropped returns the number of messages that have been dropped for slow
+// clients.
+func (c *ChatManager) Dropped() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dropped
+}
+
+// SetStore sets the Store that room messages are persisted to.  Rooms found
+// in the store are created, their histories are filled with the newest
+// stored messages, and message IDs continue from the newest appended one.
+func (c *ChatManager) SetStore(store Store) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, roomName := range store.Rooms() {
+		rm, ok := c.rooms[roomName]
+		if !ok {
+			rm = newRoom(roomName, c.maxHistoryLines)
+			c.rooms[roomName] = rm
+		}
+		msgs, err := store.Before(roomName, math.MaxUint64, c.maxHistoryLines)
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			rm.history.insert(msg)
+		}
+		if len(msgs) == c.maxHistoryLines {
+			// The store may hold older messages; Subscribe looks
+			// for them there.
+			rm.history.mu.Lock()
+			rm.history.dropped = msgs[0].ID - 1
+			rm.history.mu.Unlock()
+		}
+		log.Printf("Replayed %d messages into %s", len(msgs), roomName)
+	}
+	if lastID := store.LastID(); lastID > c.lastID {
+		c.lastID = lastID
+	}
+	c.store = store
+	return nil
+}
+
+// SetMaxHistoryLines changes the history size of every room.  The newest
+// messages that fit are kept.
+func (c *ChatManager) SetMaxHistoryLines(maxHistoryLines int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxHistoryLines = maxHistoryLines
+	for _, rm := range c.rooms {
+		rm.history.resize(maxHistoryLines)
+	}
+}
+
+// SetClock sets the function that the ChatManager takes the current time
+// from (Now by default), e.g., for the time of messages and sanctions.
+// Unlike replacing Now, it doesn't affect other ChatManagers.
+func (c *ChatManager) SetClock(now func() time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// clock returns the current time according to the ChatManager's clock (but
+// does not lock any shared state; it should only be used if you already
+// hold the appropriate locks).
+func (c *ChatManager) clock() time.Time {
+	if c.now == nil {
+		return Now()
+	}
+	return c.now()
+}
+
+// MaxHistoryLines returns the history size of every room.
+func (c *ChatManager) MaxHistoryLines() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.maxHistoryLines
+}
+
+// SetChatLog replaces the chat log (e.g., with a reopened log file).  It is
+// up to the caller to close the previous one.
+func (c *ChatManager) SetChatLog(chatLog io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.chatLog = chatLog
+}
+
+// SetLogFormatter sets the Formatter used to write messages to the chat log.
+// LogFormatter is used by default.
+func (c *ChatManager) SetLogFormatter(f Formatter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logFormatter = f
+}
+
+// SetLogWhispers sets whether private messages (see Whisper) are written to
+// the chat log.  They are not by default.
+func (c *ChatManager) SetLogWhispers(logWhispers bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logWhispers = logWhispers
+}
+
+// CreateRoom creates a new, empty room.  An error is returned if the name is
+// invalid or the room already exists.
+func (c *ChatManager) CreateRoom(roomName string) error {
+	if !ValidRoomName(roomName) {
+		return InvalidRoomNameErr
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.rooms[roomName]; ok {
+		return RoomExistsErr
+	}
+	c.rooms[roomName] = newRoom(roomName, c.maxHistoryLines)
+	log.Printf("Room %s has been created", roomName)
+	return nil
 }
 
-// Join adds a user to the chat manager and announces the join to all clients.
-func (c *ChatManager) Join(name string, conn net.Conn) error {
+// Rooms returns the sorted names of all rooms.
+func (c *ChatManager) Rooms() []string {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if _, ok := c.nameToConn[name]; ok {
+	names := make([]string, 0, len(c.rooms))
+	for name := range c.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Members returns the sorted names of the users in a room.
+func (c *ChatManager) Members(roomName string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rm, ok := c.rooms[roomName]
+	if !ok {
+		return nil, RoomNotFoundErr
+	}
+	names := make([]string, 0, len(rm.members))
+	for name := range rm.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Join adds a user to a room and announces the join to the room's members.
+// The room is created if it doesn't exist yet.  A *SanctionedError is
+// returned if the user's name or conn's address is banned.  A user may be in
+// several rooms at once, but only over a single connection.  Messages are
+// rendered for the connection with TextFormatter, unless conn is itself a
+// Formatter.  If writing to conn fails, the user quits every room.
+func (c *ChatManager) Join(roomName string, name string, conn net.Conn) error {
+	if !ValidRoomName(roomName) {
+		return InvalidRoomNameErr
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ShuttingDownErr
+	}
+	cl, ok := c.nameToClient[name]
+	if ok && cl.conn != conn {
 		return errors.New(fmt.Sprintf(
 			"Another \"%s\" is already connected", name))
 	}
-	c.nameToConn[name] = conn
-	log.Printf("%s has joined", name)
-	c.broadcast([]byte(fmt.Sprintf(
-		"%s * %s %s\n", Timestamp(), name, "has joined")))
+	rm, ok := c.rooms[roomName]
+	if !ok {
+		rm = newRoom(roomName, c.maxHistoryLines)
+		c.rooms[roomName] = rm
+		log.Printf("Room %s has been created", roomName)
+	}
+	if rm.members[name] {
+		return errors.New(fmt.Sprintf(
+			"\"%s\" is already in %s", name, roomName))
+	}
+	if s := c.sanction(SanctionBan, name, remoteIP(conn)); s != nil {
+		return &SanctionedError{s}
+	}
+	change := PresenceUpdate
+	if cl == nil {
+		cl = newClient(name, conn, c.clock(), c.queueSize, c.policy, c.writeFailed)
+		c.nameToClient[name] = cl
+		change = PresenceConnect
+	}
+	rm.members[name] = true
+	log.Printf("%s has joined %s", name, roomName)
+	c.broadcast(rm, c.newMessage(KindJoin, name, roomName, "has joined"))
+	// Unless the client was too slow for its own join message
+	if c.nameToClient[name] == cl {
+		c.publishPresence(change, "", cl)
+	}
 	return nil
 }
 
-// Quit removes a user from the chat manager and announces the quit to all
-// clients.
-func (c *ChatManager) Quit(name string) {
+// Quit removes a user from a room and announces the quit to the room's
+// members.  Once a user has quit every room, the name is free to be used by
+// another connection.
+func (c *ChatManager) Quit(roomName string, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.quit(roomName, name)
+}
+
+// QuitAll removes a user from every room it is in.
+func (c *ChatManager) QuitAll(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cl, ok := c.nameToClient[name]; ok {
+		c.disconnect(cl)
+	}
+}
+
+// Disconnect removes the user connected over conn (if any) from every room
+// it is in, then waits for what is already queued for the user to be
+// written, so that conn can be closed right after (callers that can't wait
+// for a client that doesn't read should set a write deadline on conn
+// first).  Unlike QuitAll, it can't affect another connection that has
+// since taken the user's name.
+func (c *ChatManager) Disconnect(conn net.Conn) {
+	c.mu.Lock()
+	cl := c.clientByConn(conn)
+	if cl != nil {
+		c.disconnect(cl)
+	}
+	c.mu.Unlock()
+	if cl != nil {
+		<-cl.done
+	}
+}
+
+// Reply queues data for the user connected over conn only, after the
+// messages already queued for the user, so that the two don't interleave.
+// data is written as is, so it must already be in the form that the
+// connection expects (e.g., lines of text); it isn't logged or stored.
+func (c *ChatManager) Reply(conn net.Conn, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ShuttingDownErr
+	}
+	cl := c.clientByConn(conn)
+	if cl == nil {
+		return errors.New("Not connected")
+	}
+	dropped, ok := cl.reply(data)
+	if dropped {
+		c.dropped++
+	}
+	if !ok {
+		c.dropSlow(cl)
+	}
+	return nil
+}
+
+// clientByConn returns the client connected over conn, or nil if there is
+// none (but does not lock any shared state; it should only be used if you
+// already hold the appropriate locks).
+func (c *ChatManager) clientByConn(conn net.Conn) *client {
+	for _, cl := range c.nameToClient {
+		if cl.conn == conn {
+			return cl
+		}
+	}
+	return nil
+}
+
+// writeFailed disconnects a client whose connection can't be written to.
+func (c *ChatManager) writeFailed(cl *client, err error) {
+	log.Printf("Error writing to %s: %s", cl.name, err)
+	cl.conn.Close()
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	delete(c.nameToConn, name)
-	log.Printf("%s has quit", name)
-	c.broadcast([]byte(fmt.Sprintf(
-		"%s * %s %s\n", Timestamp(), name, "has quit")))
+	c.disconnect(cl)
+}
+
+// disconnect removes a client from every room it is in (but does not lock
+// any shared state; it should only be used if you already hold the
+// appropriate locks).  Nothing is done if the client is already gone.
+func (c *ChatManager) disconnect(cl *client) {
+	c.remove(cl, "has quit")
+}
+
+// remove removes a client from every room it is in, announcing body (e.g.,
+// "has quit") as its quit message (but does not lock any shared state; it
+// should only be used if you already hold the appropriate locks).  Nothing
+// is done if the client is already gone.
+func (c *ChatManager) remove(cl *client, body string) {
+	if c.nameToClient[cl.name] != cl {
+		return
+	}
+	for roomName, rm := range c.rooms {
+		if rm.members[cl.name] {
+			c.quitWith(roomName, cl.name, body)
+		}
+	}
 }
 
-// broadcast writes msg to all clients known to the ChatManager (but does not
-// lock any shared state; it should only be used if you already hold the
+// quit removes a user from a room (but does not lock any shared state; it
+// should only be used if you already hold the appropriate locks).
+func (c *ChatManager) quit(roomName string, name string) {
+	c.quitWith(roomName, name, "has quit")
+}
+
+// quitWith removes a user from a room, announcing body as its quit message
+// (but does not lock any shared state; it should only be used if you
+// already hold the appropriate locks).
+func (c *ChatManager) quitWith(roomName string, name string, body string) {
+	rm, ok := c.rooms[roomName]
+	if !ok || !rm.members[name] {
+		return
+	}
+	delete(rm.members, name)
+	log.Printf("%s has quit %s", name, roomName)
+	c.broadcast(rm, c.newMessage(KindQuit, name, roomName, body))
+	cl := c.nameToClient[name]
+	for _, other := range c.rooms {
+		if other.members[name] {
+			c.publishPresence(PresenceUpdate, "", cl)
+			return
+		}
+	}
+	c.publishPresence(PresenceDisconnect, "", cl)
+	// Let the client's writer finish what is already queued, then exit
+	cl.queue.close()
+	delete(c.nameToClient, name)
+}
+
+// newMessage returns a new Message with the next ID and the current time
+// (but does not lock any shared state; it should only be used if you
+// already hold the appropriate locks).  Trailing line endings are stripped
+// from body.
+func (c *ChatManager) newMessage(kind Kind, sender string, roomName string, body string) *Message {
+	c.lastID++
+	return &Message{
+		ID:     c.lastID,
+		Time:   c.clock(),
+		Sender: sender,
+		Room:   roomName,
+		Kind:   kind,
+		Body:   strings.TrimRight(body, "\r\n"),
+	}
+}
+
+// appendStore appends msg to the message store, if there is one (but does
+// not lock any shared state; it should only be used if you already hold the
+// appropriate locks).  Every message with an ID is appended, including
+// private ones, so that the store knows the newest ID that was handed out.
+func (c *ChatManager) appendStore(msg *Message) {
+	if c.store == nil {
+		return
+	}
+	if err := c.store.Append(msg); err != nil {
+		log.Printf("Error writing to message store: %s", err)
+	}
+}
+
+// newNotice returns a notice (see KindNotice) (but does not lock any shared
+// state; it should only be used if you already hold the appropriate locks).
+// Unlike newMessage, it doesn't take an ID, so that no ID is handed out that
+// a restart could hand out again.
+func (c *ChatManager) newNotice(body string) *Message {
+	return &Message{Time: c.clock(), Kind: KindNotice, Body: body}
+}
+
+// writeLog writes msg to the chat log, if there is one (but does not lock
+// any shared state; it should only be used if you already hold the
 // appropriate locks).
-func (c *ChatManager) broadcast(msg []byte) {
-	if !bytes.HasSuffix(msg, []byte("\n")) {
-		msg = append(msg, '\n')
+func (c *ChatManager) writeLog(msg *Message) {
+	if c.chatLog == nil {
+		return
 	}
-	log.Printf("Broadcasting: %s", string(msg))
-	if c.chatLog != nil {
-		_, err := c.chatLog.Write(msg)
-		if err != nil {
-			log.Printf("Error writing to chat log file: %s", err)
+	_, err := c.chatLog.Write(c.logFormatter.Format(msg))
+	if err != nil {
+		log.Printf("Error writing to chat log file: %s", err)
+	}
+}
+
+// deliver queues msg for a client and counts any dropped messages (but does
+// not lock any shared state; it should only be used if you already hold the
+// appropriate locks).  It returns false if the client is too slow and should
+// be disconnected with dropSlow.
+func (c *ChatManager) deliver(cl *client, msg *Message) bool {
+	dropped, ok := cl.deliver(msg)
+	if dropped {
+		c.dropped++
+	}
+	return ok
+}
+
+// dropSlow disconnects a client whose queue is full (but does not lock any
+// shared state; it should only be used if you already hold the appropriate
+// locks).
+func (c *ChatManager) dropSlow(cl *client) {
+	log.Printf("Disconnecting slow client %s", cl.name)
+	cl.queue.close()
+	cl.conn.Close()
+	c.disconnect(cl)
+}
+
+// broadcast writes msg to all members of a room (but does not lock any shared
+// state; it should only be used if you already hold the appropriate locks).
+// Nothing is written once the ChatManager has been shut down.
+func (c *ChatManager) broadcast(rm *room, msg *Message) {
+	if c.closed {
+		return
+	}
+	log.Printf("Broadcasting to %s: %d %s <%s> %s",
+		rm.name, msg.ID, msg.Kind, msg.Sender, msg.Body)
+	c.writeLog(msg)
+	c.appendStore(msg)
+	if c.index != nil {
+		c.index.Add(msg)
+	}
+	rm.history.insert(msg)
+	rm.publish(msg)
+	// Slow clients are disconnected once everyone has been sent msg, so that
+	// their quit messages follow it.
+	slow := []*client{}
+	for name := range rm.members {
+		cl := c.nameToClient[name]
+		if !c.deliver(cl, msg) {
+			slow = append(slow, cl)
 		}
 	}
-	c.history.insert(msg)
-	for _, conn := range c.nameToConn {
-		go conn.Write(msg)
+	for _, cl := range slow {
+		c.dropSlow(cl)
 	}
 }
 
-// Broadcast writes msg to all clients known to the ChatManager.
-func (c *ChatManager) Broadcast(name string, msg []byte) {
-	out := []byte(fmt.Sprintf("%s <%s> %s", Timestamp(), name, msg))
+// Broadcast writes msg to all members of a room and returns the Message that
+// was sent.  Members that are away and are mentioned in msg send the sender
+// an automatic reply (see SetAway).  A *SanctionedError is returned if the
+// sender is banned or muted.
+func (c *ChatManager) Broadcast(roomName string, name string, msg []byte) (*Message, error) {
+	return c.send(KindChat, roomName, name, msg)
+}
+
+// Action writes an action (e.g., "* name waves") to all members of a room
+// and returns the Message that was sent.
+func (c *ChatManager) Action(roomName string, name string, msg []byte) (*Message, error) {
+	return c.send(KindAction, roomName, name, msg)
+}
+
+// send writes a message of the given kind to all members of a room.
+func (c *ChatManager) send(kind Kind, roomName string, name string, msg []byte) (*Message, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.broadcast(out)
+	if c.closed {
+		return nil, ShuttingDownErr
+	}
+	rm, ok := c.rooms[roomName]
+	if !ok {
+		return nil, RoomNotFoundErr
+	}
+	if err := c.checkSender(name); err != nil {
+		return nil, err
+	}
+	out := c.newMessage(kind, name, roomName, string(msg))
+	if cl, ok := c.nameToClient[name]; ok {
+		cl.lastActive = out.Time
+	}
+	c.broadcast(rm, out)
+	for member := range rm.members {
+		if member != name && mentions(out.Body, member) {
+			c.autoReply(name, c.nameToClient[member])
+		}
+	}
+	return out, nil
 }
 
-// History returns the specifies number of lines (numLines) from the chat
-// history as a slices of bytes.
-func (c *ChatManager) History(numLines int) []byte {
-	return c.history.messages(numLines)
+// Whisper writes msg to a single user (to) only.  The message is echoed
+// back to the sender if the sender is connected, as is the recipient's
+// automatic reply if the recipient is away (see SetAway).  A
+// *NotConnectedError is returned if the recipient isn't connected.  Private
+// messages are never recorded in a room's history, and are only written to
+// the chat log if enabled with SetLogWhispers.  Banned and muted users can't
+// whisper.
+func (c *ChatManager) Whisper(from string, to string, msg []byte) (*Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ShuttingDownErr
+	}
+	if err := c.checkSender(from); err != nil {
+		return nil, err
+	}
+	cl, ok := c.nameToClient[to]
+	if !ok {
+		return nil, &NotConnectedError{to}
+	}
+	out := c.newMessage(KindPrivate, from, "", string(msg))
+	out.To = to
+	if c.logWhispers {
+		c.writeLog(out)
+	}
+	c.appendStore(out)
+	if !c.deliver(cl, out) {
+		c.dropSlow(cl)
+	}
+	if fromCl, ok := c.nameToClient[from]; ok {
+		fromCl.lastActive = out.Time
+		if from != to && !c.deliver(fromCl, out) {
+			c.dropSlow(fromCl)
+		}
+	}
+	c.autoReply(from, cl)
+	return out, nil
+}
+
+// Rename changes the name of a connected user and announces the change to
+// every room the user is in.  A registered name can't be taken by renaming,
+// and when registration is required no name can.  A *SanctionedError is
+// returned if the user is banned or muted (so that a sanction can't be
+// shed by renaming), or if the new name or the user's address is banned.
+func (c *ChatManager) Rename(oldName string, newName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cl, ok := c.nameToClient[oldName]
+	if !ok {
+		return &NotConnectedError{oldName}
+	}
+	if _, ok := c.nameToClient[newName]; ok {
+		return errors.New(fmt.Sprintf(
+			"Another \"%s\" is already connected", newName))
+	}
+	// Taking a registered name requires logging in as it
+	if c.accounts != nil && c.accounts.Registered(newName) {
+		return NameRegisteredErr
+	} else if c.accounts != nil && c.requireRegistration {
+		return RegistrationRequiredErr
+	}
+	if err := c.checkSender(oldName); err != nil {
+		return err
+	}
+	if s := c.sanction(SanctionBan, newName, remoteIP(cl.conn)); s != nil {
+		return &SanctionedError{s}
+	}
+	delete(c.nameToClient, oldName)
+	c.nameToClient[newName] = cl
+	cl.name = newName
+	log.Printf("%s is now known as %s", oldName, newName)
+	for _, rm := range c.rooms {
+		if !rm.members[oldName] {
+			continue
+		}
+		delete(rm.members, oldName)
+		rm.members[newName] = true
+		c.broadcast(rm, c.newMessage(KindNick, oldName, rm.name,
+			"is now known as "+newName))
+	}
+	c.publishPresence(PresenceUpdate, oldName, cl)
+	return nil
+}
+
+// History returns the specified number of messages (numLines) from a room's
+// history, oldest first.  Without a Store, no more than the in-memory
+// history can be returned; with one, older messages are read from it.
+func (c *ChatManager) History(roomName string, numLines int) ([]*Message, error) {
+	c.mu.Lock()
+	rm, ok := c.rooms[roomName]
+	store := c.store
+	c.mu.Unlock()
+	if !ok {
+		return nil, RoomNotFoundErr
+	}
+	msgs := rm.history.messages(numLines)
+	if store == nil || len(msgs) >= numLines {
+		return msgs, nil
+	}
+	oldestID := uint64(math.MaxUint64)
+	if len(msgs) > 0 {
+		oldestID = msgs[0].ID
+	}
+	older, err := store.Before(roomName, oldestID, numLines-len(msgs))
+	if err != nil {
+		return nil, err
+	}
+	return append(older, msgs...), nil
 }
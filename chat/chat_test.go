@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"net"
 	"strconv"
 	"strings"
 	"testing"
@@ -16,15 +17,57 @@ const bufSize = 512
 const historySize = 8
 const testTime = "02-Jan-06 15:04"
 
+// testNow is rendered as testTime
+var testNow = time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+
 func init() {
-	Timestamp = func() string { return testTime }
+	Now = func() time.Time { return testNow }
+}
+
+// bodies returns the bodies of msgs, concatenated.
+func bodies(msgs []*Message) string {
+	out := ""
+	for _, m := range msgs {
+		out += m.Body
+	}
+	return out
+}
+
+// ipConn is a net.Conn from a TCP address.
+type ipConn struct {
+	net.Conn
+	addr *net.TCPAddr
+}
+
+func (c *ipConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// readLine reads a message from conn.
+func readLine(t *testing.T, conn net.Conn) string {
+	buf := make([]byte, bufSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+// joinAs joins name to the DefaultRoom over conn, and reads the join message
+// from conn and from the operator's connection.
+func joinAs(t *testing.T, cm *ChatManager, opConn net.Conn, name string, conn net.Conn) {
+	if err := cm.Join(DefaultRoom, name, conn); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	readLine(t, conn)
+	readLine(t, opConn)
 }
 
 func TestJoin(t *testing.T) {
 	// rwBuf := bufio.NewReadWriter([]byte{}, []byte{})
 	cm := NewChatManager(nil, historySize)
 	dc := dummyconn.NewDummyConn()
-	err := cm.Join("testuser", dc)
+	err := cm.Join(DefaultRoom, "testuser", dc)
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
@@ -44,11 +87,11 @@ func TestJoin(t *testing.T) {
 func TestJoinDuplicateUser(t *testing.T) {
 	cm := NewChatManager(nil, historySize)
 	dc := dummyconn.NewDummyConn()
-	err := cm.Join("testuser", dc)
+	err := cm.Join(DefaultRoom, "testuser", dc)
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
-	err = cm.Join("testuser", dc)
+	err = cm.Join(DefaultRoom, "testuser", dummyconn.NewDummyConn())
 	if err == nil || !strings.HasSuffix(err.Error(), "already connected") {
 		if err == nil {
 			t.Error("Expected error due to duplicate user")
@@ -61,14 +104,14 @@ func TestJoinDuplicateUser(t *testing.T) {
 func TestQuit(t *testing.T) {
 	cm := NewChatManager(nil, historySize)
 	dc := dummyconn.NewDummyConn()
-	err := cm.Join("testuser", dc)
+	err := cm.Join(DefaultRoom, "testuser", dc)
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
 
-	cm.Quit("testuser")
+	cm.Quit(DefaultRoom, "testuser")
 
-	err = cm.Join("testuser", dc)
+	err = cm.Join(DefaultRoom, "testuser", dc)
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
@@ -83,7 +126,7 @@ func TestBroadcast(t *testing.T) {
 	dc2 := dummyconn.NewDummyConn()
 	readBuf := make([]byte, bufSize)
 
-	err := cm.Join("testuser1", dc1)
+	err := cm.Join(DefaultRoom, "testuser1", dc1)
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
@@ -93,12 +136,13 @@ func TestBroadcast(t *testing.T) {
 	}
 	rMsg := readBuf[:n]
 	expected := []byte(testTime + " * testuser1 has joined\n")
+	expectedChatLog = append(expectedChatLog, "[lobby] "...)
 	expectedChatLog = append(expectedChatLog, expected...)
 	if !bytes.Equal(rMsg, expected) {
 		t.Fatalf("Unexpected read: %s, want: %s.", rMsg, expected)
 	}
 
-	err = cm.Join("testuser2", dc2)
+	err = cm.Join(DefaultRoom, "testuser2", dc2)
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
@@ -109,6 +153,7 @@ func TestBroadcast(t *testing.T) {
 	}
 	rMsg = readBuf[:n]
 	expected = []byte(testTime + " * testuser2 has joined\n")
+	expectedChatLog = append(expectedChatLog, "[lobby] "...)
 	expectedChatLog = append(expectedChatLog, expected...)
 	if !bytes.Equal(rMsg, expected) {
 		t.Fatalf("Unexpected read: %s, want: %s.", rMsg, expected)
@@ -123,7 +168,10 @@ func TestBroadcast(t *testing.T) {
 		t.Fatalf("Unexpected read: %s, want: %s.", rMsg, expected)
 	}
 
-	cm.Broadcast("testuser", []byte("test message"))
+	_, err = cm.Broadcast(DefaultRoom, "testuser", []byte("test message"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
 
 	n, err = dc1.Read(readBuf)
 	if err != nil {
@@ -131,6 +179,7 @@ func TestBroadcast(t *testing.T) {
 	}
 	rMsg = readBuf[:n]
 	expected = []byte(testTime + " <testuser> test message\n")
+	expectedChatLog = append(expectedChatLog, "[lobby] "...)
 	expectedChatLog = append(expectedChatLog, expected...)
 	if !bytes.Equal(rMsg, expected) {
 		t.Fatalf("Unexpected read: %s, want: %s.", rMsg, expected)
@@ -154,11 +203,10 @@ func TestBroadcast(t *testing.T) {
 	}
 }
 
-func TestDefaultTimestamp(t *testing.T) {
-	timeString := _timestamp()
-	_, err := time.Parse(timestampLayout, timeString)
-	if err != nil {
-		t.Fatal("Failed to parse time string: %s", timeString)
+func TestDefaultNow(t *testing.T) {
+	now := _now()
+	if now.Location() != time.UTC {
+		t.Errorf("Location() = %s, want: UTC", now.Location())
 	}
 }
 
@@ -173,7 +221,7 @@ func (f *FailWriter) Write(p []byte) (n int, err error) {
 func TestLogWriteFail(t *testing.T) {
 	cm := NewChatManager(&FailWriter{}, historySize)
 	dc := dummyconn.NewDummyConn()
-	err := cm.Join("testuser", dc)
+	err := cm.Join(DefaultRoom, "testuser", dc)
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
@@ -192,41 +240,41 @@ func TestLogWriteFail(t *testing.T) {
 
 func TestHistoryInsert(t *testing.T) {
 	h := newHistory(historySize)
-	msg := []byte("0")
+	msg := &Message{Body: "0"}
 	h.insert(msg)
 	if h.message.Value != nil {
 		t.Error("Expected message position to be nil")
 	}
 	prev := h.message.Prev()
-	if !bytes.Equal(prev.Value.([]byte), msg) {
-		t.Errorf("message = %s, want: %s", prev.Value.([]byte), msg)
+	if prev.Value.(*Message) != msg {
+		t.Errorf("message = %v, want: %v", prev.Value.(*Message), msg)
 	}
 }
 
 func TestHistoryInsertFull(t *testing.T) {
 	h := newHistory(historySize)
 	for i := 0; i < historySize; i++ {
-		h.insert([]byte(strconv.Itoa(i)))
+		h.insert(&Message{Body: strconv.Itoa(i)})
 	}
-	expected := []byte("0")
-	if !bytes.Equal(h.message.Value.([]byte), expected) {
-		t.Errorf("message = %s, want: %s", h.message.Value.([]byte), expected)
+	expected := "0"
+	if h.message.Value.(*Message).Body != expected {
+		t.Errorf("message = %s, want: %s", h.message.Value.(*Message).Body, expected)
 	}
-	expected = []byte("7")
+	expected = "7"
 	prev := h.message.Prev()
-	if !bytes.Equal(prev.Value.([]byte), expected) {
-		t.Errorf("message = %s, want: %s", prev.Value.([]byte), expected)
+	if prev.Value.(*Message).Body != expected {
+		t.Errorf("message = %s, want: %s", prev.Value.(*Message).Body, expected)
 	}
 }
 
 func TestHistoryMessages(t *testing.T) {
 	h := newHistory(historySize)
 	for i := 0; i < historySize; i++ {
-		h.insert([]byte(strconv.Itoa(i)))
+		h.insert(&Message{Body: strconv.Itoa(i)})
 	}
-	expected := []byte("01234567")
-	messages := h.messages(historySize + 1)
-	if !bytes.Equal(messages, expected) {
+	expected := "01234567"
+	messages := bodies(h.messages(historySize + 1))
+	if messages != expected {
 		t.Errorf("message = %s, want: %s", messages, expected)
 	}
 }
@@ -234,11 +282,11 @@ func TestHistoryMessages(t *testing.T) {
 func TestHistoryMessagesFullPlusOne(t *testing.T) {
 	h := newHistory(historySize)
 	for i := 0; i < historySize+1; i++ {
-		h.insert([]byte(strconv.Itoa(i)))
+		h.insert(&Message{Body: strconv.Itoa(i)})
 	}
-	expected := []byte("12345678")
-	messages := h.messages(historySize)
-	if !bytes.Equal(messages, expected) {
+	expected := "12345678"
+	messages := bodies(h.messages(historySize))
+	if messages != expected {
 		t.Errorf("message = %s, want: %s", messages, expected)
 	}
 }
@@ -246,32 +294,557 @@ func TestHistoryMessagesFullPlusOne(t *testing.T) {
 func TestHistoryMessagesNotFull(t *testing.T) {
 	h := newHistory(historySize)
 	for i := 0; i < historySize-1; i++ {
-		h.insert([]byte(strconv.Itoa(i)))
+		h.insert(&Message{Body: strconv.Itoa(i)})
 	}
-	expected := []byte("0123456")
-	messages := h.messages(historySize)
-	if !bytes.Equal(messages, expected) {
+	expected := "0123456"
+	messages := bodies(h.messages(historySize))
+	if messages != expected {
 		t.Errorf("message = %s, want: %s", messages, expected)
 	}
 }
 
 func TestHistoryMessagesEmpty(t *testing.T) {
 	h := newHistory(historySize)
-	expected := []byte("")
 	messages := h.messages(historySize)
-	if !bytes.Equal(messages, expected) {
-		t.Errorf("message = %s, want: %s", messages, expected)
+	if len(messages) != 0 {
+		t.Errorf("messages = %v, want none", messages)
 	}
 }
 
 func TestHistory(t *testing.T) {
 	cm := NewChatManager(nil, historySize)
 	for i := 0; i < historySize; i++ {
-		cm.history.insert([]byte(strconv.Itoa(i)))
+		cm.rooms[DefaultRoom].history.insert(&Message{Body: strconv.Itoa(i)})
 	}
-	expected := []byte("01234567")
-	messages := cm.History(historySize)
-	if !bytes.Equal(messages, expected) {
-		t.Errorf("message = %s, want: %s", messages, expected)
+	expected := "01234567"
+	messages, err := cm.History(DefaultRoom, historySize)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(messages) != expected {
+		t.Errorf("message = %s, want: %s", bodies(messages), expected)
+	}
+}
+
+func TestSetMaxHistoryLines(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	for i := 0; i < historySize; i++ {
+		cm.rooms[DefaultRoom].history.insert(&Message{Body: strconv.Itoa(i)})
+	}
+	cm.SetMaxHistoryLines(3)
+	messages, _ := cm.History(DefaultRoom, historySize)
+	if bodies(messages) != "567" {
+		t.Errorf("History after shrinking = %s, want: 567", bodies(messages))
+	}
+	cm.SetMaxHistoryLines(5)
+	cm.rooms[DefaultRoom].history.insert(&Message{Body: "8"})
+	messages, _ = cm.History(DefaultRoom, historySize)
+	if bodies(messages) != "5678" {
+		t.Errorf("History after growing = %s, want: 5678", bodies(messages))
+	}
+	cm.CreateRoom("dev")
+	if size := cm.rooms["dev"].history.maxSize; size != 5 {
+		t.Errorf("New room history size = %d, want: 5", size)
+	}
+}
+
+// TestMessageIDs makes sure that message IDs increase across rooms.
+func TestMessageIDs(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	cm.CreateRoom("dev")
+	var lastID uint64
+	for _, roomName := range []string{DefaultRoom, "dev", DefaultRoom} {
+		msg, err := cm.Broadcast(roomName, "testuser", []byte("hi\r\n"))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if msg.ID <= lastID {
+			t.Errorf("ID = %d, want > %d", msg.ID, lastID)
+		}
+		lastID = msg.ID
+		if msg.Kind != KindChat || msg.Sender != "testuser" ||
+			msg.Room != roomName || msg.Body != "hi" || !msg.Time.Equal(testNow) {
+			t.Errorf("Unexpected message: %+v", msg)
+		}
+	}
+}
+
+func TestHistoryNoSuchRoom(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	_, err := cm.History("nosuchroom", historySize)
+	if err != RoomNotFoundErr {
+		t.Errorf("err = %v, want: %v", err, RoomNotFoundErr)
+	}
+}
+
+func TestValidRoomName(t *testing.T) {
+	for _, name := range []string{"lobby", "go-nuts", "room_2"} {
+		if !ValidRoomName(name) {
+			t.Errorf("ValidRoomName(%q) = false, want: true", name)
+		}
+	}
+	for _, name := range []string{"", "has space", "#irc", strings.Repeat("x", 33), "stream", "users"} {
+		if ValidRoomName(name) {
+			t.Errorf("ValidRoomName(%q) = true, want: false", name)
+		}
+	}
+}
+
+func TestValidName(t *testing.T) {
+	for _, name := range []string{"alice", "guest-bob", "Zoë"} {
+		if !ValidName(name) {
+			t.Errorf("ValidName(%q) = false, want: true", name)
+		}
+	}
+	for _, name := range []string{"", "has space", "two\nlines", "bell\a", "nbsp\u00a0"} {
+		if ValidName(name) {
+			t.Errorf("ValidName(%q) = true, want: false", name)
+		}
+	}
+}
+
+func TestCreateRoom(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	err := cm.CreateRoom("dev")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	err = cm.CreateRoom("dev")
+	if err != RoomExistsErr {
+		t.Errorf("err = %v, want: %v", err, RoomExistsErr)
+	}
+	err = cm.CreateRoom("bad room")
+	if err != InvalidRoomNameErr {
+		t.Errorf("err = %v, want: %v", err, InvalidRoomNameErr)
+	}
+	rooms := strings.Join(cm.Rooms(), ",")
+	if rooms != "dev,lobby" {
+		t.Errorf("rooms = %s, want: dev,lobby", rooms)
+	}
+}
+
+// TestRoomIsolation makes sure that messages broadcast to one room are not
+// seen by the members of, or recorded in the history of, another room.
+func TestRoomIsolation(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	dc1 := dummyconn.NewDummyConn()
+	dc2 := dummyconn.NewDummyConn()
+	readBuf := make([]byte, bufSize)
+
+	err := cm.Join(DefaultRoom, "testuser1", dc1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = dc1.Read(readBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cm.Join("dev", "testuser2", dc2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = dc2.Read(readBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cm.Broadcast("dev", "testuser2", []byte("dev only"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	n, err := dc2.Read(readBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte(testTime + " <testuser2> dev only\n")
+	if !bytes.Equal(readBuf[:n], expected) {
+		t.Fatalf("Unexpected read: %s, want: %s.", readBuf[:n], expected)
+	}
+
+	history, err := cm.History(DefaultRoom, historySize)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	lobby := Format(TextFormatter, history)
+	expected = []byte(testTime + " * testuser1 has joined\n")
+	if !bytes.Equal(lobby, expected) {
+		t.Errorf("lobby history = %s, want: %s", lobby, expected)
+	}
+	members, err := cm.Members("dev")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Join(members, ",") != "testuser2" {
+		t.Errorf("dev members = %v, want: [testuser2]", members)
+	}
+}
+
+func TestJoinSameRoomTwice(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	dc := dummyconn.NewDummyConn()
+	err := cm.Join(DefaultRoom, "testuser", dc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	err = cm.Join(DefaultRoom, "testuser", dc)
+	if err == nil || !strings.HasSuffix(err.Error(), "already in lobby") {
+		t.Errorf("err = %v, want \"already in lobby\" error", err)
+	}
+}
+
+// TestQuitLastRoom makes sure that a name is only released once its user
+// has quit every room.
+func TestQuitLastRoom(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	dc := dummyconn.NewDummyConn()
+	err := cm.Join(DefaultRoom, "testuser", dc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	err = cm.Join("dev", "testuser", dc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	cm.Quit(DefaultRoom, "testuser")
+	err = cm.Join(DefaultRoom, "testuser", dummyconn.NewDummyConn())
+	if err == nil {
+		t.Fatal("Expected error due to duplicate user")
+	}
+
+	cm.QuitAll("testuser")
+	err = cm.Join(DefaultRoom, "testuser", dummyconn.NewDummyConn())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func TestAction(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	msg, err := cm.Action(DefaultRoom, "testuser", []byte("waves"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if msg.Kind != KindAction {
+		t.Errorf("Kind = %s, want: %s", msg.Kind, KindAction)
+	}
+	msgs, _ := cm.History(DefaultRoom, historySize)
+	history := Format(TextFormatter, msgs)
+	expected := []byte(testTime + " * testuser waves\n")
+	if !bytes.Equal(history, expected) {
+		t.Errorf("history = %s, want: %s", history, expected)
+	}
+}
+
+func TestWhisper(t *testing.T) {
+	logBuf := &bytes.Buffer{}
+	cm := NewChatManager(logBuf, historySize)
+	dc := dummyconn.NewDummyConn()
+	readBuf := make([]byte, bufSize)
+	err := cm.Join(DefaultRoom, "testuser", dc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = dc.Read(readBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logBuf.Reset()
+
+	_, err = cm.Whisper("other", "testuser", []byte("psst\r\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	n, err := dc.Read(readBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte(testTime + " *other -> testuser* psst\n")
+	if !bytes.Equal(readBuf[:n], expected) {
+		t.Fatalf("Unexpected read: %s, want: %s.", readBuf[:n], expected)
+	}
+	if logBuf.Len() != 0 {
+		t.Errorf("chat log = %s, want it empty", logBuf.String())
+	}
+	history, _ := cm.History(DefaultRoom, historySize)
+	if strings.Contains(bodies(history), "psst") {
+		t.Errorf("history = %s, want no private messages", bodies(history))
+	}
+
+	_, err = cm.Whisper("other", "nobody", []byte("psst"))
+	if nce, ok := err.(*NotConnectedError); !ok || nce.Name != "nobody" {
+		t.Errorf("err = %v, want: NotConnectedError for nobody", err)
+	}
+}
+
+func TestWhisperEcho(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	dc1 := dummyconn.NewDummyConn()
+	dc2 := dummyconn.NewDummyConn()
+	readBuf := make([]byte, bufSize)
+	err := cm.Join("room1", "testuser1", dc1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = dc1.Read(readBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cm.Join("room2", "testuser2", dc2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = dc2.Read(readBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cm.Whisper("testuser1", "testuser2", []byte("psst"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	n, err := dc1.Read(readBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte(testTime + " *testuser1 -> testuser2* psst\n")
+	if !bytes.Equal(readBuf[:n], expected) {
+		t.Fatalf("Unexpected read: %s, want: %s.", readBuf[:n], expected)
+	}
+}
+
+func TestWhisperLogged(t *testing.T) {
+	logBuf := &bytes.Buffer{}
+	cm := NewChatManager(logBuf, historySize)
+	cm.SetLogWhispers(true)
+	err := cm.Join(DefaultRoom, "testuser", dummyconn.NewDummyConn())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	logBuf.Reset()
+	_, err = cm.Whisper("other", "testuser", []byte("psst"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := testTime + " *other -> testuser* psst\n"
+	if logBuf.String() != expected {
+		t.Errorf("chat log = %s, want: %s", logBuf.String(), expected)
+	}
+}
+
+func TestReply(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	dc := dummyconn.NewDummyConn()
+	if err := cm.Join(DefaultRoom, "testuser", dc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The reply is queued after the join message, which hasn't been read
+	if err := cm.Reply(dc, []byte("Rooms: lobby\n")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	readLine(t, dc)
+	if msg := readLine(t, dc); msg != "Rooms: lobby\n" {
+		t.Errorf("Reply = %q, want: %q", msg, "Rooms: lobby\n")
+	}
+	if err := cm.Reply(dummyconn.NewDummyConn(), []byte("hi\n")); err == nil {
+		t.Error("Expected an error replying to a connection that isn't connected")
+	}
+
+	// Disconnect waits for the queued reply to be written
+	cm.Reply(dc, []byte("Bye!\n"))
+	msgCh := make(chan string)
+	go func() {
+		buf := make([]byte, bufSize)
+		n, _ := dc.Read(buf)
+		msgCh <- string(buf[:n])
+	}()
+	cm.Disconnect(dc)
+	if msg := <-msgCh; msg != "Bye!\n" {
+		t.Errorf("Reply = %q, want: %q", msg, "Bye!\n")
+	}
+}
+
+func TestRename(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	dc := dummyconn.NewDummyConn()
+	err := cm.Join(DefaultRoom, "testuser", dc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	err = cm.Join(DefaultRoom, "taken", dummyconn.NewDummyConn())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	err = cm.Rename("testuser", "taken")
+	if err == nil || !strings.HasSuffix(err.Error(), "already connected") {
+		t.Errorf("err = %v, want \"already connected\" error", err)
+	}
+	err = cm.Rename("nobody", "renamed")
+	if _, ok := err.(*NotConnectedError); !ok {
+		t.Errorf("err = %v, want: NotConnectedError", err)
+	}
+
+	err = cm.Rename("testuser", "renamed")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	members, _ := cm.Members(DefaultRoom)
+	if strings.Join(members, ",") != "renamed,taken" {
+		t.Errorf("members = %v, want: [renamed taken]", members)
+	}
+	msgs, _ := cm.History(DefaultRoom, 1)
+	history := Format(TextFormatter, msgs)
+	expected := []byte(testTime + " * testuser is now known as renamed\n")
+	if !bytes.Equal(history, expected) {
+		t.Errorf("history = %s, want: %s", history, expected)
+	}
+}
+
+// formattedConn is a connection that renders its own messages.
+type formattedConn struct {
+	net.Conn
+}
+
+func (f formattedConn) Format(m *Message) []byte {
+	return JSONFormatter.Format(m)
+}
+
+func TestJoinFormattedConn(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	dc := dummyconn.NewDummyConn()
+	err := cm.Join(DefaultRoom, "testuser", formattedConn{dc})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	buf := make([]byte, bufSize)
+	n, err := dc.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf[:n], []byte(`{"id":1,`)) {
+		t.Errorf("Unexpected read: %s, want a JSON message", buf[:n])
+	}
+}
+
+// memStore is an in-memory Store.
+type memStore struct {
+	msgs []*Message
+}
+
+func (m *memStore) Append(msg *Message) error {
+	m.msgs = append(m.msgs, msg)
+	return nil
+}
+
+func (m *memStore) Before(roomName string, id uint64, n int) ([]*Message, error) {
+	msgs := []*Message{}
+	for _, msg := range m.msgs {
+		if msg.Room == roomName && msg.ID < id {
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(msgs) > n {
+		msgs = msgs[len(msgs)-n:]
+	}
+	return msgs, nil
+}
+
+func (m *memStore) After(roomName string, id uint64, n int) ([]*Message, error) {
+	msgs := []*Message{}
+	for _, msg := range m.msgs {
+		if msg.Room == roomName && msg.ID > id && len(msgs) < n {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+func (m *memStore) Rooms() []string {
+	seen := map[string]bool{}
+	rooms := []string{}
+	for _, msg := range m.msgs {
+		if msg.Room != "" && !seen[msg.Room] {
+			seen[msg.Room] = true
+			rooms = append(rooms, msg.Room)
+		}
+	}
+	return rooms
+}
+
+func (m *memStore) LastID() uint64 {
+	if len(m.msgs) == 0 {
+		return 0
+	}
+	return m.msgs[len(m.msgs)-1].ID
+}
+
+func TestSetStore(t *testing.T) {
+	store := &memStore{}
+	for i := 1; i <= 10; i++ {
+		store.Append(&Message{ID: uint64(i), Room: "dev", Body: strconv.Itoa(i % 10)})
+	}
+	cm := NewChatManager(nil, historySize)
+	err := cm.SetStore(store)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(cm.rooms["dev"].history.messages(historySize)) != "34567890" {
+		t.Errorf("dev history = %s, want: 34567890",
+			bodies(cm.rooms["dev"].history.messages(historySize)))
+	}
+
+	msg, err := cm.Broadcast("dev", "testuser", []byte("new"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if msg.ID != 11 {
+		t.Errorf("ID = %d, want: 11", msg.ID)
+	}
+	if store.LastID() != 11 {
+		t.Errorf("store LastID() = %d, want: 11", store.LastID())
+	}
+
+	// History reads past the in-memory history from the store
+	history, err := cm.History("dev", 11)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(history) != "1234567890new" {
+		t.Errorf("history = %s, want: 1234567890new", bodies(history))
+	}
+}
+
+// TestSetStoreWhisperLast makes sure that the ID of a private message, which
+// isn't part of any room's history, isn't handed out again after a restart.
+func TestSetStoreWhisperLast(t *testing.T) {
+	store := &memStore{}
+	cm := NewChatManager(nil, historySize)
+	if err := cm.SetStore(store); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	dc := dummyconn.NewDummyConn()
+	if err := cm.Join(DefaultRoom, "testuser", dc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	readLine(t, dc)
+	go cm.Whisper("testuser", "testuser", []byte("note to self"))
+	readLine(t, dc)
+	whisperID := store.LastID()
+	if whisperID != 2 {
+		t.Fatalf("store LastID() = %d after the whisper, want: 2", whisperID)
+	}
+
+	// Restart
+	cm = NewChatManager(nil, historySize)
+	if err := cm.SetStore(store); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	msg, err := cm.Broadcast(DefaultRoom, "testuser", []byte("hi"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if msg.ID <= whisperID {
+		t.Errorf("ID = %d after the restart, want more than %d", msg.ID, whisperID)
 	}
 }
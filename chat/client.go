@@ -0,0 +1,209 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// OverflowPolicy decides what happens when a message is sent to a client
+// whose outbound queue is full (i.e., a slow consumer).
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest queued message to make room.
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the message being sent.
+	DropNewest
+	// Disconnect disconnects the client.
+	Disconnect
+)
+
+// policyNames maps the names accepted by ParseOverflowPolicy to policies.
+var policyNames = map[string]OverflowPolicy{
+	"drop_oldest": DropOldest,
+	"drop_newest": DropNewest,
+	"disconnect":  Disconnect,
+}
+
+// ParseOverflowPolicy returns the OverflowPolicy named by name
+// ("drop_oldest", "drop_newest" or "disconnect").
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	policy, ok := policyNames[name]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Unknown overflow policy: %s", name))
+	}
+	return policy, nil
+}
+
+func (p OverflowPolicy) String() string {
+	for name, policy := range policyNames {
+		if policy == p {
+			return name
+		}
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+const (
+	defaultQueueSize = 256
+	defaultPolicy    = DropOldest
+)
+
+// outQueue is a bounded queue of rendered messages waiting to be written to
+// a client.
+type outQueue struct {
+	items  [][]byte
+	max    int
+	closed bool
+	mu     sync.Mutex
+	cond   *sync.Cond
+}
+
+// newOutQueue returns an empty queue that holds up to max messages.
+func newOutQueue(max int) *outQueue {
+	q := &outQueue{max: max}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push adds msg to the queue, applying policy if the queue is full.  It
+// returns whether a message was dropped and whether the client should be
+// disconnected.  Messages pushed to a closed queue are ignored.
+func (q *outQueue) push(msg []byte, policy OverflowPolicy) (dropped bool, disconnect bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false, false
+	}
+	if len(q.items) >= q.max {
+		switch policy {
+		case DropNewest:
+			return true, false
+		case Disconnect:
+			return true, true
+		default:
+			q.items = q.items[1:]
+			dropped = true
+		}
+	}
+	q.items = append(q.items, msg)
+	q.cond.Signal()
+	return dropped, false
+}
+
+// pop removes and returns the oldest message, waiting for one if the queue
+// is empty.  ok is false once the queue is closed and empty.
+func (q *outQueue) pop() (msg []byte, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	msg = q.items[0]
+	q.items = q.items[1:]
+	return msg, true
+}
+
+// close closes the queue.  Messages that are already queued can still be
+// popped.
+func (q *outQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// client is a user connected to the ChatManager.  Messages are written to
+// the client's connection, in order, by a single writer goroutine that
+// reads from the client's queue.
+type client struct {
+	name       string
+	conn       net.Conn
+	formatter  Formatter
+	transport  string
+	connected  time.Time
+	lastActive time.Time
+	away       *Away
+	queue      *outQueue
+	policy     OverflowPolicy
+	dropped    uint64
+	done       chan struct{}
+}
+
+// newClient returns a client, connected at now, and starts its writer
+// goroutine.  onError is called (from the writer goroutine) if writing to
+// conn fails.
+func newClient(name string, conn net.Conn, now time.Time, queueSize int, policy OverflowPolicy, onError func(*client, error)) *client {
+	cl := &client{
+		name:       name,
+		conn:       conn,
+		formatter:  TextFormatter,
+		transport:  DefaultTransport,
+		connected:  now,
+		lastActive: now,
+		queue:      newOutQueue(queueSize),
+		policy:     policy,
+		done:       make(chan struct{}),
+	}
+	if f, ok := conn.(Formatter); ok {
+		cl.formatter = f
+	}
+	if t, ok := conn.(Transporter); ok {
+		cl.transport = t.Transport()
+	}
+	go cl.writeLoop(onError)
+	return cl
+}
+
+// writeLoop writes queued messages to the client's connection until the
+// queue is closed or a write fails.
+func (cl *client) writeLoop(onError func(*client, error)) {
+	defer close(cl.done)
+	for {
+		msg, ok := cl.queue.pop()
+		if !ok {
+			return
+		}
+		_, err := cl.conn.Write(msg)
+		if err != nil {
+			cl.queue.close()
+			onError(cl, err)
+			return
+		}
+	}
+}
+
+// deliver queues msg, rendered with the client's Formatter, for writing to
+// the client (but does not lock any shared state; it should only be used if
+// you already hold the ChatManager's lock).  It returns whether a message
+// was dropped, and false if the client is too slow and should be
+// disconnected.
+func (cl *client) deliver(msg *Message) (dropped bool, ok bool) {
+	dropped, disconnect := cl.queue.push(cl.formatter.Format(msg), cl.policy)
+	if dropped {
+		cl.dropped++
+		log.Printf("Dropped message %d for slow client %s (%d dropped, policy: %s)",
+			msg.ID, cl.name, cl.dropped, cl.policy)
+	}
+	return dropped, !disconnect
+}
+
+// reply queues data, as is, for writing to the client (but does not lock
+// any shared state; it should only be used if you already hold the
+// ChatManager's lock).  It returns the same as deliver.
+func (cl *client) reply(data []byte) (dropped bool, ok bool) {
+	dropped, disconnect := cl.queue.push(data, cl.policy)
+	if dropped {
+		cl.dropped++
+		log.Printf("Dropped a reply for slow client %s (%d dropped, policy: %s)",
+			cl.name, cl.dropped, cl.policy)
+	}
+	return dropped, !disconnect
+}
@@ -0,0 +1,183 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/dummyconn"
+)
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for name, expected := range policyNames {
+		policy, err := ParseOverflowPolicy(name)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if policy != expected || policy.String() != name {
+			t.Errorf("ParseOverflowPolicy(%s) = %s, want: %s", name, policy, expected)
+		}
+	}
+	_, err := ParseOverflowPolicy("block")
+	if err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+}
+
+// fill returns a queue holding "1" and "2" (i.e., full).
+func fill() *outQueue {
+	q := newOutQueue(2)
+	q.push([]byte("1"), DropOldest)
+	q.push([]byte("2"), DropOldest)
+	return q
+}
+
+// drain returns the queued messages, concatenated.
+func drain(q *outQueue) string {
+	q.close()
+	out := ""
+	for {
+		msg, ok := q.pop()
+		if !ok {
+			return out
+		}
+		out += string(msg)
+	}
+}
+
+func TestOutQueueDropOldest(t *testing.T) {
+	q := fill()
+	dropped, disconnect := q.push([]byte("3"), DropOldest)
+	if !dropped || disconnect {
+		t.Errorf("push = (%t, %t), want: (true, false)", dropped, disconnect)
+	}
+	if out := drain(q); out != "23" {
+		t.Errorf("queue = %s, want: 23", out)
+	}
+}
+
+func TestOutQueueDropNewest(t *testing.T) {
+	q := fill()
+	dropped, disconnect := q.push([]byte("3"), DropNewest)
+	if !dropped || disconnect {
+		t.Errorf("push = (%t, %t), want: (true, false)", dropped, disconnect)
+	}
+	if out := drain(q); out != "12" {
+		t.Errorf("queue = %s, want: 12", out)
+	}
+}
+
+func TestOutQueueDisconnect(t *testing.T) {
+	q := fill()
+	dropped, disconnect := q.push([]byte("3"), Disconnect)
+	if !dropped || !disconnect {
+		t.Errorf("push = (%t, %t), want: (true, true)", dropped, disconnect)
+	}
+}
+
+func TestOutQueueClosed(t *testing.T) {
+	q := newOutQueue(2)
+	q.close()
+	q.push([]byte("1"), DropOldest)
+	if _, ok := q.pop(); ok {
+		t.Error("Expected closed queue to be empty")
+	}
+}
+
+// TestWriteOrder makes sure that messages are written to a client in the
+// order that they were sent.
+func TestWriteOrder(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	dc := dummyconn.NewDummyConn()
+	err := cm.Join(DefaultRoom, "testuser", dc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, body := range []string{"1", "2", "3", "4"} {
+		cm.Broadcast(DefaultRoom, "testuser", []byte(body))
+	}
+	buf := make([]byte, bufSize)
+	expected := []string{"has joined", "1", "2", "3", "4"}
+	for _, body := range expected {
+		n, err := dc.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[n-len(body)-1:n-1]) != body {
+			t.Fatalf("Unexpected read: %s, want it to end with: %s", buf[:n], body)
+		}
+	}
+}
+
+// waitForQuit waits for name to no longer be connected to cm.
+func waitForQuit(t *testing.T, cm *ChatManager, name string) {
+	for i := 0; i < 100; i++ {
+		members, _ := cm.Members(DefaultRoom)
+		found := false
+		for _, member := range members {
+			found = found || member == name
+		}
+		if !found {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s never quit", name)
+}
+
+func TestWriteErrorQuits(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	dc := dummyconn.NewDummyConn()
+	dc.Close()
+	err := cm.Join(DefaultRoom, "testuser", dc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	waitForQuit(t, cm, "testuser")
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	cm.SetQueuePolicy(1, Disconnect)
+	// Nothing ever reads from dc, so the first message blocks the writer
+	// and the second one fills the queue.
+	dc := dummyconn.NewDummyConn()
+	err := cm.Join(DefaultRoom, "testuser", dc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		cm.Broadcast(DefaultRoom, "other", []byte("flood"))
+	}
+	waitForQuit(t, cm, "testuser")
+	if cm.Dropped() == 0 {
+		t.Error("Expected dropped messages to be counted")
+	}
+}
+
+func TestSlowConsumerDropOldest(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	cm.SetQueuePolicy(1, DropOldest)
+	dc := dummyconn.NewDummyConn()
+	err := cm.Join(DefaultRoom, "testuser", dc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Give the writer time to pick up the join message (and block on it).
+	time.Sleep(10 * time.Millisecond)
+	for _, body := range []string{"1", "2", "3"} {
+		cm.Broadcast(DefaultRoom, "other", []byte(body))
+	}
+	if cm.Dropped() != 2 {
+		t.Errorf("Dropped() = %d, want: 2", cm.Dropped())
+	}
+	buf := make([]byte, bufSize)
+	for _, body := range []string{"has joined", "3"} {
+		n, err := dc.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[n-len(body)-1:n-1]) != body {
+			t.Fatalf("Unexpected read: %s, want it to end with: %s", buf[:n], body)
+		}
+	}
+}
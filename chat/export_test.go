@@ -0,0 +1,26 @@
+package chat
+
+import (
+	"net"
+)
+
+// The tests that use internal/chattest are in package chat_test (chattest
+// imports chat, so package chat's own tests can't import it).  These are
+// the helpers of package chat's tests that they share.
+
+const (
+	HistorySize = historySize
+	BufSize     = bufSize
+	TestTime    = testTime
+)
+
+var (
+	TestNow  = testNow
+	ReadLine = readLine
+	JoinAs   = joinAs
+)
+
+// NewIPConn returns conn as a connection from addr.
+func NewIPConn(conn net.Conn, addr *net.TCPAddr) net.Conn {
+	return &ipConn{conn, addr}
+}
@@ -0,0 +1,103 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Based on Go's reference time
+const timestampLayout = "02-Jan-06 15:04"
+
+// Formatter renders a Message for a client or the chat log.  Rendered
+// messages end with a newline.
+type Formatter interface {
+	Format(m *Message) []byte
+}
+
+// FormatterFunc is an adapter to allow the use of ordinary functions as
+// Formatters.
+type FormatterFunc func(m *Message) []byte
+
+// Format calls f(m).
+func (f FormatterFunc) Format(m *Message) []byte {
+	return f(m)
+}
+
+// TextFormatter renders messages as plain-text lines, e.g.,
+// "02-Jan-06 15:04 <name> hello".
+var TextFormatter Formatter = FormatterFunc(formatText)
+
+// JSONFormatter renders messages as JSON objects, one per line.
+var JSONFormatter Formatter = FormatterFunc(formatJSON)
+
+// LogFormatter renders messages like TextFormatter, prefixed with the room
+// the message was sent to.  It is the default chat log format.
+var LogFormatter Formatter = FormatterFunc(formatLog)
+
+// ResultFormatter renders messages like LogFormatter, prefixed with the
+// message ID, e.g., "#42 [lobby] 02-Jan-06 15:04 <name> hello".  It is
+// meant for search results.
+var ResultFormatter Formatter = FormatterFunc(formatResult)
+
+// formatters maps the names accepted by FormatterByName to Formatters.
+var formatters = map[string]Formatter{
+	"text": TextFormatter,
+	"json": JSONFormatter,
+	"log":  LogFormatter,
+}
+
+// FormatterByName returns the Formatter registered under name ("text",
+// "json" or "log").
+func FormatterByName(name string) (f Formatter, ok bool) {
+	f, ok = formatters[name]
+	return f, ok
+}
+
+// Format renders msgs in order with f.
+func Format(f Formatter, msgs []*Message) []byte {
+	out := []byte{}
+	for _, m := range msgs {
+		out = append(out, f.Format(m)...)
+	}
+	return out
+}
+
+func formatText(m *Message) []byte {
+	ts := m.Time.Format(timestampLayout)
+	switch m.Kind {
+	case KindChat:
+		return []byte(fmt.Sprintf("%s <%s> %s\n", ts, m.Sender, m.Body))
+	case KindPrivate:
+		return []byte(fmt.Sprintf("%s *%s -> %s* %s\n", ts, m.Sender, m.To, m.Body))
+	case KindNotice:
+		return []byte(fmt.Sprintf("%s *** %s\n", ts, m.Body))
+	case KindAway:
+		if m.Body == "" {
+			return []byte(fmt.Sprintf("%s *** %s is away\n", ts, m.Sender))
+		}
+		return []byte(fmt.Sprintf("%s *** %s is away: %s\n", ts, m.Sender, m.Body))
+	}
+	return []byte(fmt.Sprintf("%s * %s %s\n", ts, m.Sender, m.Body))
+}
+
+func formatJSON(m *Message) []byte {
+	out, err := json.Marshal(m)
+	if err != nil {
+		// A Message only holds marshalable types, so this is a bug.
+		log.Printf("Error marshaling message %d: %s", m.ID, err)
+		return nil
+	}
+	return append(out, '\n')
+}
+
+func formatLog(m *Message) []byte {
+	if m.Room == "" {
+		return formatText(m)
+	}
+	return append([]byte("["+m.Room+"] "), formatText(m)...)
+}
+
+func formatResult(m *Message) []byte {
+	return append([]byte(fmt.Sprintf("#%d ", m.ID)), formatLog(m)...)
+}
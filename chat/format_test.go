@@ -0,0 +1,71 @@
+package chat
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTextFormatter(t *testing.T) {
+	tests := []struct {
+		msg      *Message
+		expected string
+	}{
+		{&Message{Time: testNow, Sender: "bob", Kind: KindChat, Body: "hi"},
+			testTime + " <bob> hi\n"},
+		{&Message{Time: testNow, Sender: "bob", Kind: KindAction, Body: "waves"},
+			testTime + " * bob waves\n"},
+		{&Message{Time: testNow, Sender: "bob", Kind: KindJoin, Body: "has joined"},
+			testTime + " * bob has joined\n"},
+		{&Message{Time: testNow, Sender: "bob", To: "amy", Kind: KindPrivate, Body: "psst"},
+			testTime + " *bob -> amy* psst\n"},
+	}
+	for _, test := range tests {
+		out := string(TextFormatter.Format(test.msg))
+		if out != test.expected {
+			t.Errorf("Format(%+v) = %q, want: %q", test.msg, out, test.expected)
+		}
+	}
+}
+
+func TestLogFormatter(t *testing.T) {
+	msg := &Message{Time: testNow, Sender: "bob", Room: "dev", Kind: KindChat, Body: "hi"}
+	expected := "[dev] " + testTime + " <bob> hi\n"
+	if out := string(LogFormatter.Format(msg)); out != expected {
+		t.Errorf("Format = %q, want: %q", out, expected)
+	}
+}
+
+func TestResultFormatter(t *testing.T) {
+	msg := &Message{ID: 42, Time: testNow, Sender: "bob", Room: "dev", Kind: KindChat, Body: "hi"}
+	expected := "#42 [dev] " + testTime + " <bob> hi\n"
+	if out := string(ResultFormatter.Format(msg)); out != expected {
+		t.Errorf("Format = %q, want: %q", out, expected)
+	}
+}
+
+func TestJSONFormatter(t *testing.T) {
+	msg := &Message{7, testNow, "bob", "dev", "", KindChat, "hi"}
+	out := JSONFormatter.Format(msg)
+	if out[len(out)-1] != '\n' {
+		t.Errorf("Format = %q, want a trailing newline", out)
+	}
+	decoded := &Message{}
+	err := json.Unmarshal(out, decoded)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if *decoded != *msg {
+		t.Errorf("decoded = %+v, want: %+v", decoded, msg)
+	}
+}
+
+func TestFormatterByName(t *testing.T) {
+	for _, name := range []string{"text", "json", "log"} {
+		if _, ok := FormatterByName(name); !ok {
+			t.Errorf("Expected a %s formatter", name)
+		}
+	}
+	if _, ok := FormatterByName("xml"); ok {
+		t.Error("Expected no xml formatter")
+	}
+}
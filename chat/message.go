@@ -0,0 +1,46 @@
+package chat
+
+import (
+	"time"
+)
+
+// overwritable for testing
+var Now func() time.Time = _now
+
+func _now() time.Time {
+	return time.Now().UTC()
+}
+
+// Kind indicates what sort of event a Message describes.
+type Kind string
+
+const (
+	KindChat    Kind = "chat"
+	KindAction  Kind = "action"
+	KindJoin    Kind = "join"
+	KindQuit    Kind = "quit"
+	KindNick    Kind = "nick"
+	KindPrivate Kind = "private"
+	// KindNotice is a notice from the server to everyone (e.g., that it
+	// is shutting down) or to a single user.  Notices have no sender and
+	// no room, and since they aren't part of any room's stream (and
+	// aren't stored), no ID either.
+	KindNotice Kind = "notice"
+	// KindAway is an automatic reply from a user that is away (Sender)
+	// to a user (To) that sent it a private message or mentioned it.  The
+	// Body is the away reason.  Automatic replies have no room.
+	KindAway Kind = "away"
+)
+
+// Message is a single chat event.  IDs are assigned by the ChatManager and
+// increase monotonically across all rooms.  Private messages have an empty
+// Room and the recipient in To.
+type Message struct {
+	ID     uint64    `json:"id"`
+	Time   time.Time `json:"timestamp"`
+	Sender string    `json:"sender"`
+	Room   string    `json:"room,omitempty"`
+	To     string    `json:"to,omitempty"`
+	Kind   Kind      `json:"kind"`
+	Body   string    `json:"body"`
+}
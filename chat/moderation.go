@@ -0,0 +1,428 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SanctionKind is what a Sanction does to its target.
+type SanctionKind string
+
+const (
+	// SanctionBan keeps the target from joining and sending.
+	SanctionBan SanctionKind = "ban"
+	// SanctionMute keeps the target from sending.
+	SanctionMute SanctionKind = "mute"
+)
+
+// kickGrace is how long a kicked client has to receive the notice that it
+// was kicked before its connection is closed.
+const kickGrace = 5 * time.Second
+
+var ModerationDisabledErr = errors.New("Moderation is disabled")
+var OperatorErr = errors.New("Operators can't be kicked, banned or muted")
+var OperatorNeedsRegistrationErr = errors.New("Only registered names can be operators")
+var InvalidTargetErr = errors.New("Invalid target")
+var NotBannedErr = errors.New("Not banned")
+var NotMutedErr = errors.New("Not muted")
+
+// Sanction is a ban or a mute imposed by an operator.  The target of a mute
+// is a name; the target of a ban is a name, an IP address or a CIDR block
+// (e.g., "10.0.0.0/8").  A zero Expires means that the sanction doesn't
+// expire.
+type Sanction struct {
+	Kind    SanctionKind `json:"kind"`
+	Target  string       `json:"target"`
+	By      string       `json:"by"`
+	Reason  string       `json:"reason,omitempty"`
+	Created time.Time    `json:"created"`
+	Expires time.Time    `json:"expires,omitzero"`
+}
+
+// expired returns a bool indicating whether the sanction has expired at now.
+func (s *Sanction) expired(now time.Time) bool {
+	return !s.Expires.IsZero() && !now.Before(s.Expires)
+}
+
+// matches returns a bool indicating whether the sanction applies to name or
+// to the address ip (which may be nil).
+func (s *Sanction) matches(name string, ip net.IP) bool {
+	if s.Target == name {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	if _, block, err := net.ParseCIDR(s.Target); err == nil {
+		return block.Contains(ip)
+	}
+	target := net.ParseIP(s.Target)
+	return target != nil && target.Equal(ip)
+}
+
+// Describe returns e.g. " until 02-Jan-06 15:04: spam", for the parts of the
+// sanction that are set.
+func (s *Sanction) Describe() string {
+	desc := ""
+	if !s.Expires.IsZero() {
+		desc += " until " + s.Expires.Format(timestampLayout)
+	}
+	if s.Reason != "" {
+		desc += ": " + s.Reason
+	}
+	return desc
+}
+
+// SanctionedError is returned when a banned user joins or sends a message,
+// or when a muted user sends one.
+type SanctionedError struct {
+	Sanction *Sanction
+}
+
+func (e *SanctionedError) Error() string {
+	if e.Sanction.Kind == SanctionMute {
+		return "Muted" + e.Sanction.Describe()
+	}
+	return "Banned" + e.Sanction.Describe()
+}
+
+// Moderation holds the sanctions in effect and the names that operators
+// have made operators.
+type Moderation interface {
+	// IsOperator returns a bool indicating whether name has been made an
+	// operator.
+	IsOperator(name string) bool
+	// Operators returns the names that have been made operators.
+	Operators() []string
+	// AddOperator makes name an operator.
+	AddOperator(name string) error
+	// Sanctions returns the sanctions, including any that have expired.
+	Sanctions() []*Sanction
+	// AddSanction adds a sanction, replacing any sanction of the same
+	// kind against the same target.
+	AddSanction(s *Sanction) error
+	// RemoveSanction removes the sanction of a kind against target and
+	// returns a bool indicating whether there was one.
+	RemoveSanction(kind SanctionKind, target string) (bool, error)
+}
+
+// SetModeration sets the Moderation that bans, mutes and operators granted
+// with Op are kept in.  Without one, only the operators set with
+// SetOperators can moderate, and they can only kick.
+func (c *ChatManager) SetModeration(moderation Moderation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.moderation = moderation
+}
+
+// SetOperators sets the names that are operators regardless of the
+// Moderation (e.g., from the configuration).  Operators must be registered
+// (see SetAccounts); an unregistered name is never an operator.
+func (c *ChatManager) SetOperators(names []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.operators = map[string]bool{}
+	for _, name := range names {
+		c.operators[name] = true
+	}
+}
+
+// isOperator returns a bool indicating whether name is an operator (but does
+// not lock any shared state; it should only be used if you already hold the
+// appropriate locks).
+func (c *ChatManager) isOperator(name string) bool {
+	if c.accounts == nil || !c.accounts.Registered(name) {
+		return false
+	}
+	return c.operators[name] || (c.moderation != nil && c.moderation.IsOperator(name))
+}
+
+// IsOperator returns a bool indicating whether name is an operator.
+func (c *ChatManager) IsOperator(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.isOperator(name)
+}
+
+// Operators returns the sorted names of the operators.
+func (c *ChatManager) Operators() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := []string{}
+	for name := range c.operators {
+		names = append(names, name)
+	}
+	if c.moderation != nil {
+		for _, name := range c.moderation.Operators() {
+			if !c.operators[name] {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Op makes name (which must be registered) an operator.  by must be an
+// operator.
+func (c *ChatManager) Op(by string, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.isOperator(by) {
+		return PermissionDeniedErr
+	}
+	if c.moderation == nil {
+		return ModerationDisabledErr
+	}
+	if !c.accounts.Registered(name) {
+		return OperatorNeedsRegistrationErr
+	}
+	if err := c.moderation.AddOperator(name); err != nil {
+		return err
+	}
+	log.Printf("%s has made %s an operator", by, name)
+	return nil
+}
+
+// sanction returns the sanction of a kind in effect against name or the
+// address ip, or nil if there is none (but does not lock any shared state;
+// it should only be used if you already hold the appropriate locks).
+// Operators are never sanctioned.
+func (c *ChatManager) sanction(kind SanctionKind, name string, ip net.IP) *Sanction {
+	if c.moderation == nil || c.isOperator(name) {
+		return nil
+	}
+	now := c.clock()
+	for _, s := range c.moderation.Sanctions() {
+		if s.Kind == kind && !s.expired(now) && s.matches(name, ip) {
+			return s
+		}
+	}
+	return nil
+}
+
+// checkSender returns a *SanctionedError if name is banned or muted (but
+// does not lock any shared state; it should only be used if you already
+// hold the appropriate locks).
+func (c *ChatManager) checkSender(name string) error {
+	if s := c.sanction(SanctionBan, name, nil); s != nil {
+		return &SanctionedError{s}
+	}
+	if s := c.sanction(SanctionMute, name, nil); s != nil {
+		return &SanctionedError{s}
+	}
+	return nil
+}
+
+// remoteIP returns the IP address that conn is from, or nil if it isn't an
+// IP connection.
+func remoteIP(conn net.Conn) net.IP {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// CheckAddress returns a *SanctionedError if the IP address addr is banned.
+// It is meant for clients that send messages without joining (see Join,
+// which checks the address of the connection).
+func (c *ChatManager) CheckAddress(addr string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+	if s := c.sanction(SanctionBan, "", ip); s != nil {
+		return &SanctionedError{s}
+	}
+	return nil
+}
+
+// Sanctions returns the sanctions in effect, oldest first.
+func (c *ChatManager) Sanctions() []*Sanction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	active := []*Sanction{}
+	if c.moderation == nil {
+		return active
+	}
+	now := c.clock()
+	for _, s := range c.moderation.Sanctions() {
+		if !s.expired(now) {
+			active = append(active, s)
+		}
+	}
+	sort.SliceStable(active, func(i, j int) bool {
+		return active[i].Created.Before(active[j].Created)
+	})
+	return active
+}
+
+// notify sends a notice to a single client (but does not lock any shared
+// state; it should only be used if you already hold the appropriate locks).
+func (c *ChatManager) notify(cl *client, notice string) {
+	if !c.deliver(cl, c.newNotice(notice)) {
+		c.dropSlow(cl)
+	}
+}
+
+// kick tells a client that an operator (by) has removed it, removes it from
+// every room, and closes its connection once it has been told or after
+// kickGrace (but does not lock any shared state; it should only be used if
+// you already hold the appropriate locks).  done is e.g. "kicked" and desc
+// is appended to the messages (see Sanction.Describe).
+func (c *ChatManager) kick(cl *client, done string, by string, desc string) {
+	log.Printf("%s has been %s by %s%s", cl.name, done, by, desc)
+	c.notify(cl, fmt.Sprintf("You have been %s by %s%s", done, by, desc))
+	c.remove(cl, fmt.Sprintf("has been %s by %s%s", done, by, desc))
+	go func() {
+		timer := time.NewTimer(kickGrace)
+		defer timer.Stop()
+		select {
+		case <-cl.done:
+		case <-timer.C:
+		}
+		cl.conn.Close()
+	}()
+}
+
+// Kick disconnects a user.  by must be an operator; operators can't be
+// kicked.
+func (c *ChatManager) Kick(by string, name string, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ShuttingDownErr
+	}
+	if !c.isOperator(by) {
+		return PermissionDeniedErr
+	}
+	cl, ok := c.nameToClient[name]
+	if !ok {
+		return &NotConnectedError{name}
+	}
+	if c.isOperator(name) {
+		return OperatorErr
+	}
+	desc := ""
+	if reason != "" {
+		desc = ": " + reason
+	}
+	c.kick(cl, "kicked", by, desc)
+	return nil
+}
+
+// newSanction checks and returns a new sanction by an operator (but does not
+// lock any shared state; it should only be used if you already hold the
+// appropriate locks).  A d of 0 means that it doesn't expire.
+func (c *ChatManager) newSanction(kind SanctionKind, by string, target string, d time.Duration, reason string) (*Sanction, error) {
+	if !c.isOperator(by) {
+		return nil, PermissionDeniedErr
+	}
+	if c.moderation == nil {
+		return nil, ModerationDisabledErr
+	}
+	if target == "" || strings.ContainsAny(target, " \t\r\n") || d < 0 {
+		return nil, InvalidTargetErr
+	}
+	if c.isOperator(target) {
+		return nil, OperatorErr
+	}
+	now := c.clock()
+	s := &Sanction{kind, target, by, reason, now, time.Time{}}
+	if d > 0 {
+		s.Expires = now.Add(d)
+	}
+	return s, nil
+}
+
+// Ban bans a name, an IP address or a CIDR block (target) for d (0 for
+// good), and kicks the users it applies to.  by must be an operator;
+// operators can't be banned, by name or by address.
+func (c *ChatManager) Ban(by string, target string, d time.Duration, reason string) (*Sanction, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, err := c.newSanction(SanctionBan, by, target, d, reason)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.moderation.AddSanction(s); err != nil {
+		return nil, err
+	}
+	log.Printf("%s has banned %s%s", by, target, s.Describe())
+	for _, cl := range c.nameToClient {
+		if !c.isOperator(cl.name) && s.matches(cl.name, remoteIP(cl.conn)) {
+			c.kick(cl, "banned", by, s.Describe())
+		}
+	}
+	return s, nil
+}
+
+// Unban lifts the ban of target.  by must be an operator.
+func (c *ChatManager) Unban(by string, target string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.isOperator(by) {
+		return PermissionDeniedErr
+	}
+	if c.moderation == nil {
+		return ModerationDisabledErr
+	}
+	ok, err := c.moderation.RemoveSanction(SanctionBan, target)
+	if err != nil {
+		return err
+	} else if !ok {
+		return NotBannedErr
+	}
+	log.Printf("%s has unbanned %s", by, target)
+	return nil
+}
+
+// Mute keeps name from sending messages for d (0 for good).  by must be an
+// operator; operators can't be muted.
+func (c *ChatManager) Mute(by string, name string, d time.Duration, reason string) (*Sanction, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, err := c.newSanction(SanctionMute, by, name, d, reason)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.moderation.AddSanction(s); err != nil {
+		return nil, err
+	}
+	log.Printf("%s has muted %s%s", by, name, s.Describe())
+	if cl, ok := c.nameToClient[name]; ok {
+		c.notify(cl, fmt.Sprintf("You have been muted by %s%s", by, s.Describe()))
+	}
+	return s, nil
+}
+
+// Unmute lets name send messages again.  by must be an operator.
+func (c *ChatManager) Unmute(by string, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.isOperator(by) {
+		return PermissionDeniedErr
+	}
+	if c.moderation == nil {
+		return ModerationDisabledErr
+	}
+	ok, err := c.moderation.RemoveSanction(SanctionMute, name)
+	if err != nil {
+		return err
+	} else if !ok {
+		return NotMutedErr
+	}
+	log.Printf("%s has unmuted %s", by, name)
+	if cl, ok := c.nameToClient[name]; ok {
+		c.notify(cl, "You are no longer muted")
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package chat_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+	"github.com/bgmerrell/gochatd/dummyconn"
+	"github.com/bgmerrell/gochatd/internal/chattest"
+)
+
+// memModeration is an in-memory Moderation.
+type memModeration struct {
+	operators map[string]bool
+	sanctions []*chat.Sanction
+}
+
+func newMemModeration() *memModeration {
+	return &memModeration{map[string]bool{}, nil}
+}
+
+func (m *memModeration) IsOperator(name string) bool {
+	return m.operators[name]
+}
+
+func (m *memModeration) Operators() []string {
+	names := []string{}
+	for name := range m.operators {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (m *memModeration) AddOperator(name string) error {
+	m.operators[name] = true
+	return nil
+}
+
+func (m *memModeration) Sanctions() []*chat.Sanction {
+	return m.sanctions
+}
+
+func (m *memModeration) AddSanction(s *chat.Sanction) error {
+	m.RemoveSanction(s.Kind, s.Target)
+	m.sanctions = append(m.sanctions, s)
+	return nil
+}
+
+func (m *memModeration) RemoveSanction(kind chat.SanctionKind, target string) (bool, error) {
+	for i, s := range m.sanctions {
+		if s.Kind == kind && s.Target == target {
+			m.sanctions = append(m.sanctions[:i], m.sanctions[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// newModeratedChat returns a ChatManager whose operator is alice, with bob
+// also registered, and the dummyconn that alice has joined over.
+func newModeratedChat(t *testing.T) (*chat.ChatManager, net.Conn) {
+	cm := chat.NewChatManager(nil, chat.HistorySize)
+	cm.SetAccounts(chattest.MemAccounts{"alice": "secret1", "bob": "secret2"}, false)
+	cm.SetOperators([]string{"alice"})
+	cm.SetModeration(newMemModeration())
+	dc := dummyconn.NewDummyConn()
+	if err := cm.Join(chat.DefaultRoom, "alice", dc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	chat.ReadLine(t, dc)
+	return cm, dc
+}
+
+func TestKick(t *testing.T) {
+	cm, aliceConn := newModeratedChat(t)
+	bobConn := dummyconn.NewDummyConn()
+	chat.JoinAs(t, cm, aliceConn, "bob", bobConn)
+
+	if err := cm.Kick("bob", "alice", ""); err != chat.PermissionDeniedErr {
+		t.Errorf("Kick by bob error = %v, want: %s", err, chat.PermissionDeniedErr)
+	}
+	if err := cm.Kick("alice", "alice", ""); err != chat.OperatorErr {
+		t.Errorf("Kick(alice) error = %v, want: %s", err, chat.OperatorErr)
+	}
+	if err := cm.Kick("alice", "carol", ""); err == nil {
+		t.Error("Expected an error for kicking a user that isn't connected")
+	}
+	go func() {
+		if err := cm.Kick("alice", "bob", "spam"); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	}()
+	expected := chat.TestTime + " *** You have been kicked by alice: spam\n"
+	if got := chat.ReadLine(t, bobConn); got != expected {
+		t.Errorf("Read: %q, want: %q", got, expected)
+	}
+	if _, err := bobConn.Read(make([]byte, chat.BufSize)); err == nil {
+		t.Error("Expected bob's connection to be closed")
+	}
+	expected = chat.TestTime + " * bob has been kicked by alice: spam\n"
+	if got := chat.ReadLine(t, aliceConn); got != expected {
+		t.Errorf("Read: %q, want: %q", got, expected)
+	}
+	if members, _ := cm.Members(chat.DefaultRoom); len(members) != 1 {
+		t.Errorf("Members = %v, want: [alice]", members)
+	}
+}
+
+func TestBan(t *testing.T) {
+	cm, aliceConn := newModeratedChat(t)
+	bobConn := dummyconn.NewDummyConn()
+	chat.JoinAs(t, cm, aliceConn, "bob", bobConn)
+
+	if _, err := cm.Ban("alice", "alice", 0, ""); err != chat.OperatorErr {
+		t.Errorf("Ban(alice) error = %v, want: %s", err, chat.OperatorErr)
+	}
+	go cm.Ban("alice", "bob", time.Hour, "spam")
+	expected := chat.TestTime + " *** You have been banned by alice until 02-Jan-06 16:04: spam\n"
+	if got := chat.ReadLine(t, bobConn); got != expected {
+		t.Errorf("Read: %q, want: %q", got, expected)
+	}
+	chat.ReadLine(t, aliceConn)
+
+	err := cm.Join(chat.DefaultRoom, "bob", dummyconn.NewDummyConn())
+	if _, ok := err.(*chat.SanctionedError); !ok {
+		t.Errorf("Join of a banned name error = %v, want a *SanctionedError", err)
+	}
+	if _, err = cm.Broadcast(chat.DefaultRoom, "bob", []byte("hi")); err == nil ||
+		err.Error() != "Banned until 02-Jan-06 16:04: spam" {
+		t.Errorf("Broadcast by a banned name error = %v", err)
+	}
+	cm.SetClock(func() time.Time { return chat.TestNow.Add(time.Hour) })
+	if _, err = cm.Broadcast(chat.DefaultRoom, "bob", []byte("hi")); err != nil {
+		t.Errorf("Broadcast after the ban expired error = %v", err)
+	}
+	chat.ReadLine(t, aliceConn)
+
+	if _, err = cm.Ban("alice", "10.0.0.0/8", 0, ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	banned := chat.NewIPConn(dummyconn.NewDummyConn(), &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234})
+	if _, ok := cm.Join(chat.DefaultRoom, "carol", banned).(*chat.SanctionedError); !ok {
+		t.Error("Expected a connection from a banned block to be refused")
+	}
+	if _, ok := cm.CheckAddress("10.1.2.3").(*chat.SanctionedError); !ok {
+		t.Error("Expected CheckAddress to refuse an address in a banned block")
+	}
+	if err = cm.CheckAddress("192.168.1.1"); err != nil {
+		t.Errorf("CheckAddress(192.168.1.1) error = %v, want: nil", err)
+	}
+	if sanctions := cm.Sanctions(); len(sanctions) != 1 || sanctions[0].Target != "10.0.0.0/8" {
+		t.Errorf("Sanctions = %v, want the block only", sanctions)
+	}
+	if err = cm.Unban("alice", "10.0.0.0/8"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err = cm.Unban("alice", "10.0.0.0/8"); err != chat.NotBannedErr {
+		t.Errorf("Second Unban error = %v, want: %s", err, chat.NotBannedErr)
+	}
+	ok := chat.NewIPConn(dummyconn.NewDummyConn(), &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234})
+	chat.JoinAs(t, cm, aliceConn, "carol", ok)
+}
+
+func TestMute(t *testing.T) {
+	cm, aliceConn := newModeratedChat(t)
+	bobConn := dummyconn.NewDummyConn()
+	chat.JoinAs(t, cm, aliceConn, "bob", bobConn)
+
+	if _, err := cm.Mute("bob", "alice", 0, ""); err != chat.PermissionDeniedErr {
+		t.Errorf("Mute by bob error = %v, want: %s", err, chat.PermissionDeniedErr)
+	}
+	if _, err := cm.Mute("alice", "bob", 0, ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := chat.TestTime + " *** You have been muted by alice\n"
+	if got := chat.ReadLine(t, bobConn); got != expected {
+		t.Errorf("Read: %q, want: %q", got, expected)
+	}
+	if _, err := cm.Broadcast(chat.DefaultRoom, "bob", []byte("hi")); err == nil || err.Error() != "Muted" {
+		t.Errorf("Broadcast by a muted name error = %v, want: Muted", err)
+	}
+	if _, err := cm.Whisper("bob", "alice", []byte("hi")); err == nil {
+		t.Error("Expected a muted name not to be able to whisper")
+	}
+	if err := cm.Unmute("alice", "bob"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	chat.ReadLine(t, bobConn)
+	go cm.Broadcast(chat.DefaultRoom, "bob", []byte("hi"))
+	expected = chat.TestTime + " <bob> hi\n"
+	if got := chat.ReadLine(t, aliceConn); got != expected {
+		t.Errorf("Read: %q, want: %q", got, expected)
+	}
+}
+
+func TestRenameMuted(t *testing.T) {
+	cm, aliceConn := newModeratedChat(t)
+	bobConn := dummyconn.NewDummyConn()
+	chat.JoinAs(t, cm, aliceConn, "mallory", bobConn)
+	if _, err := cm.Mute("alice", "mallory", 0, ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	chat.ReadLine(t, bobConn)
+
+	if err := cm.Rename("mallory", "mallory2"); err == nil || err.Error() != "Muted" {
+		t.Errorf("Rename of a muted name error = %v, want: Muted", err)
+	}
+	if _, err := cm.UserPresence("mallory2"); err == nil {
+		t.Error("Expected the muted name not to have been renamed")
+	}
+	if _, err := cm.Broadcast(chat.DefaultRoom, "mallory", []byte("hi")); err == nil || err.Error() != "Muted" {
+		t.Errorf("Broadcast after the rename error = %v, want: Muted", err)
+	}
+}
+
+func TestRenameIntoBan(t *testing.T) {
+	cm, aliceConn := newModeratedChat(t)
+	carolConn := dummyconn.NewDummyConn()
+	chat.JoinAs(t, cm, aliceConn, "carol", carolConn)
+	if _, err := cm.Ban("alice", "eve", 0, ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := cm.Rename("carol", "eve").(*chat.SanctionedError); !ok {
+		t.Error("Expected a banned name not to be taken by renaming")
+	}
+	if p, err := cm.UserPresence("carol"); err != nil || p.Name != "carol" {
+		t.Errorf("UserPresence(carol) = (%v, %v), want carol unrenamed", p, err)
+	}
+}
+
+func TestOp(t *testing.T) {
+	cm := chat.NewChatManager(nil, chat.HistorySize)
+	cm.SetOperators([]string{"alice"})
+	if cm.IsOperator("alice") {
+		t.Error("Expected an operator without accounts not to be an operator")
+	}
+	cm.SetAccounts(chattest.MemAccounts{"alice": "secret1", "bob": "secret2"}, false)
+	if err := cm.Op("alice", "bob"); err != chat.ModerationDisabledErr {
+		t.Errorf("Op without moderation error = %v, want: %s", err, chat.ModerationDisabledErr)
+	}
+	cm.SetModeration(newMemModeration())
+	if err := cm.Op("bob", "bob"); err != chat.PermissionDeniedErr {
+		t.Errorf("Op by bob error = %v, want: %s", err, chat.PermissionDeniedErr)
+	}
+	if err := cm.Op("alice", "carol"); err != chat.OperatorNeedsRegistrationErr {
+		t.Errorf("Op(carol) error = %v, want: %s", err, chat.OperatorNeedsRegistrationErr)
+	}
+	if err := cm.Op("alice", "bob"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if ops := cm.Operators(); len(ops) != 2 || ops[0] != "alice" || ops[1] != "bob" {
+		t.Errorf("Operators = %v, want: [alice bob]", ops)
+	}
+}
@@ -0,0 +1,145 @@
+package chat
+
+import (
+	"math"
+	"sort"
+)
+
+// maxInt is the largest int.  Pages are looked for one message past their
+// size (to find the adjacent page), so their size must stay below it.
+const maxInt = int(^uint(0) >> 1)
+
+// Page is a page of a room's history.  Prev and Next are cursors for the
+// adjacent pages: pass Prev as the before cursor to get the older page and
+// Next as the after cursor to get the newer one.  A cursor is zero if there
+// is no such page (yet).
+type Page struct {
+	Messages []*Message `json:"messages"`
+	Prev     uint64     `json:"prev,omitempty"`
+	Next     uint64     `json:"next,omitempty"`
+}
+
+// droppedID returns the ID of the newest message dropped from the history
+// (0 if none were).
+func (h *history) droppedID() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dropped
+}
+
+// older returns up to n of the room's messages with IDs lower than id,
+// oldest first.  Messages no longer in the in-memory history are read from
+// the store (if any).
+func older(rm *room, store Store, id uint64, n int) ([]*Message, error) {
+	msgs := rm.history.messages(rm.history.maxSize)
+	end := sort.Search(len(msgs), func(i int) bool { return msgs[i].ID >= id })
+	msgs = msgs[:end]
+	if len(msgs) > n {
+		msgs = msgs[len(msgs)-n:]
+	}
+	if store == nil || len(msgs) == n {
+		return msgs, nil
+	}
+	if len(msgs) > 0 {
+		id = msgs[0].ID
+	}
+	stored, err := store.Before(rm.name, id, n-len(msgs))
+	if err != nil {
+		return nil, err
+	}
+	return append(stored, msgs...), nil
+}
+
+// newer returns up to n of the room's messages with IDs greater than id,
+// oldest first.  Messages no longer in the in-memory history are read from
+// the store (if any).
+func newer(rm *room, store Store, id uint64, n int) ([]*Message, error) {
+	all := rm.history.messages(rm.history.maxSize)
+	start := sort.Search(len(all), func(i int) bool { return all[i].ID > id })
+	msgs := all[start:]
+	if store != nil && id < rm.history.droppedID() {
+		// Some of the messages have been dropped from memory
+		stored, err := store.After(rm.name, id, n)
+		if err != nil {
+			return nil, err
+		}
+		if len(all) > 0 {
+			end := sort.Search(len(stored), func(i int) bool { return stored[i].ID >= all[0].ID })
+			stored = stored[:end]
+		}
+		msgs = append(stored, msgs...)
+	}
+	if len(msgs) > n {
+		msgs = msgs[:n]
+	}
+	return msgs, nil
+}
+
+// HistoryPage returns a page of up to n messages from a room's history.  If
+// after is non-zero, the page holds the oldest messages with IDs greater
+// than after.  Otherwise it holds the newest messages with IDs lower than
+// before (or the newest messages, if before is zero as well).  Unlike
+// History, pages reach back as far as the Store (if any) does.
+func (c *ChatManager) HistoryPage(roomName string, before uint64, after uint64, n int) (*Page, error) {
+	c.mu.Lock()
+	rm, ok := c.rooms[roomName]
+	store := c.store
+	c.mu.Unlock()
+	if !ok {
+		return nil, RoomNotFoundErr
+	}
+	if n < 1 {
+		n = 1
+	} else if n > maxInt-1 {
+		n = maxInt - 1
+	}
+	page := &Page{}
+	var err error
+	if after != 0 {
+		page.Messages, err = newer(rm, store, after, n+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Messages) > n {
+			page.Messages = page.Messages[:n]
+			page.Next = page.Messages[n-1].ID
+		}
+	} else {
+		if before == 0 {
+			before = math.MaxUint64
+		}
+		page.Messages, err = older(rm, store, before, n+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Messages) > n {
+			page.Messages = page.Messages[1:]
+			page.Prev = page.Messages[0].ID
+		}
+	}
+	if len(page.Messages) == 0 {
+		return page, nil
+	}
+	first := page.Messages[0].ID
+	last := page.Messages[len(page.Messages)-1].ID
+	// Look for the neighbouring pages that weren't already looked for
+	if page.Prev == 0 && after != 0 {
+		msgs, err := older(rm, store, first, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) > 0 {
+			page.Prev = first
+		}
+	}
+	if page.Next == 0 && after == 0 {
+		msgs, err := newer(rm, store, last, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) > 0 {
+			page.Next = last
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,123 @@
+package chat
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHistoryPage(t *testing.T) {
+	store := &memStore{}
+	for i := 1; i <= 10; i++ {
+		store.Append(&Message{ID: uint64(i), Room: "dev", Body: strconv.Itoa(i % 10)})
+	}
+	cm := NewChatManager(nil, historySize)
+	if err := cm.SetStore(store); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The in-memory history holds messages 3 through 10
+	tests := []struct {
+		before   uint64
+		after    uint64
+		n        int
+		expected string
+		prev     uint64
+		next     uint64
+	}{
+		{0, 0, 4, "7890", 7, 0},
+		{7, 0, 4, "3456", 3, 6},
+		{3, 0, 4, "12", 0, 2},
+		{0, 2, 4, "3456", 3, 6},
+		{0, 6, 4, "7890", 7, 0},
+		{0, 1, 1, "2", 2, 2},
+		{0, 0, 20, "1234567890", 0, 0},
+		{0, 10, 4, "", 0, 0},
+	}
+	for _, test := range tests {
+		page, err := cm.HistoryPage("dev", test.before, test.after, test.n)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if bodies(page.Messages) != test.expected || page.Prev != test.prev || page.Next != test.next {
+			t.Errorf("HistoryPage(before=%d, after=%d, n=%d) = %s (prev=%d, next=%d), want: %s (prev=%d, next=%d)",
+				test.before, test.after, test.n, bodies(page.Messages), page.Prev, page.Next,
+				test.expected, test.prev, test.next)
+		}
+	}
+}
+
+// TestHistoryPageResized makes sure that pages reach the store for the
+// messages dropped by shrinking the history, even once it has grown again.
+func TestHistoryPageResized(t *testing.T) {
+	store := &memStore{}
+	cm := NewChatManager(nil, historySize)
+	if err := cm.SetStore(store); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cm.CreateRoom("dev")
+	for i := 1; i <= 4; i++ {
+		cm.Broadcast("dev", "testuser", []byte(strconv.Itoa(i)))
+	}
+	first, _ := store.After("dev", 0, 1)
+	cm.SetMaxHistoryLines(2)
+	cm.SetMaxHistoryLines(historySize)
+	// The history holds 3 and 4 and isn't full
+	page, err := cm.HistoryPage("dev", 0, first[0].ID, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(page.Messages) != "23" {
+		t.Errorf("Page = %s, want: 23", bodies(page.Messages))
+	}
+}
+
+// TestHistoryPageHuge makes sure that a page size near the largest int
+// doesn't overflow.
+func TestHistoryPageHuge(t *testing.T) {
+	store := &memStore{}
+	for i := 1; i <= 10; i++ {
+		store.Append(&Message{ID: uint64(i), Room: "dev", Body: strconv.Itoa(i % 10)})
+	}
+	cm := NewChatManager(nil, historySize)
+	if err := cm.SetStore(store); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, test := range []struct{ before, after uint64 }{{0, 0}, {0, 2}} {
+		page, err := cm.HistoryPage("dev", test.before, test.after, maxInt)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(page.Messages) == 0 {
+			t.Errorf("HistoryPage(before=%d, after=%d) is empty", test.before, test.after)
+		}
+	}
+}
+
+func TestHistoryPageWithoutStore(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	cm.CreateRoom("dev")
+	if page, _ := cm.HistoryPage("dev", 0, 0, 2); len(page.Messages) != 0 || page.Prev != 0 || page.Next != 0 {
+		t.Errorf("Empty room page = %+v, want an empty page", page)
+	}
+	first, _ := cm.Broadcast("dev", "testuser", []byte("1"))
+	second, _ := cm.Broadcast("dev", "testuser", []byte("2"))
+	cm.Broadcast("dev", "testuser", []byte("3"))
+	page, err := cm.HistoryPage("dev", 0, 0, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(page.Messages) != "23" || page.Prev != second.ID || page.Next != 0 {
+		t.Errorf("Page = %s (prev=%d, next=%d), want: 23 (prev=%d, next=0)",
+			bodies(page.Messages), page.Prev, page.Next, second.ID)
+	}
+	page, err = cm.HistoryPage("dev", page.Prev, 0, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(page.Messages) != "1" || page.Prev != 0 || page.Next != first.ID {
+		t.Errorf("Page = %s (prev=%d, next=%d), want: 1 (prev=0, next=%d)",
+			bodies(page.Messages), page.Prev, page.Next, first.ID)
+	}
+	if _, err := cm.HistoryPage("nope", 0, 0, 2); err != RoomNotFoundErr {
+		t.Errorf("HistoryPage(nope) error = %v, want: %s", err, RoomNotFoundErr)
+	}
+}
@@ -0,0 +1,203 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultTransport is the transport of connections that don't name theirs
+// (see Transporter).
+const DefaultTransport = "raw"
+
+// Transporter is implemented by connections that name the transport they
+// use (e.g., "websocket").
+type Transporter interface {
+	Transport() string
+}
+
+// Presence describes a connected user.
+type Presence struct {
+	Name       string    `json:"name"`
+	Transport  string    `json:"transport"`
+	RemoteAddr string    `json:"remote_address"`
+	Connected  time.Time `json:"connected"`
+	// LastActive is when the user connected or last sent a message
+	LastActive time.Time `json:"last_active"`
+	Rooms      []string  `json:"rooms"`
+	// Away is set if the user is away (see SetAway)
+	Away *Away `json:"away,omitempty"`
+}
+
+// Idle returns how long the user has been idle at now.
+func (p *Presence) Idle(now time.Time) time.Duration {
+	return now.Sub(p.LastActive)
+}
+
+// Format renders the presence as a line of text, as it is at now, e.g.,
+// "alice (raw from 10.0.0.1:5555) in lobby; connected 02-Jan-06 15:04,
+// idle 5m0s".  Away users have e.g. ", away since 02-Jan-06 15:09: lunch"
+// appended.
+func (p *Presence) Format(now time.Time) string {
+	s := fmt.Sprintf("%s (%s from %s) in %s; connected %s, idle %s", p.Name,
+		p.Transport, p.RemoteAddr, strings.Join(p.Rooms, ", "),
+		p.Connected.Format(timestampLayout), p.Idle(now).Round(time.Second))
+	if p.Away != nil {
+		s += ", away since " + p.Away.Since.Format(timestampLayout)
+		if p.Away.Reason != "" {
+			s += ": " + p.Away.Reason
+		}
+	}
+	return s
+}
+
+// PresenceChange is what happened to a user's presence.
+type PresenceChange string
+
+const (
+	// PresenceConnect is sent when a user joins its first room.
+	PresenceConnect PresenceChange = "connect"
+	// PresenceUpdate is sent when a connected user joins or quits a room,
+	// changes its name, or goes away or comes back.
+	PresenceUpdate PresenceChange = "update"
+	// PresenceDisconnect is sent when a user has quit its last room.
+	PresenceDisconnect PresenceChange = "disconnect"
+)
+
+// PresenceEvent is a change to a user's presence.  OldName is set when the
+// user has changed its name.
+type PresenceEvent struct {
+	Change   PresenceChange `json:"change"`
+	OldName  string         `json:"old_name,omitempty"`
+	Presence *Presence      `json:"presence"`
+}
+
+// PresenceSubscription delivers presence changes.  C is closed when the
+// subscription ends, either through UnsubscribePresence or because the
+// listener fell too far behind.
+type PresenceSubscription struct {
+	C      <-chan *PresenceEvent
+	c      chan *PresenceEvent
+	closed bool
+}
+
+// presence returns a client's presence (but does not lock any shared state;
+// it should only be used if you already hold the appropriate locks).
+func (c *ChatManager) presence(cl *client) *Presence {
+	rooms := []string{}
+	for roomName, rm := range c.rooms {
+		if rm.members[cl.name] {
+			rooms = append(rooms, roomName)
+		}
+	}
+	sort.Strings(rooms)
+	var away *Away
+	if cl.away != nil {
+		a := *cl.away
+		away = &a
+	}
+	return &Presence{cl.name, cl.transport, cl.conn.RemoteAddr().String(),
+		cl.connected, cl.lastActive, rooms, away}
+}
+
+// Presence returns the presence of every connected user, sorted by name.
+func (c *ChatManager) Presence() []*Presence {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.allPresence()
+}
+
+// allPresence returns the presence of every connected user, sorted by name
+// (but does not lock any shared state; it should only be used if you
+// already hold the appropriate locks).
+func (c *ChatManager) allPresence() []*Presence {
+	users := make([]*Presence, 0, len(c.nameToClient))
+	for _, cl := range c.nameToClient {
+		users = append(users, c.presence(cl))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// UserPresence returns the presence of a connected user.
+func (c *ChatManager) UserPresence(name string) (*Presence, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cl, ok := c.nameToClient[name]
+	if !ok {
+		return nil, &NotConnectedError{name}
+	}
+	return c.presence(cl), nil
+}
+
+// RoomPresence returns the presence of the users in a room, sorted by name.
+func (c *ChatManager) RoomPresence(roomName string) ([]*Presence, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rm, ok := c.rooms[roomName]
+	if !ok {
+		return nil, RoomNotFoundErr
+	}
+	users := make([]*Presence, 0, len(rm.members))
+	for name := range rm.members {
+		users = append(users, c.presence(c.nameToClient[name]))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+// SubscribePresence subscribes to presence changes.  The presence of every
+// connected user is returned as well, so that the listener can follow the
+// changes from there.  The subscription buffers as many events as a client
+// queue holds messages; a listener that falls further behind is
+// unsubscribed.
+func (c *ChatManager) SubscribePresence() (*PresenceSubscription, []*Presence, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, nil, ShuttingDownErr
+	}
+	ch := make(chan *PresenceEvent, c.queueSize)
+	sub := &PresenceSubscription{ch, ch, false}
+	c.presenceSubs[sub] = true
+	return sub, c.allPresence(), nil
+}
+
+// UnsubscribePresence ends a presence subscription.  It is safe to call more
+// than once.
+func (c *ChatManager) UnsubscribePresence(sub *PresenceSubscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closePresence(sub)
+}
+
+// closePresence ends a presence subscription (but does not lock any shared
+// state; it should only be used if you already hold the appropriate locks).
+func (c *ChatManager) closePresence(sub *PresenceSubscription) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(c.presenceSubs, sub)
+	close(sub.c)
+}
+
+// publishPresence sends a change to a client's presence to the presence
+// subscribers (but does not lock any shared state; it should only be used
+// if you already hold the appropriate locks).
+func (c *ChatManager) publishPresence(change PresenceChange, oldName string, cl *client) {
+	if len(c.presenceSubs) == 0 {
+		return
+	}
+	event := &PresenceEvent{change, oldName, c.presence(cl)}
+	for sub := range c.presenceSubs {
+		select {
+		case sub.c <- event:
+		default:
+			log.Print("Unsubscribing slow presence subscriber")
+			c.closePresence(sub)
+		}
+	}
+}
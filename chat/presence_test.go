@@ -0,0 +1,110 @@
+package chat
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/dummyconn"
+)
+
+// transportConn is a net.Conn that names its transport.
+type transportConn struct {
+	net.Conn
+}
+
+func (c *transportConn) Transport() string {
+	return "carrier-pigeon"
+}
+
+func TestPresence(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	aliceConn := dummyconn.NewDummyConn()
+	bobConn := &transportConn{&ipConn{dummyconn.NewDummyConn(),
+		&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}}}
+	for _, join := range []struct {
+		room string
+		name string
+		conn net.Conn
+	}{
+		{DefaultRoom, "alice", aliceConn},
+		{"dev", "alice", aliceConn},
+		{DefaultRoom, "bob", bobConn},
+	} {
+		if err := cm.Join(join.room, join.name, join.conn); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	cm.SetClock(func() time.Time { return testNow.Add(time.Minute) })
+	if _, err := cm.Broadcast(DefaultRoom, "bob", []byte("hi")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := []*Presence{
+		{"alice", DefaultTransport, "remote", testNow, testNow, []string{"dev", DefaultRoom}, nil},
+		{"bob", "carrier-pigeon", "10.1.2.3:1234", testNow, testNow.Add(time.Minute), []string{DefaultRoom}, nil},
+	}
+	if users := cm.Presence(); !reflect.DeepEqual(users, expected) {
+		t.Errorf("Presence = %+v, want: %+v", users, expected)
+	}
+	if idle := expected[1].Idle(testNow.Add(3 * time.Minute)); idle != 2*time.Minute {
+		t.Errorf("Idle = %s, want: 2m0s", idle)
+	}
+	if users, err := cm.RoomPresence("dev"); err != nil || !reflect.DeepEqual(users, expected[:1]) {
+		t.Errorf("RoomPresence(dev) = (%v, %v), want: (%v, nil)", users, err, expected[:1])
+	}
+	if _, err := cm.RoomPresence("nowhere"); err != RoomNotFoundErr {
+		t.Errorf("RoomPresence(nowhere) error = %v, want: %s", err, RoomNotFoundErr)
+	}
+}
+
+func TestSubscribePresence(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	if err := cm.Join(DefaultRoom, "alice", dummyconn.NewDummyConn()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	sub, users, err := cm.SubscribePresence()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(users) != 1 || users[0].Name != "alice" {
+		t.Errorf("SubscribePresence users = %v, want alice only", users)
+	}
+
+	bobConn := dummyconn.NewDummyConn()
+	if err = cm.Join(DefaultRoom, "bob", bobConn); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err = cm.Join("dev", "bob", bobConn); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err = cm.Rename("bob", "carol"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cm.QuitAll("carol")
+	for _, expected := range []struct {
+		change  PresenceChange
+		oldName string
+		name    string
+		rooms   int
+	}{
+		{PresenceConnect, "", "bob", 1},
+		{PresenceUpdate, "", "bob", 2},
+		{PresenceUpdate, "bob", "carol", 2},
+		{PresenceUpdate, "", "carol", 1},
+		{PresenceDisconnect, "", "carol", 0},
+	} {
+		event := <-sub.C
+		if event.Change != expected.change || event.OldName != expected.oldName ||
+			event.Presence.Name != expected.name || len(event.Presence.Rooms) != expected.rooms {
+			t.Errorf("Event = %+v (%+v), want: %+v", event, event.Presence, expected)
+		}
+	}
+
+	cm.UnsubscribePresence(sub)
+	cm.UnsubscribePresence(sub)
+	if _, ok := <-sub.C; ok {
+		t.Error("Expected the subscription to end")
+	}
+}
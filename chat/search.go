@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// storeReplayBatch is the number of messages read from a Store at a time
+// when filling an Index.
+const storeReplayBatch = 1000
+
+var SearchDisabledErr = errors.New("Search is disabled")
+
+// QueryError is returned when a search query can't be parsed.
+type QueryError struct {
+	Reason string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("Invalid query: %s", e.Reason)
+}
+
+// Index makes room messages searchable.  Messages are added in ID order as
+// they are broadcast.
+type Index interface {
+	// Add indexes a message.
+	Add(m *Message)
+	// Search returns up to limit messages matching query, newest first.
+	// If roomName isn't empty, only that room's messages match.
+	Search(query string, roomName string, limit int) ([]*Message, error)
+}
+
+// SetIndex sets the Index that room messages are added to.  The messages
+// already in the Store (or, without one, in the rooms' histories) are added
+// to it first.
+func (c *ChatManager) SetIndex(index Index) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	msgs := []*Message{}
+	for _, rm := range c.rooms {
+		if c.store == nil {
+			msgs = append(msgs, rm.history.messages(rm.history.maxSize)...)
+			continue
+		}
+		var id uint64
+		for {
+			batch, err := c.store.After(rm.name, id, storeReplayBatch)
+			if err != nil {
+				return err
+			}
+			if len(batch) == 0 {
+				break
+			}
+			msgs = append(msgs, batch...)
+			id = batch[len(batch)-1].ID
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].ID < msgs[j].ID })
+	for _, msg := range msgs {
+		index.Add(msg)
+	}
+	log.Printf("Indexed %d messages", len(msgs))
+	c.index = index
+	return nil
+}
+
+// Search returns up to limit room messages matching query, newest first.
+// If roomName isn't empty, only that room is searched.  SearchDisabledErr
+// is returned if no Index has been set.
+func (c *ChatManager) Search(query string, roomName string, limit int) ([]*Message, error) {
+	c.mu.Lock()
+	index := c.index
+	_, ok := c.rooms[roomName]
+	c.mu.Unlock()
+	if index == nil {
+		return nil, SearchDisabledErr
+	}
+	if roomName != "" && !ok {
+		return nil, RoomNotFoundErr
+	}
+	return index.Search(query, roomName, limit)
+}
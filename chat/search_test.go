@@ -0,0 +1,64 @@
+package chat
+
+import (
+	"strconv"
+	"testing"
+)
+
+// listIndex is an Index that remembers the messages it was given and matches
+// messages by body.
+type listIndex struct {
+	msgs []*Message
+}
+
+func (l *listIndex) Add(m *Message) {
+	l.msgs = append(l.msgs, m)
+}
+
+func (l *listIndex) Search(query string, roomName string, limit int) ([]*Message, error) {
+	results := []*Message{}
+	for _, m := range l.msgs {
+		if m.Body == query && (roomName == "" || m.Room == roomName) {
+			results = append(results, m)
+		}
+	}
+	return results, nil
+}
+
+func TestSetIndex(t *testing.T) {
+	store := &memStore{}
+	for i := 1; i <= 10; i++ {
+		room := "dev"
+		if i%2 == 0 {
+			room = "ops"
+		}
+		store.Append(&Message{ID: uint64(i), Room: room, Body: strconv.Itoa(i % 10)})
+	}
+	cm := NewChatManager(nil, historySize)
+	if _, err := cm.Search("1", "", 10); err != SearchDisabledErr {
+		t.Errorf("Search without an index error = %v, want: %s", err, SearchDisabledErr)
+	}
+	if err := cm.SetStore(store); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	index := &listIndex{}
+	if err := cm.SetIndex(index); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Every stored message is indexed, in ID order
+	if bodies(index.msgs) != "1234567890" {
+		t.Errorf("indexed = %s, want: 1234567890", bodies(index.msgs))
+	}
+
+	cm.Broadcast("dev", "testuser", []byte("new"))
+	results, err := cm.Search("new", "dev", 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(results) != 1 || results[0].Sender != "testuser" {
+		t.Errorf("Search(new) = %v, want the broadcast message", results)
+	}
+	if _, err := cm.Search("new", "nope", 10); err != RoomNotFoundErr {
+		t.Errorf("Search in a missing room error = %v, want: %s", err, RoomNotFoundErr)
+	}
+}
@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+var ShuttingDownErr = errors.New("Server is shutting down")
+
+// abortGrace is how long Shutdown waits for a writer to stop after aborting
+// its write.
+const abortGrace = time.Second
+
+// Shutdown sends notice (unless it is empty) to every connected client and
+// subscriber, then ends every subscription and waits for the clients'
+// queued messages to be written before closing their connections.  If ctx
+// ends first, the writes in progress are aborted (by setting a write
+// deadline that has passed), the remaining connections are closed once
+// their writers have stopped (or, for writers that don't, after at most
+// abortGrace in all), and ctx's error is returned.  From then on,
+// nothing more is sent or logged, and joining, sending and subscribing fail
+// with ShuttingDownErr.
+func (c *ChatManager) Shutdown(ctx context.Context, notice string) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	if notice != "" {
+		msg := c.newNotice(notice)
+		c.writeLog(msg)
+		for _, rm := range c.rooms {
+			rm.publish(msg)
+		}
+		for _, cl := range c.nameToClient {
+			// A slow client's queue is closed below anyway
+			c.deliver(cl, msg)
+		}
+	}
+	c.closed = true
+	for _, rm := range c.rooms {
+		for sub := range rm.subscribers {
+			sub.close()
+		}
+	}
+	for sub := range c.presenceSubs {
+		c.closePresence(sub)
+	}
+	clients := make([]*client, 0, len(c.nameToClient))
+	for _, cl := range c.nameToClient {
+		cl.queue.close()
+		clients = append(clients, cl)
+	}
+	c.mu.Unlock()
+
+	var err error
+	for _, cl := range clients {
+		if err != nil {
+			break
+		}
+		select {
+		case <-cl.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+			log.Printf("Gave up draining client writes: %s", err)
+		}
+	}
+	// The writes still in progress are aborted all at once, so that
+	// writers that ignore the deadline share one abortGrace
+	var aborted []*client
+	for _, cl := range clients {
+		select {
+		case <-cl.done:
+			cl.conn.Close()
+		default:
+			_ = cl.conn.SetWriteDeadline(time.Now())
+			aborted = append(aborted, cl)
+		}
+	}
+	if len(aborted) > 0 {
+		abortCtx, cancel := context.WithTimeout(context.Background(), abortGrace)
+		defer cancel()
+		for _, cl := range aborted {
+			select {
+			case <-cl.done:
+			case <-abortCtx.Done():
+				// The connection ignores write deadlines; closing
+				// it is the only way left to stop the writer
+				log.Printf("Writer of %s didn't stop; closing anyway", cl.name)
+			}
+			cl.conn.Close()
+		}
+	}
+	return err
+}
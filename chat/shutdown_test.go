@@ -0,0 +1,125 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/dummyconn"
+)
+
+func TestShutdown(t *testing.T) {
+	var chatLog bytes.Buffer
+	cm := NewChatManager(&chatLog, historySize)
+	dc := dummyconn.NewDummyConn()
+	if err := cm.Join(DefaultRoom, "testuser", dc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	buf := make([]byte, bufSize)
+	dc.Read(buf)
+	sub, _, err := cm.Subscribe(DefaultRoom, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	errCh := make(chan error)
+	go func() { errCh <- cm.Shutdown(context.Background(), "Going down") }()
+	n, err := dc.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := testTime + " *** Going down\n"
+	if string(buf[:n]) != expected {
+		t.Errorf("Read: %q, want: %q", buf[:n], expected)
+	}
+	if err = <-errCh; err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err = dc.Read(buf); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+	if msg := <-sub.C; msg.Kind != KindNotice || msg.Body != "Going down" || msg.ID != 0 {
+		t.Errorf("Subscriber got %v, want the notice (with no ID)", msg)
+	}
+	if _, ok := <-sub.C; ok {
+		t.Error("Expected the subscription to end")
+	}
+	if !bytes.HasSuffix(chatLog.Bytes(), []byte(expected)) {
+		t.Errorf("Chat log = %q, want it to end with the notice", chatLog.String())
+	}
+
+	logged := chatLog.Len()
+	cm.Disconnect(dc)
+	if chatLog.Len() != logged {
+		t.Error("Expected nothing to be logged after the shutdown")
+	}
+	if err = cm.Join(DefaultRoom, "other", dummyconn.NewDummyConn()); err != ShuttingDownErr {
+		t.Errorf("Join error = %v, want: %s", err, ShuttingDownErr)
+	}
+	if _, err = cm.Broadcast(DefaultRoom, "testuser", []byte("hi")); err != ShuttingDownErr {
+		t.Errorf("Broadcast error = %v, want: %s", err, ShuttingDownErr)
+	}
+	if _, _, err = cm.Subscribe(DefaultRoom, 0); err != ShuttingDownErr {
+		t.Errorf("Subscribe error = %v, want: %s", err, ShuttingDownErr)
+	}
+	if err = cm.Shutdown(context.Background(), "Again"); err != nil {
+		t.Errorf("Second Shutdown error = %v, want: nil", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	// Nobody reads from dc, so its join message is never written
+	dc := dummyconn.NewDummyConn()
+	if err := cm.Join(DefaultRoom, "testuser", dc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := cm.Shutdown(ctx, "Going down"); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown error = %v, want: %s", err, context.DeadlineExceeded)
+	}
+	if _, err := dc.Read(make([]byte, bufSize)); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+// deadlineIgnoringConn is a connection that ignores write deadlines.
+type deadlineIgnoringConn struct {
+	net.Conn
+}
+
+func (c deadlineIgnoringConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// TestShutdownAbort makes sure that writers which ignore write deadlines
+// delay the shutdown by abortGrace in all, not abortGrace each.
+func TestShutdownAbort(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	conns := []net.Conn{}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		// Nobody reads, so the writers block until their conns are closed
+		conn := deadlineIgnoringConn{dummyconn.NewDummyConn()}
+		if err := cm.Join(DefaultRoom, name, conn); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		conns = append(conns, conn)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := cm.Shutdown(ctx, "Going down"); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown error = %v, want: %s", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*abortGrace {
+		t.Errorf("Shutdown took %s, want less than %s", elapsed, 2*abortGrace)
+	}
+	for _, conn := range conns {
+		if _, err := conn.Read(make([]byte, bufSize)); err == nil {
+			t.Error("Expected the connection to be closed")
+		}
+	}
+}
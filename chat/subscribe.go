@@ -0,0 +1,106 @@
+package chat
+
+import (
+	"errors"
+	"log"
+	"sort"
+)
+
+var MessagesGoneErr = errors.New("Messages since then are no longer available")
+
+// Subscription delivers the messages broadcast to a room to a listener that
+// isn't a member of the room (e.g., an HTTP stream).  C is closed when the
+// subscription ends, either through Unsubscribe or because the listener
+// fell too far behind.
+type Subscription struct {
+	C      <-chan *Message
+	c      chan *Message
+	room   *room
+	closed bool
+}
+
+// Subscribe subscribes to the messages broadcast to a room.  The room's
+// messages with IDs greater than sinceID are returned as well; together
+// with the subscription they form a gapless sequence.  Messages that have
+// been dropped from the room's history are read from the Store (if any),
+// up to storeReplayBatch of them; MessagesGoneErr is returned if more are
+// missing, or if there is no Store to read them from.  The subscription
+// buffers as many messages as a client queue; a listener that falls
+// further behind is unsubscribed.
+func (c *ChatManager) Subscribe(roomName string, sinceID uint64) (*Subscription, []*Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, nil, ShuttingDownErr
+	}
+	rm, ok := c.rooms[roomName]
+	if !ok {
+		return nil, nil, RoomNotFoundErr
+	}
+	backlog, err := c.backlog(rm, sinceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch := make(chan *Message, c.queueSize)
+	sub := &Subscription{ch, ch, rm, false}
+	rm.subscribers[sub] = true
+	return sub, backlog, nil
+}
+
+// backlog returns the room's messages with IDs greater than sinceID, from
+// its history and, for those dropped from it, the Store (but does not lock
+// any shared state; it should only be used if you already hold the
+// ChatManager's lock).
+func (c *ChatManager) backlog(rm *room, sinceID uint64) ([]*Message, error) {
+	msgs := rm.history.since(sinceID)
+	if sinceID >= rm.history.droppedID() {
+		return msgs, nil
+	}
+	if c.store == nil {
+		return nil, MessagesGoneErr
+	}
+	stored, err := c.store.After(rm.name, sinceID, storeReplayBatch)
+	if err != nil {
+		return nil, err
+	}
+	end := len(stored)
+	if len(msgs) > 0 {
+		end = sort.Search(len(stored), func(i int) bool { return stored[i].ID >= msgs[0].ID })
+	}
+	if end == storeReplayBatch {
+		// There may be more messages between the batch and the history
+		return nil, MessagesGoneErr
+	}
+	return append(stored[:end], msgs...), nil
+}
+
+// Unsubscribe ends a subscription.  It is safe to call more than once.
+func (c *ChatManager) Unsubscribe(sub *Subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sub.close()
+}
+
+// close ends the subscription (but does not lock any shared state; it
+// should only be used if you already hold the ChatManager's lock).
+func (sub *Subscription) close() {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(sub.room.subscribers, sub)
+	close(sub.c)
+}
+
+// publish sends msg to the room's subscribers (but does not lock any shared
+// state; it should only be used if you already hold the ChatManager's lock).
+func (rm *room) publish(msg *Message) {
+	for sub := range rm.subscribers {
+		select {
+		case sub.c <- msg:
+		default:
+			log.Printf("Unsubscribing slow subscriber from %s", rm.name)
+			sub.close()
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package chat
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	first, _ := cm.Broadcast(DefaultRoom, "testuser", []byte("1"))
+	cm.Broadcast(DefaultRoom, "testuser", []byte("2"))
+
+	sub, backlog, err := cm.Subscribe(DefaultRoom, first.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(backlog) != "2" {
+		t.Errorf("backlog = %s, want: 2", bodies(backlog))
+	}
+	cm.Broadcast(DefaultRoom, "testuser", []byte("3"))
+	cm.Broadcast("elsewhere", "testuser", []byte("x"))
+	msg := <-sub.C
+	if msg.Body != "3" {
+		t.Errorf("Body = %s, want: 3", msg.Body)
+	}
+
+	cm.Unsubscribe(sub)
+	cm.Unsubscribe(sub)
+	if _, ok := <-sub.C; ok {
+		t.Error("Expected subscription to be closed")
+	}
+	cm.Broadcast(DefaultRoom, "testuser", []byte("4"))
+}
+
+func TestSubscribeNoSuchRoom(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	_, _, err := cm.Subscribe("nosuchroom", 0)
+	if err != RoomNotFoundErr {
+		t.Errorf("err = %v, want: %v", err, RoomNotFoundErr)
+	}
+}
+
+func TestSubscribeSlow(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	cm.SetQueuePolicy(2, DropOldest)
+	sub, _, err := cm.Subscribe(DefaultRoom, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		cm.Broadcast(DefaultRoom, "testuser", []byte("flood"))
+	}
+	n := 0
+	for range sub.C {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("received %d messages before closing, want: 2", n)
+	}
+}
+
+func TestSubscribeGap(t *testing.T) {
+	cm := NewChatManager(nil, historySize)
+	first, _ := cm.Broadcast(DefaultRoom, "testuser", []byte("0"))
+	for i := 1; i < historySize; i++ {
+		cm.Broadcast(DefaultRoom, "testuser", []byte(strconv.Itoa(i)))
+	}
+	// Nothing has been dropped from the history yet
+	if _, _, err := cm.Subscribe(DefaultRoom, 0); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cm.Broadcast(DefaultRoom, "testuser", []byte("8"))
+	if _, _, err := cm.Subscribe(DefaultRoom, 0); err != MessagesGoneErr {
+		t.Errorf("err = %v, want: %v", err, MessagesGoneErr)
+	}
+	_, backlog, err := cm.Subscribe(DefaultRoom, first.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(backlog) != "12345678" {
+		t.Errorf("backlog = %s, want: 12345678", bodies(backlog))
+	}
+}
+
+func TestSubscribeGapStore(t *testing.T) {
+	store := &memStore{}
+	for i := 1; i <= 10; i++ {
+		store.Append(&Message{ID: uint64(i), Room: "dev", Body: strconv.Itoa(i % 10)})
+	}
+	cm := NewChatManager(nil, historySize)
+	if err := cm.SetStore(store); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cm.Broadcast("dev", "testuser", []byte("x"))
+	_, backlog, err := cm.Subscribe("dev", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(backlog) != "234567890x" {
+		t.Errorf("backlog = %s, want: 234567890x", bodies(backlog))
+	}
+}
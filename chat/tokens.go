@@ -0,0 +1,109 @@
+package chat
+
+import (
+	"errors"
+)
+
+// Permission is something an API token allows its holder to do.
+type Permission string
+
+const (
+	PermRead Permission = "read"
+	PermPost Permission = "post"
+	// PermModerate lets an operator's token be used to moderate
+	PermModerate Permission = "moderate"
+)
+
+var InvalidTokenErr = errors.New("Invalid token")
+var PermissionDeniedErr = errors.New("Permission denied")
+var TokensDisabledErr = errors.New("Tokens are disabled")
+var AuthRequiredErr = errors.New("Authentication required")
+var TokenNeedsRegistrationErr = errors.New("Only registered names can have tokens")
+
+// Tokens holds the API tokens that let HTTP clients act as a user.
+type Tokens interface {
+	// Issue returns a new token for name with the given permissions.
+	Issue(name string, perms []Permission) (string, error)
+	// Lookup returns the name and permissions of a token.
+	Lookup(token string) (name string, perms []Permission, ok bool)
+	// Revoke revokes all of name's tokens and returns how many there
+	// were.
+	Revoke(name string) (int, error)
+}
+
+// SetTokens sets the Tokens of API clients.  Once tokens are set, clients
+// without one can only act as guests: their names get guestPrefix, or they
+// are refused if guestPrefix is empty.
+func (c *ChatManager) SetTokens(tokens Tokens, guestPrefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens = tokens
+	c.guestPrefix = guestPrefix
+}
+
+// getTokens returns the Tokens (if any) and the guest prefix.
+func (c *ChatManager) getTokens() (Tokens, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokens, c.guestPrefix
+}
+
+// IssueToken returns a new API token for a registered name.  Only operators
+// can have tokens with PermModerate.
+func (c *ChatManager) IssueToken(name string, perms []Permission) (string, error) {
+	tokens, _ := c.getTokens()
+	if tokens == nil {
+		return "", TokensDisabledErr
+	}
+	if !c.Registered(name) {
+		return "", TokenNeedsRegistrationErr
+	}
+	for _, perm := range perms {
+		if perm == PermModerate && !c.IsOperator(name) {
+			return "", PermissionDeniedErr
+		}
+	}
+	return tokens.Issue(name, perms)
+}
+
+// RevokeTokens revokes all of name's API tokens and returns how many there
+// were.
+func (c *ChatManager) RevokeTokens(name string) (int, error) {
+	tokens, _ := c.getTokens()
+	if tokens == nil {
+		return 0, TokensDisabledErr
+	}
+	return tokens.Revoke(name)
+}
+
+// Authorize returns the name that a token acts as, provided that the token
+// has the permission perm.
+func (c *ChatManager) Authorize(token string, perm Permission) (string, error) {
+	tokens, _ := c.getTokens()
+	if tokens == nil {
+		return "", TokensDisabledErr
+	}
+	name, perms, ok := tokens.Lookup(token)
+	if !ok {
+		return "", InvalidTokenErr
+	}
+	for _, p := range perms {
+		if p == perm {
+			return name, nil
+		}
+	}
+	return "", PermissionDeniedErr
+}
+
+// GuestName returns the name that a client without a token, asking for
+// name, acts as (see SetTokens).  Without Tokens, the name is used as is.
+func (c *ChatManager) GuestName(name string) (string, error) {
+	tokens, guestPrefix := c.getTokens()
+	if tokens == nil {
+		return name, nil
+	}
+	if guestPrefix == "" {
+		return "", AuthRequiredErr
+	}
+	return guestPrefix + name, nil
+}
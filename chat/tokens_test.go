@@ -0,0 +1,54 @@
+package chat_test
+
+import (
+	"testing"
+
+	"github.com/bgmerrell/gochatd/chat"
+	"github.com/bgmerrell/gochatd/internal/chattest"
+)
+
+func TestAuthorize(t *testing.T) {
+	cm := chat.NewChatManager(nil, chat.HistorySize)
+	if _, err := cm.Authorize("alice", chat.PermRead); err != chat.TokensDisabledErr {
+		t.Errorf("Authorize without tokens error = %v, want: %s", err, chat.TokensDisabledErr)
+	}
+	cm.SetAccounts(chattest.MemAccounts{"alice": "secret1"}, false)
+	cm.SetTokens(chattest.MemTokens{}, "")
+	if _, err := cm.IssueToken("bob", []chat.Permission{chat.PermRead}); err != chat.TokenNeedsRegistrationErr {
+		t.Errorf("IssueToken(bob) error = %v, want: %s", err, chat.TokenNeedsRegistrationErr)
+	}
+	token, err := cm.IssueToken("alice", []chat.Permission{chat.PermRead})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if name, err := cm.Authorize(token, chat.PermRead); err != nil || name != "alice" {
+		t.Errorf("Authorize(read) = (%s, %v), want: (alice, nil)", name, err)
+	}
+	if _, err = cm.Authorize(token, chat.PermPost); err != chat.PermissionDeniedErr {
+		t.Errorf("Authorize(post) error = %v, want: %s", err, chat.PermissionDeniedErr)
+	}
+	if _, err = cm.Authorize("bogus", chat.PermRead); err != chat.InvalidTokenErr {
+		t.Errorf("Authorize(bogus) error = %v, want: %s", err, chat.InvalidTokenErr)
+	}
+	if n, err := cm.RevokeTokens("alice"); err != nil || n != 1 {
+		t.Errorf("RevokeTokens(alice) = (%d, %v), want: (1, nil)", n, err)
+	}
+	if _, err = cm.Authorize(token, chat.PermRead); err != chat.InvalidTokenErr {
+		t.Errorf("Authorize(revoked) error = %v, want: %s", err, chat.InvalidTokenErr)
+	}
+}
+
+func TestGuestName(t *testing.T) {
+	cm := chat.NewChatManager(nil, chat.HistorySize)
+	if name, err := cm.GuestName("bob"); err != nil || name != "bob" {
+		t.Errorf("GuestName without tokens = (%s, %v), want: (bob, nil)", name, err)
+	}
+	cm.SetTokens(chattest.MemTokens{}, "")
+	if _, err := cm.GuestName("bob"); err != chat.AuthRequiredErr {
+		t.Errorf("GuestName without a prefix error = %v, want: %s", err, chat.AuthRequiredErr)
+	}
+	cm.SetTokens(chattest.MemTokens{}, "guest-")
+	if name, err := cm.GuestName("bob"); err != nil || name != "guest-bob" {
+		t.Errorf("GuestName = (%s, %v), want: (guest-bob, nil)", name, err)
+	}
+}
@@ -1,75 +1,237 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
-	"io/ioutil"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 
+	"github.com/bgmerrell/gochatd/accounts"
 	"github.com/bgmerrell/gochatd/chat"
 	httphandler "github.com/bgmerrell/gochatd/handlers/http"
 	"github.com/bgmerrell/gochatd/handlers/raw"
+	"github.com/bgmerrell/gochatd/handlers/websocket"
+	"github.com/bgmerrell/gochatd/listener"
+	"github.com/bgmerrell/gochatd/moderation"
+	"github.com/bgmerrell/gochatd/ratelimit"
+	"github.com/bgmerrell/gochatd/search"
+	"github.com/bgmerrell/gochatd/store"
+	"github.com/bgmerrell/gochatd/tlsconf"
+	"github.com/bgmerrell/gochatd/tokens"
 )
 
 var confPath string
+var checkConfig bool
+
+// flagOverrides holds the settings given on the command line (see
+// registerFlags).
+var flagOverrides = registerFlags(flag.CommandLine)
 
 func init() {
 	flag.StringVar(&confPath, "conf-path", "gochatd-conf.json", "Configuration file path")
-}
-
-type config struct {
-	LogPath         string `json:"log_path"`
-	Addr            string `json:"address"`
-	MaxNameLen      int    `json:"max_name_length"`
-	MsgBufSize      int    `json:"msg_buffer_size"`
-	MaxHistoryLines int    `json:"max_history_lines"`
+	flag.BoolVar(&checkConfig, "check-config", false, "Validate the configuration and exit")
 }
 
 func main() {
 	flag.Parse()
-	cfgRaw, err := ioutil.ReadFile(confPath)
+	cfg, err := loadConfig(confPath, flagOverrides)
 	if err != nil {
-		log.Fatalf("Failed to read log file (%s): %s", confPath, err)
+		log.Fatal(err)
 	}
-	// Just use a JSON config file to avoid 3rd party dependencies (for
-	// something like ini or toml)
-	cfg := config{}
-	err = json.Unmarshal(cfgRaw, &cfg)
-	if err != nil {
-		log.Fatalf("Failed to parse log file (%s): %s", confPath, err)
+	if checkConfig {
+		fmt.Printf("%s is valid\n", confPath)
+		return
 	}
-	chatLogFile, err := os.OpenFile(cfg.LogPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	// The settings that can be reloaded (see reloadConfig) are read from
+	// live rather than cfg
+	var live atomic.Value
+	live.Store(cfg)
+	chatLogFile, err := openLog(cfg.LogPath)
 	if err != nil {
 		log.Fatalf("Failed to open chat log: %s", err)
 	}
-	defer chatLogFile.Close()
+	// chatLogFile changes when the log is reopened (see reloadConfig)
+	defer func() { closeLog(chatLogFile) }()
 	cm := chat.NewChatManager(chatLogFile, cfg.MaxHistoryLines)
+	cm.SetLogWhispers(cfg.LogWhispers)
+	// The settings have been validated by loadConfig
+	logFormatter, _ := chat.FormatterByName(cfg.LogFormat)
+	cm.SetLogFormatter(logFormatter)
+	policy, _ := chat.ParseOverflowPolicy(cfg.SlowConsumerPolicy)
+	cm.SetQueuePolicy(cfg.ClientQueueSize, policy)
+	if cfg.StoreDir != "" {
+		retention := store.Retention{
+			MaxAge:      duration(cfg.RetentionMaxAge),
+			MaxMessages: cfg.RetentionMaxMessages,
+		}
+		msgStore, err := store.Open(cfg.StoreDir, cfg.StoreSegmentSize, retention)
+		if err != nil {
+			log.Fatalf("Failed to open message store: %s", err)
+		}
+		defer msgStore.Close()
+		err = cm.SetStore(msgStore)
+		if err != nil {
+			log.Fatalf("Failed to replay message store: %s", err)
+		}
+	}
+	if cfg.SearchMaxMessages > 0 {
+		err = cm.SetIndex(search.New(cfg.SearchMaxMessages))
+		if err != nil {
+			log.Fatalf("Failed to build the search index: %s", err)
+		}
+	}
+	if cfg.AccountsPath != "" {
+		accts, err := accounts.Open(cfg.AccountsPath)
+		if err != nil {
+			log.Fatalf("Failed to open accounts: %s", err)
+		}
+		cm.SetAccounts(accts, cfg.RequireRegistration)
+	}
+	if cfg.TokensPath != "" {
+		tk, err := tokens.Open(cfg.TokensPath)
+		if err != nil {
+			log.Fatalf("Failed to open tokens: %s", err)
+		}
+		cm.SetTokens(tk, cfg.HTTPGuestPrefix)
+	}
+	cm.SetLoginLimit(cfg.LoginFailureRate, cfg.LoginFailureBurst)
+	cm.SetOperators(cfg.Operators)
+	if cfg.ModerationPath != "" {
+		mod, err := moderation.Open(cfg.ModerationPath)
+		if err != nil {
+			log.Fatalf("Failed to open moderation: %s", err)
+		}
+		cm.SetModeration(mod)
+	}
 
-	http.HandleFunc("/chat",
+	limiter := ratelimit.NewLimiter(cfg.HTTPRate, cfg.HTTPRateBurst)
+	chatHandler := func(w http.ResponseWriter, r *http.Request) {
+		hndlErr := httphandler.Limit(w, r, limiter)
+		if hndlErr == nil {
+			cfg := live.Load().(*config)
+			hndlErr = httphandler.Handle(w, r, cm, cfg.MsgBufSize, cfg.MaxNameLen, cfg.MaxHistoryLines)
+		}
+		if hndlErr != nil {
+			log.Print(hndlErr.Msg)
+			httphandler.WriteError(w, r, hndlErr)
+		}
+	}
+	// "/chat" addresses the default room and "/chat/{room}" any other
+	http.HandleFunc("/chat", chatHandler)
+	http.HandleFunc("/chat/", chatHandler)
+	http.HandleFunc("/rooms",
 		func(w http.ResponseWriter, r *http.Request) {
-			hndlErr := httphandler.Handle(w, r, cm, cfg.MsgBufSize, cfg.MaxNameLen, cfg.MaxHistoryLines)
+			hndlErr := httphandler.Limit(w, r, limiter)
+			if hndlErr == nil {
+				hndlErr = httphandler.HandleRooms(w, r, cm)
+			}
 			if hndlErr != nil {
 				log.Print(hndlErr.Msg)
-				http.Error(w, hndlErr.Msg, hndlErr.Code)
+				httphandler.WriteError(w, r, hndlErr)
 			}
 		})
+	http.HandleFunc("/admin/",
+		func(w http.ResponseWriter, r *http.Request) {
+			hndlErr := httphandler.Limit(w, r, limiter)
+			if hndlErr == nil {
+				cfg := live.Load().(*config)
+				hndlErr = httphandler.HandleAdmin(w, r, cm, cfg.MsgBufSize)
+			}
+			if hndlErr != nil {
+				log.Print(hndlErr.Msg)
+				httphandler.WriteError(w, r, hndlErr)
+			}
+		})
+	pingInterval := duration(cfg.WSPingInterval)
+	http.HandleFunc("/ws",
+		func(w http.ResponseWriter, r *http.Request) {
+			if hndlErr := httphandler.Limit(w, r, limiter); hndlErr != nil {
+				log.Print(hndlErr.Msg)
+				httphandler.WriteError(w, r, hndlErr)
+				return
+			}
+			cfg := live.Load().(*config)
+			wsh := websocket.NewWebSocketHandler(cfg.MsgBufSize, cfg.MaxNameLen, pingInterval)
+			wsh.SetAllowedOrigins(cfg.WSAllowedOrigins)
+			wsh.SetRateLimit(cfg.WSRate, cfg.WSRateBurst, cfg.WSRateMaxViolations)
+			wsh.Handle(cm, w, r)
+		})
+	var tlsCfg *tls.Config
+	if cfg.TLSCertPath != "" {
+		tlsCfg, err = tlsconf.New(cfg.TLSCertPath, cfg.TLSKeyPath, cfg.TLSMinVersion, cfg.TLSClientCAPath)
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %s", err)
+		}
+	}
+	server := &http.Server{Addr: cfg.HTTPAddr, TLSConfig: tlsCfg}
 	go func() {
-		log.Fatal(http.ListenAndServe(":8080", nil))
+		var err error
+		if tlsCfg != nil {
+			// The certificate comes from the TLS configuration
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
 
-	ln, err := net.Listen("tcp", cfg.Addr)
+	lc := net.ListenConfig{KeepAliveConfig: cfg.keepAlive()}
+	ln, err := lc.Listen(context.Background(), "tcp", cfg.Addr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	for {
-		rh := raw.NewRawHandler(cfg.MsgBufSize, cfg.MaxNameLen)
-		conn, err := ln.Accept()
-		if err != nil {
+	if tlsCfg != nil {
+		ln = tls.NewListener(ln, tlsCfg)
+	}
+	// Temporary accept errors are retried by the listener, so any error
+	// it returns is fatal (unless the listener was closed to shut down)
+	limited := listener.New(ln, cfg.MaxConns, cfg.MaxConnsPerIP)
+	go func() {
+		for {
+			conn, err := limited.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				log.Fatalf("Accept failed: %s", err)
+			}
+			// Reloaded limits apply to new connections only
+			cfg := live.Load().(*config)
+			rh := raw.NewRawHandler(cfg.MaxLineLen, cfg.MaxNameLen)
+			rh.SetRateLimit(cfg.RawRate, cfg.RawRateBurst, cfg.RawRateMaxViolations)
+			rh.SetTimeouts(duration(cfg.RawLoginTimeout), duration(cfg.RawIdleTimeout), duration(cfg.RawIdleWarning))
+			go rh.Handle(cm, conn)
+		}
+	}()
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	var sig os.Signal
+	for sig = range signals {
+		if sig != syscall.SIGHUP {
+			break
 		}
-		go rh.Handle(cm, conn)
+		chatLogFile = reloadConfig(cm, &live, chatLogFile)
+	}
+	cfg = live.Load().(*config)
+	log.Printf("Received %s; shutting down (grace period: %s)", sig, cfg.gracePeriod())
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.gracePeriod())
+	defer cancel()
+	limited.Close()
+	if err = cm.Shutdown(ctx, cfg.ShutdownNotice); err != nil {
+		log.Printf("Failed to drain client writes: %s", err)
+	}
+	if err = server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down the HTTP server: %s", err)
 	}
+	// The chat log and the message store are closed on return
 }
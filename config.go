@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+	"github.com/bgmerrell/gochatd/tlsconf"
+)
+
+// envPrefix is prepended to the upper-cased name of a setting to form the
+// environment variable that overrides it (e.g., GOCHATD_MAX_NAME_LENGTH).
+const envPrefix = "GOCHATD_"
+
+// config holds the settings of the server.  Each setting is named by its
+// JSON key in the configuration file; its help tag documents it.  Settings
+// start out with the values of defaultConfig, which the file, then the
+// environment and then the command line override (see loadConfig).
+type config struct {
+	LogPath            string `json:"log_path" help:"Chat log path"`
+	Addr               string `json:"address" help:"Raw (telnet-style) listener address"`
+	HTTPAddr           string `json:"http_address" help:"HTTP listener address"`
+	MaxNameLen         int    `json:"max_name_length" help:"Maximum length of a user name"`
+	MsgBufSize         int    `json:"msg_buffer_size" help:"Maximum size of an HTTP or WebSocket message"`
+	MaxLineLen         int    `json:"max_line_length" help:"Maximum length of a raw line (0: msg_buffer_size)"`
+	MaxHistoryLines    int    `json:"max_history_lines" help:"Number of messages kept in memory per room"`
+	LogWhispers        bool   `json:"log_whispers" help:"Write private messages to the chat log"`
+	LogFormat          string `json:"log_format" help:"Chat log format (text, json or log)"`
+	ClientQueueSize    int    `json:"client_queue_size" help:"Number of messages queued per client"`
+	SlowConsumerPolicy string `json:"slow_consumer_policy" help:"What to do when a client queue is full (drop_oldest, drop_newest or disconnect)"`
+	WSPingInterval     string `json:"websocket_ping_interval" help:"WebSocket ping interval (0: no pings)"`
+	// Browsers may only open WebSockets from pages on the server's own
+	// host, or from WSAllowedOrigins.
+	WSAllowedOrigins []string `json:"websocket_allowed_origins" help:"Comma-separated origins (e.g., https://example.com) that WebSocket clients may also connect from"`
+	// The message store is disabled if StoreDir is empty
+	StoreDir             string `json:"store_dir" help:"Message store directory (empty: no store)"`
+	StoreSegmentSize     int    `json:"store_segment_size" help:"Number of messages per store segment"`
+	RetentionMaxAge      string `json:"retention_max_age" help:"How long stored messages are kept (empty: forever)"`
+	RetentionMaxMessages int    `json:"retention_max_messages" help:"Number of stored messages to keep (0: all)"`
+	// Search is disabled if SearchMaxMessages is 0
+	SearchMaxMessages int `json:"search_max_messages" help:"Number of messages in the search index (0: no search)"`
+	// Registration is disabled if AccountsPath is empty
+	AccountsPath        string `json:"accounts_path" help:"Accounts file (empty: no registration)"`
+	RequireRegistration bool   `json:"require_registration" help:"Only allow registered names"`
+	// HTTP API tokens are disabled if TokensPath is empty.  Once they
+	// are enabled, HTTP posts without a token are refused, unless
+	// HTTPGuestPrefix is set, in which case they are sent under the
+	// requested name with HTTPGuestPrefix prepended.
+	TokensPath      string `json:"tokens_path" help:"API tokens file (empty: no tokens)"`
+	HTTPGuestPrefix string `json:"http_guest_prefix" help:"Name prefix of HTTP posts without a token (empty: refuse them)"`
+	// Operators are registered names that can kick, and, if
+	// ModerationPath is set, ban, mute and make other operators, who
+	// are kept in ModerationPath along with the bans and mutes.
+	Operators      []string `json:"operators" help:"Comma-separated registered names that are operators"`
+	ModerationPath string   `json:"moderation_path" help:"Bans, mutes and granted operators file (empty: kicking only)"`
+	// Rate limits are in lines (raw), messages (WebSocket) or requests
+	// (HTTP, including WebSocket handshakes) per second; a rate of 0
+	// disables the limit.  Raw and WebSocket clients are disconnected
+	// after RawRateMaxViolations and WSRateMaxViolations warnings (0 only
+	// warns).
+	RawRate              float64 `json:"raw_rate_limit" help:"Raw lines per second per connection (0: no limit)"`
+	RawRateBurst         int     `json:"raw_rate_burst" help:"Raw line burst size"`
+	RawRateMaxViolations int     `json:"raw_rate_max_violations" help:"Rate limit warnings before a raw client is disconnected (0: never)"`
+	WSRate               float64 `json:"websocket_rate_limit" help:"WebSocket messages per second per connection (0: no limit)"`
+	WSRateBurst          int     `json:"websocket_rate_burst" help:"WebSocket message burst size"`
+	WSRateMaxViolations  int     `json:"websocket_rate_max_violations" help:"Rate limit warnings before a WebSocket client is disconnected (0: never)"`
+	HTTPRate             float64 `json:"http_rate_limit" help:"HTTP requests per second per IP (0: no limit)"`
+	HTTPRateBurst        int     `json:"http_rate_burst" help:"HTTP request burst size"`
+	// Failed logins (i.e., wrong passwords) are limited per IP, whatever
+	// the transport; a rate of 0 disables the limit.
+	LoginFailureRate  float64 `json:"login_failure_rate" help:"Failed logins per second per IP (0: no limit)"`
+	LoginFailureBurst int     `json:"login_failure_burst" help:"Failed login burst size"`
+	// Raw connection limits; 0 means no limit
+	MaxConns      int `json:"max_connections" help:"Maximum raw connections (0: no limit)"`
+	MaxConnsPerIP int `json:"max_connections_per_ip" help:"Maximum raw connections per IP (0: no limit)"`
+	// Raw clients have RawLoginTimeout to log in, and are disconnected
+	// after RawIdleTimeout without sending a line (having been warned
+	// RawIdleWarning before); an empty or 0 timeout disables it.
+	RawLoginTimeout string `json:"raw_login_timeout" help:"How long a raw client has to log in (0: no limit)"`
+	RawIdleTimeout  string `json:"raw_idle_timeout" help:"How long a raw client may go without sending a line (0: no limit)"`
+	RawIdleWarning  string `json:"raw_idle_warning" help:"How long before an idle timeout a raw client is warned (0: no warning)"`
+	// TCP keepalive probes are sent on raw connections that have been
+	// quiet for RawKeepAlive (empty or 0 disables them), every
+	// RawKeepAliveInterval, until RawKeepAliveCount of them have gone
+	// unanswered and the connection is dropped.
+	RawKeepAlive         string `json:"raw_keepalive" help:"Idle time before TCP keepalive probes are sent on raw connections (0: no keepalive)"`
+	RawKeepAliveInterval string `json:"raw_keepalive_interval" help:"Time between TCP keepalive probes"`
+	RawKeepAliveCount    int    `json:"raw_keepalive_count" help:"Unanswered TCP keepalive probes before a raw connection is dropped"`
+	// TLS is disabled if TLSCertPath is empty.  Otherwise both the raw
+	// and HTTP listeners use TLS, and clients must present a certificate
+	// signed by TLSClientCAPath if it is set.  The certificate is
+	// reloaded when its files change.
+	TLSCertPath     string `json:"tls_cert_path" help:"TLS certificate (empty: no TLS)"`
+	TLSKeyPath      string `json:"tls_key_path" help:"TLS key"`
+	TLSMinVersion   string `json:"tls_min_version" help:"Minimum TLS version (1.0, 1.1, 1.2 or 1.3)"`
+	TLSClientCAPath string `json:"tls_client_ca_path" help:"CA certificates that client certificates must be signed by (empty: no client certificates)"`
+	// On SIGINT or SIGTERM, clients are sent ShutdownNotice (unless it
+	// is empty) and have up to ShutdownGracePeriod to receive what they
+	// have been sent before they are disconnected.
+	ShutdownNotice      string `json:"shutdown_notice" help:"Notice sent to everyone on shutdown (empty: none)"`
+	ShutdownGracePeriod string `json:"shutdown_grace_period" help:"How long clients have to receive their messages on shutdown"`
+}
+
+// defaultConfig returns the default settings.
+func defaultConfig() *config {
+	return &config{
+		LogPath:              "gochatd.log",
+		Addr:                 ":8079",
+		HTTPAddr:             ":8080",
+		MaxNameLen:           32,
+		MsgBufSize:           512,
+		MaxLineLen:           0,
+		MaxHistoryLines:      1024,
+		LogWhispers:          false,
+		LogFormat:            "log",
+		ClientQueueSize:      256,
+		SlowConsumerPolicy:   "drop_oldest",
+		WSPingInterval:       "30s",
+		WSAllowedOrigins:     nil,
+		StoreDir:             "",
+		StoreSegmentSize:     10000,
+		RetentionMaxAge:      "",
+		RetentionMaxMessages: 0,
+		SearchMaxMessages:    0,
+		AccountsPath:         "",
+		RequireRegistration:  false,
+		TokensPath:           "",
+		HTTPGuestPrefix:      "",
+		Operators:            nil,
+		ModerationPath:       "",
+		RawRate:              0,
+		RawRateBurst:         10,
+		RawRateMaxViolations: 3,
+		WSRate:               0,
+		WSRateBurst:          10,
+		WSRateMaxViolations:  3,
+		HTTPRate:             0,
+		HTTPRateBurst:        20,
+		LoginFailureRate:     0.1,
+		LoginFailureBurst:    5,
+		MaxConns:             0,
+		MaxConnsPerIP:        0,
+		RawLoginTimeout:      "30s",
+		RawIdleTimeout:       "",
+		RawIdleWarning:       "1m",
+		RawKeepAlive:         "15s",
+		RawKeepAliveInterval: "15s",
+		RawKeepAliveCount:    9,
+		TLSCertPath:          "",
+		TLSKeyPath:           "",
+		TLSMinVersion:        "1.2",
+		TLSClientCAPath:      "",
+		ShutdownNotice:       "The server is shutting down",
+		ShutdownGracePeriod:  "10s",
+	}
+}
+
+// ConfigError lists everything that is wrong with a configuration.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "Invalid configuration:\n\t" + strings.Join(e.Problems, "\n\t")
+}
+
+// add records a problem with a setting.
+func (e *ConfigError) add(name string, format string, a ...interface{}) {
+	e.Problems = append(e.Problems, name+": "+fmt.Sprintf(format, a...))
+}
+
+// settingName returns the name (JSON key) of the i-th config field.
+func settingName(i int) string {
+	return strings.Split(reflect.TypeOf(config{}).Field(i).Tag.Get("json"), ",")[0]
+}
+
+// flagName returns the command-line flag that overrides a setting.
+func flagName(name string) string {
+	return strings.Replace(name, "_", "-", -1)
+}
+
+// envName returns the environment variable that overrides a setting.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(name)
+}
+
+// set parses value into the i-th config field.
+func (cfg *config) set(i int, value string) error {
+	field := reflect.ValueOf(cfg).Elem().Field(i)
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("not a number")
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("not a boolean")
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		// Lists are comma-separated
+		names := []string{}
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		field.Set(reflect.ValueOf(names))
+	default:
+		// Only the kinds above are used by config
+		panic("config: unsupported setting kind: " + field.Kind().String())
+	}
+	return nil
+}
+
+// overrides holds the settings given on the command line, by name.
+type overrides map[string]string
+
+// registerFlags defines a command-line flag in fs for every setting, e.g.,
+// "-max-name-length" for max_name_length.  The flags are recorded in the
+// returned overrides.
+func registerFlags(fs *flag.FlagSet) overrides {
+	o := overrides{}
+	defaults := reflect.ValueOf(defaultConfig()).Elem()
+	for i := 0; i < defaults.NumField(); i++ {
+		name := settingName(i)
+		help := reflect.TypeOf(config{}).Field(i).Tag.Get("help")
+		value := fmt.Sprint(defaults.Field(i).Interface())
+		if names, ok := defaults.Field(i).Interface().([]string); ok {
+			value = strings.Join(names, ",")
+		}
+		usage := fmt.Sprintf("%s (default %q; also %s)", help, value, envName(name))
+		fs.Func(flagName(name), usage, func(value string) error {
+			o[name] = value
+			return nil
+		})
+	}
+	return o
+}
+
+// loadConfig returns the configuration: the defaults, overridden by the JSON
+// file at path, then by GOCHATD_* environment variables (see envName), then
+// by the command-line flags in o.  The result is validated; all of the
+// problems found are reported in a *ConfigError.
+func loadConfig(path string, o overrides) (*config, error) {
+	cfgRaw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to read config file (%s): %s", path, err))
+	}
+	// Just use a JSON config file to avoid 3rd party dependencies (for
+	// something like ini or toml)
+	cfg := defaultConfig()
+	dec := json.NewDecoder(bytes.NewReader(cfgRaw))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(cfg); err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to parse config file (%s): %s", path, err))
+	}
+	cfgErr := &ConfigError{}
+	for i := 0; i < reflect.ValueOf(cfg).Elem().NumField(); i++ {
+		name := settingName(i)
+		if value, ok := os.LookupEnv(envName(name)); ok {
+			if err = cfg.set(i, value); err != nil {
+				cfgErr.add(name, "invalid %s %q: %s", envName(name), value, err)
+			}
+		}
+		if value, ok := o[name]; ok {
+			if err = cfg.set(i, value); err != nil {
+				cfgErr.add(name, "invalid -%s %q: %s", flagName(name), value, err)
+			}
+		}
+	}
+	if cfg.MaxLineLen == 0 {
+		// Older configurations only have a message buffer size
+		cfg.MaxLineLen = cfg.MsgBufSize
+	}
+	cfg.validate(cfgErr)
+	if len(cfgErr.Problems) > 0 {
+		return nil, cfgErr
+	}
+	return cfg, nil
+}
+
+// validate adds every problem with the settings to cfgErr.
+func (cfg *config) validate(cfgErr *ConfigError) {
+	if cfg.LogPath == "" {
+		cfgErr.add("log_path", "required")
+	}
+	// The settings of each kind are checked in the order of the config
+	// fields, so that problems are reported in a stable order
+	for _, addr := range []struct {
+		name  string
+		value string
+	}{
+		{"address", cfg.Addr},
+		{"http_address", cfg.HTTPAddr},
+	} {
+		if _, _, err := net.SplitHostPort(addr.value); err != nil {
+			cfgErr.add(addr.name, "invalid address %q: %s", addr.value, err)
+		}
+	}
+	// The segment size only matters with a store
+	storeSegmentSize := 1
+	if cfg.StoreDir != "" {
+		storeSegmentSize = cfg.StoreSegmentSize
+	}
+	for _, n := range []struct {
+		name     string
+		value    float64
+		positive bool
+	}{
+		{"max_name_length", float64(cfg.MaxNameLen), true},
+		{"msg_buffer_size", float64(cfg.MsgBufSize), true},
+		{"max_line_length", float64(cfg.MaxLineLen), true},
+		{"max_history_lines", float64(cfg.MaxHistoryLines), true},
+		{"client_queue_size", float64(cfg.ClientQueueSize), true},
+		{"store_segment_size", float64(storeSegmentSize), true},
+		{"retention_max_messages", float64(cfg.RetentionMaxMessages), false},
+		{"search_max_messages", float64(cfg.SearchMaxMessages), false},
+		{"raw_rate_limit", cfg.RawRate, false},
+		{"raw_rate_burst", float64(cfg.RawRateBurst), false},
+		{"raw_rate_max_violations", float64(cfg.RawRateMaxViolations), false},
+		{"websocket_rate_limit", cfg.WSRate, false},
+		{"websocket_rate_burst", float64(cfg.WSRateBurst), false},
+		{"websocket_rate_max_violations", float64(cfg.WSRateMaxViolations), false},
+		{"http_rate_limit", cfg.HTTPRate, false},
+		{"http_rate_burst", float64(cfg.HTTPRateBurst), false},
+		{"login_failure_rate", cfg.LoginFailureRate, false},
+		{"login_failure_burst", float64(cfg.LoginFailureBurst), false},
+		{"max_connections", float64(cfg.MaxConns), false},
+		{"max_connections_per_ip", float64(cfg.MaxConnsPerIP), false},
+		{"raw_keepalive_count", float64(cfg.RawKeepAliveCount), false},
+	} {
+		if n.positive && n.value <= 0 {
+			cfgErr.add(n.name, "must be positive (got %v)", n.value)
+		} else if n.value < 0 {
+			cfgErr.add(n.name, "must not be negative (got %v)", n.value)
+		}
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+	}{
+		{"websocket_ping_interval", cfg.WSPingInterval},
+		{"retention_max_age", cfg.RetentionMaxAge},
+		{"raw_login_timeout", cfg.RawLoginTimeout},
+		{"raw_idle_timeout", cfg.RawIdleTimeout},
+		{"raw_idle_warning", cfg.RawIdleWarning},
+		{"raw_keepalive", cfg.RawKeepAlive},
+		{"raw_keepalive_interval", cfg.RawKeepAliveInterval},
+		{"shutdown_grace_period", cfg.ShutdownGracePeriod},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if parsed, err := time.ParseDuration(d.value); err != nil {
+			cfgErr.add(d.name, "%s", err)
+		} else if parsed < 0 {
+			cfgErr.add(d.name, "must not be negative (got %s)", d.value)
+		}
+	}
+	if _, ok := chat.FormatterByName(cfg.LogFormat); !ok {
+		cfgErr.add("log_format", "unknown format %q", cfg.LogFormat)
+	}
+	if _, err := chat.ParseOverflowPolicy(cfg.SlowConsumerPolicy); err != nil {
+		cfgErr.add("slow_consumer_policy", "%s", err)
+	}
+	if idle := duration(cfg.RawIdleTimeout); idle > 0 && duration(cfg.RawIdleWarning) >= idle {
+		cfgErr.add("raw_idle_warning", "must be shorter than raw_idle_timeout (%s)", cfg.RawIdleTimeout)
+	}
+	if cfg.RequireRegistration && cfg.AccountsPath == "" {
+		cfgErr.add("require_registration", "needs an accounts_path")
+	}
+	if cfg.TokensPath != "" && cfg.AccountsPath == "" {
+		cfgErr.add("tokens_path", "needs an accounts_path")
+	}
+	if len(cfg.Operators) > 0 && cfg.AccountsPath == "" {
+		cfgErr.add("operators", "needs an accounts_path")
+	}
+	if cfg.ModerationPath != "" && cfg.AccountsPath == "" {
+		cfgErr.add("moderation_path", "needs an accounts_path")
+	}
+	if cfg.TLSCertPath != "" && cfg.TLSKeyPath == "" {
+		cfgErr.add("tls_key_path", "required with a tls_cert_path")
+	} else if cfg.TLSCertPath == "" && cfg.TLSKeyPath != "" {
+		cfgErr.add("tls_cert_path", "required with a tls_key_path")
+	}
+	if cfg.TLSClientCAPath != "" && cfg.TLSCertPath == "" {
+		cfgErr.add("tls_client_ca_path", "needs a tls_cert_path")
+	}
+	if _, err := tlsconf.ParseVersion(cfg.TLSMinVersion); err != nil {
+		cfgErr.add("tls_min_version", "%s", err)
+	}
+}
+
+// duration returns a validated duration setting (0 if it is empty).
+func duration(s string) time.Duration {
+	d, _ := time.ParseDuration(s)
+	return d
+}
+
+// gracePeriod returns the shutdown grace period.
+func (cfg *config) gracePeriod() time.Duration {
+	return duration(cfg.ShutdownGracePeriod)
+}
+
+// keepAlive returns the TCP keepalive settings of raw connections.
+func (cfg *config) keepAlive() net.KeepAliveConfig {
+	return net.KeepAliveConfig{
+		Enable:   duration(cfg.RawKeepAlive) > 0,
+		Idle:     duration(cfg.RawKeepAlive),
+		Interval: duration(cfg.RawKeepAliveInterval),
+		Count:    cfg.RawKeepAliveCount,
+	}
+}
+
+// merge returns a copy of cfg with the reloadable settings of newCfg, and
+// the names of the changed settings that need a restart.
+func (cfg *config) merge(newCfg *config) (merged *config, restart []string) {
+	merged = &config{}
+	*merged = *cfg
+	oldVal := reflect.ValueOf(cfg).Elem()
+	newVal := reflect.ValueOf(newCfg).Elem()
+	mergedVal := reflect.ValueOf(merged).Elem()
+	for i := 0; i < oldVal.NumField(); i++ {
+		if reflect.DeepEqual(oldVal.Field(i).Interface(), newVal.Field(i).Interface()) {
+			continue
+		}
+		name := settingName(i)
+		if reloadable[name] {
+			mergedVal.Field(i).Set(newVal.Field(i))
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	return merged, restart
+}
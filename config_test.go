@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeConfig writes a configuration file and returns its path and a
+// function that removes it.
+func writeConfig(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "gochatd-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "gochatd-conf.json")
+	if err = ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	path, cleanup := writeConfig(t, `{"msg_buffer_size": 256}`)
+	defer cleanup()
+	cfg, err := loadConfig(path, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := defaultConfig()
+	expected.MsgBufSize = 256
+	// Older configurations only have a message buffer size
+	expected.MaxLineLen = 256
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("loadConfig = %+v, want: %+v", cfg, expected)
+	}
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	path, cleanup := writeConfig(t, `{"max_name_length": 10, "max_history_lines": 10, "address": ":1", "accounts_path": "accounts.json"}`)
+	defer cleanup()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	o := registerFlags(fs)
+	if err := fs.Parse([]string{"-max-history-lines", "30", "-log-whispers=true", "-operators", " alice, bob,"}); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GOCHATD_MAX_NAME_LENGTH", "20")
+	os.Setenv("GOCHATD_MAX_HISTORY_LINES", "20")
+	defer os.Unsetenv("GOCHATD_MAX_NAME_LENGTH")
+	defer os.Unsetenv("GOCHATD_MAX_HISTORY_LINES")
+	cfg, err := loadConfig(path, o)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if cfg.Addr != ":1" || cfg.MaxNameLen != 20 || cfg.MaxHistoryLines != 30 || !cfg.LogWhispers {
+		t.Errorf("loadConfig = %+v, want the file, environment and flag values", cfg)
+	}
+	if !reflect.DeepEqual(cfg.Operators, []string{"alice", "bob"}) {
+		t.Errorf("Operators = %q, want: [alice bob]", cfg.Operators)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	path, cleanup := writeConfig(t, `{
+		"max_history_lines": 0,
+		"http_address": "8080",
+		"retention_max_age": "forever",
+		"slow_consumer_policy": "ignore",
+		"raw_idle_timeout": "1m",
+		"tokens_path": "/tmp/tokens.json"
+	}`)
+	defer cleanup()
+	_, err := loadConfig(path, overrides{"raw_rate_limit": "fast"})
+	cfgErr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("loadConfig error = %v, want a *ConfigError", err)
+	}
+	expected := []string{
+		`raw_rate_limit: invalid -raw-rate-limit "fast": not a number`,
+		`http_address: invalid address "8080": address 8080: missing port in address`,
+		`max_history_lines: must be positive (got 0)`,
+		`retention_max_age: time: invalid duration "forever"`,
+		`slow_consumer_policy: Unknown overflow policy: ignore`,
+		`raw_idle_warning: must be shorter than raw_idle_timeout (1m)`,
+		`tokens_path: needs an accounts_path`,
+	}
+	if !reflect.DeepEqual(cfgErr.Problems, expected) {
+		t.Errorf("Problems = %q, want: %q", cfgErr.Problems, expected)
+	}
+
+	path, cleanup = writeConfig(t, `{"max_histroy_lines": 10}`)
+	defer cleanup()
+	if _, err = loadConfig(path, nil); err == nil {
+		t.Error("Expected an error for an unknown setting")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	old := defaultConfig()
+	newCfg := defaultConfig()
+	newCfg.MaxHistoryLines = 10
+	newCfg.Addr = ":1"
+	merged, restart := old.merge(newCfg)
+	if merged.MaxHistoryLines != 10 || merged.Addr != old.Addr {
+		t.Errorf("merge = %+v, want only max_history_lines changed", merged)
+	}
+	if !reflect.DeepEqual(restart, []string{"address"}) {
+		t.Errorf("restart = %v, want: [address]", restart)
+	}
+}
@@ -3,6 +3,8 @@ package dummyconn
 import (
 	"errors"
 	"net"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -11,51 +13,139 @@ var ConnClosedErrWrite = errors.New("Write error: connection closed")
 
 // dummyConn implements net.Conn.  It is meant to use as a mock connection
 // for unit tests.  It communicates reads and writes over the Ch channel.
+// Reads and writes that pass their deadline fail with
+// os.ErrDeadlineExceeded, like those of a real connection.  Closing the
+// connection closes closed (never Ch, which may still be written to), so
+// that pending reads and writes fail.
 type dummyConn struct {
-	Ch       chan []byte
-	isClosed bool
+	Ch        chan []byte
+	closed    chan struct{}
+	closeOnce *sync.Once
+	read      deadline
+	write     deadline
 }
 
 // NewDummyConn returns an initialized dummyConn
 func NewDummyConn() *dummyConn {
 	return &dummyConn{
 		make(chan []byte),
-		false}
+		make(chan struct{}),
+		&sync.Once{},
+		newDeadline(),
+		newDeadline()}
+}
+
+// isClosed returns a bool indicating whether the dummyConn has been closed.
+func (d *dummyConn) isClosed() bool {
+	select {
+	case <-d.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// deadline is a read or write deadline.  changed is closed (and replaced)
+// whenever the deadline changes, so that a blocked read or write can pick
+// up the new deadline.
+type deadline struct {
+	mu      *sync.Mutex
+	t       time.Time
+	changed chan struct{}
+}
+
+// newDeadline returns a deadline that is not set.
+func newDeadline() deadline {
+	return deadline{&sync.Mutex{}, time.Time{}, make(chan struct{})}
+}
+
+// set changes the deadline to t (the zero time means no deadline).
+func (dl *deadline) set(t time.Time) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.t = t
+	close(dl.changed)
+	dl.changed = make(chan struct{})
+}
+
+// wait returns a channel that fires when the deadline passes (nil if it
+// isn't set), a function that releases the channel's timer, and a channel
+// that is closed if the deadline changes.  exceeded is true if the deadline
+// has already passed.
+func (dl *deadline) wait() (expired <-chan time.Time, stop func(), changed <-chan struct{}, exceeded bool) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	stop = func() {}
+	if !dl.t.IsZero() {
+		d := time.Until(dl.t)
+		if d <= 0 {
+			return nil, stop, dl.changed, true
+		}
+		timer := time.NewTimer(d)
+		expired = timer.C
+		stop = func() { timer.Stop() }
+	}
+	return expired, stop, dl.changed, false
 }
 
 // Read reads from Ch and stores the read bytes in b.  It returns the number
 // of bytes read and any errors.
 func (d *dummyConn) Read(b []byte) (n int, err error) {
-	out := <-d.Ch
-	if out == nil {
-		return 0, ConnClosedErrRead
+	for {
+		if d.isClosed() {
+			return 0, ConnClosedErrRead
+		}
+		expired, stop, changed, exceeded := d.read.wait()
+		if exceeded {
+			return 0, os.ErrDeadlineExceeded
+		}
+		select {
+		case out := <-d.Ch:
+			stop()
+			n = copy(b, out)
+			return n, nil
+		case <-d.closed:
+			stop()
+			return 0, ConnClosedErrRead
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		case <-changed:
+			stop()
+		}
 	}
-	n = copy(b, out)
-	return n, nil
 }
 
 // Write writes the bytes from b into Ch.  It returns the number of bytes
 // written and any errors.
 func (d *dummyConn) Write(b []byte) (n int, err error) {
-	defer func() {
-		// Return error if the "connection" (i.e., the channel) is closed
-		if e := recover(); e != nil {
-			err = ConnClosedErrWrite
-		}
-	}()
 	b = b[:]
-	d.Ch <- b
-	return len(b), nil
+	for {
+		if d.isClosed() {
+			return 0, ConnClosedErrWrite
+		}
+		expired, stop, changed, exceeded := d.write.wait()
+		if exceeded {
+			return 0, os.ErrDeadlineExceeded
+		}
+		select {
+		case d.Ch <- b:
+			stop()
+			return len(b), nil
+		case <-d.closed:
+			stop()
+			return 0, ConnClosedErrWrite
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		case <-changed:
+			stop()
+		}
+	}
 }
 
-// Close marks the dummyConn as closed and closes Ch.  Close() can be called
-// multiple times.
+// Close marks the dummyConn as closed.  Close() can be called multiple
+// times.
 func (d *dummyConn) Close() error {
-	defer func() {
-		// Channel already closed, that's OK
-		recover()
-	}()
-	close(d.Ch)
+	d.closeOnce.Do(func() { close(d.closed) })
 	return nil
 }
 
@@ -85,17 +175,21 @@ func (d *dummyConn) RemoteAddr() net.Addr {
 	return &dummyAddr{"dummy", "remote"}
 }
 
-// SetDeadline is not implemented for dummyConn
+// SetDeadline sets both the read and the write deadline
 func (d *dummyConn) SetDeadline(t time.Time) error {
+	d.read.set(t)
+	d.write.set(t)
 	return nil
 }
 
-// SetDeadline is not implemented for dummyConn
+// SetReadDeadline sets the deadline of current and future reads
 func (d *dummyConn) SetReadDeadline(t time.Time) error {
+	d.read.set(t)
 	return nil
 }
 
-// SetDeadline is not implemented for dummyConn
+// SetWriteDeadline sets the deadline of current and future writes
 func (d *dummyConn) SetWriteDeadline(t time.Time) error {
+	d.write.set(t)
 	return nil
 }
@@ -2,6 +2,9 @@ package dummyconn
 
 import (
 	"bytes"
+	"errors"
+	"net"
+	"os"
 	"testing"
 	"time"
 )
@@ -14,7 +17,7 @@ func TestWriteRead(t *testing.T) {
 	go func() {
 		n, err := dc.Write(wMsg)
 		if err != nil {
-			t.Fatalf("Unexpected error: %s", err)
+			t.Errorf("Unexpected error: %s", err)
 		}
 		if n != len(wMsg) {
 			t.Errorf("n = %d, want %d", n, len(wMsg))
@@ -30,7 +33,7 @@ func TestWriteRead(t *testing.T) {
 	}
 	rMsg := buf[:n]
 	if !bytes.Equal(rMsg, wMsg) {
-		t.Errorf("read message: %s, want %s", n, len(wMsg))
+		t.Errorf("read message: %s, want %s", rMsg, wMsg)
 	}
 }
 
@@ -94,12 +97,46 @@ func TestSetReadDeadline(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
+	buf := make([]byte, bufSize)
+	_, err = dc.Read(buf)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Read() error = %v, want a timeout", err)
+	}
+
+	// A new deadline applies to a read that is already blocked
+	dc.SetReadDeadline(time.Time{})
+	done := make(chan error)
+	go func() {
+		_, err := dc.Read(buf)
+		done <- err
+	}()
+	dc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	select {
+	case err = <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Read() error = %v, want: %s", err, os.ErrDeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read() ignored its deadline")
+	}
+
+	// Clearing the deadline lets reads wait again
+	dc.SetReadDeadline(time.Time{})
+	go dc.Write([]byte("foo"))
+	if n, err := dc.Read(buf); err != nil || n != 3 {
+		t.Errorf("Read() = (%d, %v), want: (3, nil)", n, err)
+	}
 }
 
 func TestSetWriteDeadline(t *testing.T) {
 	dc := NewDummyConn()
-	err := dc.SetWriteDeadline(time.Now())
+	err := dc.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
+	// Nobody reads, so the write can only time out
+	_, err = dc.Write([]byte("foo"))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Write() error = %v, want: %s", err, os.ErrDeadlineExceeded)
+	}
 }
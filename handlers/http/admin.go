@@ -0,0 +1,246 @@
+package http
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+const (
+	adminPrefix       = "/admin"
+	operatorsResource = "operators"
+	bansResource      = "bans"
+	mutesResource     = "mutes"
+	kickResource      = "kick"
+)
+
+// adminRequest is the body of an admin POST request.  Form values with the
+// same names can be used instead of JSON.
+type adminRequest struct {
+	Name     string `json:"name"`
+	Target   string `json:"target"`
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+// sanctionKinds maps the sanction resources to the kinds they hold.
+var sanctionKinds = map[string]chat.SanctionKind{
+	bansResource:  chat.SanctionBan,
+	mutesResource: chat.SanctionMute,
+}
+
+// operator returns the name of the operator that makes a request.  The
+// operator is identified by a token with the moderate permission, or by
+// HTTP basic authentication with the operator's password.
+func operator(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager) (string, *HandlerError) {
+	name, hndlErr := authorize(w, r, cm, chat.PermModerate)
+	if hndlErr != nil {
+		return "", hndlErr
+	}
+	if name == "" {
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gochatd"`)
+			return "", handlerErrorFromChat(chat.AuthRequiredErr)
+		}
+		if err := cm.Login(clientIP(r), user, password); err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gochatd"`)
+			return "", handlerErrorFromChat(err)
+		}
+		name = user
+	}
+	if !cm.IsOperator(name) {
+		return "", handlerErrorFromChat(chat.PermissionDeniedErr)
+	}
+	return name, nil
+}
+
+// readAdminRequest reads the parameters of an admin POST request.
+func readAdminRequest(r *http.Request) (*adminRequest, *HandlerError) {
+	if !isJSON(r) {
+		return &adminRequest{r.FormValue("name"), r.FormValue("target"),
+			r.FormValue("duration"), r.FormValue("reason")}, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, &HandlerError{http.StatusInternalServerError, err.Error()}
+	}
+	req := &adminRequest{}
+	if err = json.Unmarshal(body, req); err != nil {
+		return nil, &HandlerError{http.StatusBadRequest, "invalid JSON: " + err.Error()}
+	}
+	return req, nil
+}
+
+// writeList writes lines as text, or v as JSON for clients that ask for it.
+func writeList(w http.ResponseWriter, r *http.Request, lines []string, v interface{}) *HandlerError {
+	if wantsJSON(r) {
+		return writeJSON(w, http.StatusOK, v)
+	}
+	for _, line := range lines {
+		if _, err := w.Write([]byte(line + "\n")); err != nil {
+			return &HandlerError{http.StatusInternalServerError, err.Error()}
+		}
+	}
+	return nil
+}
+
+// operators lists the operators (GET) or makes the requested name an
+// operator (POST).
+func operators(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, by string) *HandlerError {
+	switch r.Method {
+	case "GET":
+		names := cm.Operators()
+		return writeList(w, r, names, names)
+	case "POST":
+		req, hndlErr := readAdminRequest(r)
+		if hndlErr != nil {
+			return hndlErr
+		}
+		if req.Name == "" {
+			return &HandlerError{http.StatusBadRequest, "missing name"}
+		}
+		if err := cm.Op(by, req.Name); err != nil {
+			return handlerErrorFromChat(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}
+	w.Header().Set("Allow", "GET, POST")
+	return handlerErrorFromCode(http.StatusMethodNotAllowed)
+}
+
+// sanctions lists the bans or mutes (GET), imposes one (POST) or lifts the
+// one against target (DELETE).  A sanction lasts for its "duration" (e.g.,
+// "24h"), or for good if none is given.
+func sanctions(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, by string, kind chat.SanctionKind, target string) *HandlerError {
+	if target != "" {
+		if r.Method != "DELETE" {
+			w.Header().Set("Allow", "DELETE")
+			return handlerErrorFromCode(http.StatusMethodNotAllowed)
+		}
+		var err error
+		if kind == chat.SanctionBan {
+			err = cm.Unban(by, target)
+		} else {
+			err = cm.Unmute(by, target)
+		}
+		if err != nil {
+			return handlerErrorFromChat(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	switch r.Method {
+	case "GET":
+		lines := []string{}
+		list := []*chat.Sanction{}
+		for _, s := range cm.Sanctions() {
+			if s.Kind == kind {
+				lines = append(lines, s.Target+" (by "+s.By+")"+s.Describe())
+				list = append(list, s)
+			}
+		}
+		return writeList(w, r, lines, list)
+	case "POST":
+		req, hndlErr := readAdminRequest(r)
+		if hndlErr != nil {
+			return hndlErr
+		}
+		if req.Target == "" {
+			req.Target = req.Name
+		}
+		if req.Target == "" {
+			return &HandlerError{http.StatusBadRequest, "missing target"}
+		}
+		var d time.Duration
+		if req.Duration != "" {
+			var err error
+			if d, err = time.ParseDuration(req.Duration); err != nil || d < 0 {
+				return &HandlerError{http.StatusBadRequest, "invalid duration"}
+			}
+		}
+		var s *chat.Sanction
+		var err error
+		if kind == chat.SanctionBan {
+			s, err = cm.Ban(by, req.Target, d, req.Reason)
+		} else {
+			s, err = cm.Mute(by, req.Target, d, req.Reason)
+		}
+		if err != nil {
+			return handlerErrorFromChat(err)
+		}
+		if wantsJSON(r) {
+			return writeJSON(w, http.StatusCreated, s)
+		}
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}
+	w.Header().Set("Allow", "GET, POST")
+	return handlerErrorFromCode(http.StatusMethodNotAllowed)
+}
+
+// kick disconnects the requested name.
+func kick(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, by string) *HandlerError {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return handlerErrorFromCode(http.StatusMethodNotAllowed)
+	}
+	req, hndlErr := readAdminRequest(r)
+	if hndlErr != nil {
+		return hndlErr
+	}
+	if req.Name == "" {
+		return &HandlerError{http.StatusBadRequest, "missing name"}
+	}
+	if err := cm.Kick(by, req.Name, req.Reason); err != nil {
+		return handlerErrorFromChat(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// HandleAdmin lets operators moderate the chat.  Requests need an operator's
+// token with the moderate permission ("Authorization: Bearer {token}") or
+// the operator's name and password (HTTP basic authentication).  The
+// resources are:
+//
+//	/admin/operators        GET lists the operators; POST a "name" to add one
+//	/admin/bans             GET lists the bans; POST a "target" (a name, an
+//	                        IP address or a CIDR block) to ban it, with an
+//	                        optional "duration" and "reason"
+//	/admin/bans/{target}    DELETE lifts a ban
+//	/admin/mutes            like /admin/bans, for mutes of names
+//	/admin/mutes/{name}     DELETE lifts a mute
+//	/admin/kick             POST a "name" (and a "reason") to disconnect it
+//
+// Parameters are sent as form values or as a JSON object.
+func HandleAdmin(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, maxBodySize int) (hndlErr *HandlerError) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBodySize))
+	by, hndlErr := operator(w, r, cm)
+	if hndlErr != nil {
+		return hndlErr
+	}
+	trimmed := strings.Trim(strings.TrimPrefix(r.URL.Path, adminPrefix), "/")
+	parts := strings.SplitN(trimmed, "/", 2)
+	if kind, ok := sanctionKinds[parts[0]]; ok {
+		target := ""
+		if len(parts) == 2 {
+			target = parts[1]
+		}
+		return sanctions(w, r, cm, by, kind, target)
+	} else if len(parts) == 2 {
+		return handlerErrorFromCode(http.StatusNotFound)
+	}
+	switch parts[0] {
+	case operatorsResource:
+		return operators(w, r, cm, by)
+	case kickResource:
+		return kick(w, r, cm, by)
+	}
+	return handlerErrorFromCode(http.StatusNotFound)
+}
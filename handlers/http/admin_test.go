@@ -0,0 +1,128 @@
+package http
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+	"github.com/bgmerrell/gochatd/internal/chattest"
+	"github.com/bgmerrell/gochatd/moderation"
+)
+
+// adminTest is a request to HandleAdmin (or Handle, for /chat paths) and
+// the status code it should get.
+type adminTest struct {
+	method string
+	path   string
+	body   string
+	auth   []string
+	code   int
+}
+
+// do makes the test's request from addr and returns the response.
+func (test *adminTest) do(t *testing.T, cm *chat.ChatManager, addr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+	req.RemoteAddr = addr + ":1234"
+	if strings.HasPrefix(test.body, "{") {
+		req.Header.Set("Content-Type", jsonContentType)
+	} else if test.body != "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if len(test.auth) == 1 {
+		req.Header.Set("Authorization", "Bearer "+test.auth[0])
+	} else if len(test.auth) == 2 {
+		req.SetBasicAuth(test.auth[0], test.auth[1])
+	}
+	w := httptest.NewRecorder()
+	var hErr *HandlerError
+	if strings.HasPrefix(test.path, pathPrefix) {
+		hErr = Handle(w, req, cm, 512, 32, historySize)
+	} else {
+		hErr = HandleAdmin(w, req, cm, 512)
+	}
+	if hErr != nil {
+		w.Code = hErr.Code
+	}
+	if w.Code != test.code {
+		t.Errorf("%s %s %s = %d, want: %d", test.method, test.path, test.body, w.Code, test.code)
+	}
+	return w
+}
+
+func TestHandleAdmin(t *testing.T) {
+	chat.Now = func() time.Time { return testNow }
+	dir, err := ioutil.TempDir("", "gochatd-moderation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mod, err := moderation.Open(filepath.Join(dir, "moderation.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := chat.NewChatManager(nil, historySize)
+	cm.SetAccounts(chattest.MemAccounts{"alice": "secret1", "bob": "secret2"}, false)
+	cm.SetTokens(chattest.MemTokens{}, "guest-")
+	cm.SetOperators([]string{"alice"})
+	cm.SetModeration(mod)
+	if _, err = cm.IssueToken("bob", []chat.Permission{chat.PermModerate}); err != chat.PermissionDeniedErr {
+		t.Errorf("IssueToken(bob, moderate) error = %v, want: %s", err, chat.PermissionDeniedErr)
+	}
+	token, err := cm.IssueToken("alice", []chat.Permission{chat.PermModerate})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	alice := []string{"alice", "secret1"}
+	for _, test := range []adminTest{
+		{"GET", "/admin/operators", "", nil, http.StatusUnauthorized},
+		{"GET", "/admin/operators", "", []string{"alice", "wrong"}, http.StatusUnauthorized},
+		{"GET", "/admin/operators", "", []string{"bob", "secret2"}, http.StatusForbidden},
+		{"GET", "/admin/operators", "", []string{token}, http.StatusOK},
+		{"GET", "/admin/bogus", "", alice, http.StatusNotFound},
+		{"POST", "/admin/bans", "target=10.0.0.0/8&duration=1h&reason=spam", alice, http.StatusCreated},
+		{"POST", "/admin/bans", "target=bob&duration=soon", alice, http.StatusBadRequest},
+		{"POST", "/admin/bans", `{"target": "alice"}`, alice, http.StatusForbidden},
+		{"POST", "/chat?name=carol", "hi", nil, http.StatusForbidden},
+		{"DELETE", "/admin/bans/10.0.0.0/8", "", alice, http.StatusNoContent},
+		{"DELETE", "/admin/bans/10.0.0.0/8", "", alice, http.StatusNotFound},
+		{"POST", "/chat?name=carol", "hi", nil, http.StatusOK},
+		{"POST", "/admin/mutes", `{"target": "bob", "reason": "flooding"}`, alice, http.StatusCreated},
+		{"POST", "/chat", "hi", []string{"bob", "secret2"}, http.StatusForbidden},
+		{"DELETE", "/admin/mutes/bob", "", alice, http.StatusNoContent},
+		{"POST", "/chat", "hi", []string{"bob", "secret2"}, http.StatusOK},
+		{"POST", "/admin/kick", "name=carol", alice, http.StatusNotFound},
+		{"POST", "/admin/operators", "name=bob", alice, http.StatusCreated},
+	} {
+		test.do(t, cm, "10.1.2.3")
+		if test.path == "/admin/bans" && test.code == http.StatusCreated {
+			list := &adminTest{"GET", "/admin/bans", "", alice, http.StatusOK}
+			w := list.do(t, cm, "10.1.2.3")
+			expected := "10.0.0.0/8 (by alice) until 02-Jan-06 16:04: spam\n"
+			if w.Body.String() != expected {
+				t.Errorf("GET /admin/bans = %q, want: %q", w.Body.String(), expected)
+			}
+		}
+	}
+
+	list := &adminTest{"GET", "/admin/operators", "", alice, http.StatusOK}
+	ops := list.do(t, cm, "127.0.0.1")
+	if ops.Body.String() != "alice\nbob\n" {
+		t.Errorf("GET /admin/operators = %q, want: \"alice\\nbob\\n\"", ops.Body.String())
+	}
+	mutes := &adminTest{"POST", "/admin/mutes", `{"target": "carol", "duration": "1h"}`, alice, http.StatusCreated}
+	w := mutes.do(t, cm, "127.0.0.1")
+	s := &chat.Sanction{}
+	if err = json.Unmarshal(w.Body.Bytes(), s); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s.Kind != chat.SanctionMute || s.Target != "carol" || !s.Expires.Equal(testNow.Add(time.Hour)) {
+		t.Errorf("POST /admin/mutes = %+v, want an hour's mute of carol", s)
+	}
+}
@@ -0,0 +1,111 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+const bearerPrefix = "Bearer "
+
+// bearerToken returns the token of a request's "Authorization: Bearer"
+// header, if it has one.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(bearerPrefix) || !strings.EqualFold(auth[:len(bearerPrefix)], bearerPrefix) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(bearerPrefix):]), true
+}
+
+// authorize returns the name that a request's bearer token acts as, provided
+// that the token has the permission perm.  The name is empty for requests
+// without a token.
+func authorize(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, perm chat.Permission) (string, *HandlerError) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return "", nil
+	}
+	name, err := cm.Authorize(token, perm)
+	if err == chat.InvalidTokenErr {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gochatd", error="invalid_token"`)
+	} else if err == chat.PermissionDeniedErr {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gochatd", error="insufficient_scope"`)
+	}
+	if err != nil {
+		return "", handlerErrorFromChat(err)
+	}
+	return name, nil
+}
+
+// sender returns the name that a post request acts as.  A token's name (see
+// authorize) fixes the sender.  Otherwise a registered name needs its
+// password, given through HTTP basic authentication (whose user name is used
+// if the request doesn't name the sender), and anyone else, credentials or
+// not, is subject to chat.ChatManager.GuestName.
+func sender(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, tokenName string, name string, maxNameSize int) (string, *HandlerError) {
+	if tokenName != "" {
+		if name != "" && name != tokenName {
+			return "", &HandlerError{http.StatusBadRequest, "name doesn't match the token"}
+		}
+		return tokenName, nil
+	}
+	user, password, hasAuth := r.BasicAuth()
+	if hasAuth && name == "" {
+		name = user
+	} else if hasAuth && name != user {
+		return "", &HandlerError{http.StatusBadRequest, "name doesn't match the credentials"}
+	}
+	if name == "" {
+		return "", &HandlerError{http.StatusBadRequest, "missing name"}
+	} else if len(name) > maxNameSize {
+		return "", &HandlerError{http.StatusBadRequest, "name too long"}
+	}
+	if !hasAuth || !cm.Registered(name) {
+		// Basic credentials only vouch for registered names
+		password = ""
+		var err error
+		if name, err = cm.GuestName(name); err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gochatd"`)
+			return "", handlerErrorFromChat(err)
+		}
+	}
+	if err := cm.Login(clientIP(r), name, password); err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gochatd"`)
+		return "", handlerErrorFromChat(err)
+	}
+	return name, nil
+}
+
+// identity returns the name that a request is authenticated as: its token's
+// name (see authorize), or else a registered name whose password is given
+// through HTTP basic authentication.  name, if not empty, must match.
+// Unlike sender, there is no guest fallback (an unregistered name has no
+// password to check), so identity suits requests that change the state of
+// a user (e.g., postAway) rather than just speak for one.
+func identity(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, tokenName string, name string) (string, *HandlerError) {
+	if tokenName != "" {
+		if name != "" && name != tokenName {
+			return "", &HandlerError{http.StatusBadRequest, "name doesn't match the token"}
+		}
+		return tokenName, nil
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gochatd"`)
+		return "", handlerErrorFromChat(chat.AuthRequiredErr)
+	}
+	if name != "" && name != user {
+		return "", &HandlerError{http.StatusBadRequest, "name doesn't match the credentials"}
+	}
+	err := chat.AuthFailedErr
+	if cm.Registered(user) {
+		err = cm.Login(clientIP(r), user, password)
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gochatd"`)
+		return "", handlerErrorFromChat(err)
+	}
+	return user, nil
+}
@@ -0,0 +1,95 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+	"github.com/bgmerrell/gochatd/internal/chattest"
+)
+
+func TestBearerToken(t *testing.T) {
+	tokens := chattest.MemTokens{}
+	cm := chat.NewChatManager(nil, historySize)
+	cm.SetAccounts(chattest.MemAccounts{"alice": "secret1", "bob": "secret2"}, false)
+	cm.SetTokens(tokens, "")
+	alice, _ := cm.IssueToken("alice", []chat.Permission{chat.PermRead, chat.PermPost})
+	bob, _ := cm.IssueToken("bob", []chat.Permission{chat.PermRead})
+	tests := []struct {
+		method string
+		query  string
+		token  string
+		code   int
+	}{
+		{"POST", "", "bogus", http.StatusUnauthorized},
+		{"POST", "?name=bob", bob, http.StatusForbidden},
+		{"GET", "", bob, http.StatusOK},
+		{"POST", "?name=bob", alice, http.StatusBadRequest},
+		{"POST", "", alice, http.StatusOK},
+		{"POST", "?name=alice", alice, http.StatusOK},
+		// Without a guest prefix, posting needs a token
+		{"POST", "?name=carol", "", http.StatusUnauthorized},
+		{"GET", "", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/chat"+test.query, strings.NewReader("hi"))
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		code := http.StatusOK
+		if hErr := Handle(w, req, cm, 512, 32, historySize); hErr != nil {
+			code = hErr.Code
+		}
+		if code != test.code {
+			t.Errorf("%s %s with token %q = %d, want: %d", test.method, test.query, test.token, code, test.code)
+		}
+		if code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s with token %q: expected a WWW-Authenticate header", test.method, test.query, test.token)
+		}
+	}
+}
+
+func TestGuestPrefix(t *testing.T) {
+	chat.Now = func() time.Time { return testNow }
+	cm := chat.NewChatManager(nil, historySize)
+	cm.SetTokens(chattest.MemTokens{}, "guest-")
+	req := httptest.NewRequest("POST", "/chat?name=carol", strings.NewReader("hi"))
+	w := httptest.NewRecorder()
+	if hErr := Handle(w, req, cm, 512, 32, historySize); hErr != nil {
+		t.Fatal("Unexpected error: ", hErr.Msg)
+	}
+	history, _ := cm.History(chat.DefaultRoom, 1)
+	if len(history) != 1 || history[0].Sender != "guest-carol" {
+		t.Errorf("History = %v, want a message from guest-carol", history)
+	}
+}
+
+func TestBasicAuthUnregistered(t *testing.T) {
+	chat.Now = func() time.Time { return testNow }
+	for _, guestPrefix := range []string{"guest-", ""} {
+		cm := chat.NewChatManager(nil, historySize)
+		cm.SetAccounts(chattest.MemAccounts{"alice": "secret1"}, false)
+		cm.SetTokens(chattest.MemTokens{}, guestPrefix)
+		req := httptest.NewRequest("POST", "/chat", strings.NewReader("hi"))
+		req.SetBasicAuth("bob", "anything")
+		w := httptest.NewRecorder()
+		hErr := Handle(w, req, cm, 512, 32, historySize)
+		if guestPrefix == "" {
+			if hErr == nil || hErr.Code != http.StatusUnauthorized {
+				t.Errorf("Without a guest prefix, Handle = %v, want a %d error", hErr, http.StatusUnauthorized)
+			}
+			continue
+		}
+		if hErr != nil {
+			t.Fatal("Unexpected error: ", hErr.Msg)
+		}
+		history, _ := cm.History(chat.DefaultRoom, 1)
+		if len(history) != 1 || history[0].Sender != "guest-bob" {
+			t.Errorf("History = %v, want a message from guest-bob", history)
+		}
+	}
+}
@@ -1,17 +1,30 @@
 package http
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bgmerrell/gochatd/chat"
 )
 
 const (
+	pathPrefix       = "/chat"
 	nameParam        = "name"
+	toParam          = "to"
 	linesParam       = "lines"
 	minLinesParamVal = 1
+	sinceParam       = "since"
+	beforeParam      = "before"
+	afterParam       = "after"
+	waitParam        = "wait"
+	maxWaitParamVal  = 60
+	lastIDHeader     = "X-Last-Message-ID"
+	prevCursorHeader = "X-Prev-Cursor"
+	nextCursorHeader = "X-Next-Cursor"
 )
 
 type HandlerError struct {
@@ -26,50 +39,365 @@ func handlerErrorFromCode(code int) *HandlerError {
 	}
 }
 
-// get reads from the chat.  The HTTP requests's "lines" parameter is used to
-// specify the number of lines to read from the chat.
-func get(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, maxHistoryLines int) (hndlErr *HandlerError) {
-	linesParamVal := r.URL.Query().Get(linesParam)
-	numLines, err := strconv.Atoi(linesParamVal)
+// handlerErrorFromChat maps an error returned by the ChatManager to a
+// HandlerError.
+func handlerErrorFromChat(err error) *HandlerError {
+	if _, ok := err.(*chat.NotConnectedError); ok {
+		return &HandlerError{http.StatusNotFound, err.Error()}
+	}
+	if _, ok := err.(*chat.QueryError); ok {
+		return &HandlerError{http.StatusBadRequest, err.Error()}
+	}
+	if _, ok := err.(*chat.SanctionedError); ok {
+		return &HandlerError{http.StatusForbidden, err.Error()}
+	}
+	switch err {
+	case chat.RoomNotFoundErr:
+		return &HandlerError{http.StatusNotFound, err.Error()}
+	case chat.RoomExistsErr:
+		return &HandlerError{http.StatusConflict, err.Error()}
+	case chat.InvalidRoomNameErr:
+		return &HandlerError{http.StatusBadRequest, err.Error()}
+	case chat.SearchDisabledErr, chat.AccountsDisabledErr:
+		return &HandlerError{http.StatusNotImplemented, err.Error()}
+	case chat.AuthFailedErr, chat.RegistrationRequiredErr, chat.InvalidTokenErr, chat.AuthRequiredErr:
+		return &HandlerError{http.StatusUnauthorized, err.Error()}
+	case chat.PermissionDeniedErr, chat.TokenNeedsRegistrationErr:
+		return &HandlerError{http.StatusForbidden, err.Error()}
+	case chat.OperatorErr, chat.OperatorNeedsRegistrationErr:
+		return &HandlerError{http.StatusForbidden, err.Error()}
+	case chat.InvalidTargetErr:
+		return &HandlerError{http.StatusBadRequest, err.Error()}
+	case chat.NotBannedErr, chat.NotMutedErr:
+		return &HandlerError{http.StatusNotFound, err.Error()}
+	case chat.ModerationDisabledErr:
+		return &HandlerError{http.StatusNotImplemented, err.Error()}
+	case chat.TokensDisabledErr:
+		return &HandlerError{http.StatusNotImplemented, err.Error()}
+	case chat.ShuttingDownErr:
+		return &HandlerError{http.StatusServiceUnavailable, err.Error()}
+	case chat.TooManyLoginsErr:
+		return &HandlerError{http.StatusTooManyRequests, err.Error()}
+	case chat.MessagesGoneErr:
+		return &HandlerError{http.StatusGone, err.Error()}
+	case chat.NameRegisteredErr, chat.NotAwayErr:
+		return &HandlerError{http.StatusConflict, err.Error()}
+	}
+	return &HandlerError{http.StatusInternalServerError, err.Error()}
+}
+
+// subresources are the resources below a room ("/chat/{room}/{resource}").
+// A lone "/chat/{resource}" addresses the resource of the DefaultRoom, so
+// they can't be room names (see chat.ValidRoomName).
+var subresources = map[string]bool{
+	streamResource: true,
+	searchResource: true,
+	usersResource:  true,
+}
+
+// parsePath returns the room and the room's resource (empty for the room
+// itself) addressed by a request path of the form "/chat/{room}/{resource}".
+// The room is empty for a plain "/chat" or "/chat/{resource}".
+func parsePath(path string) (roomName string, resource string) {
+	trimmed := strings.Trim(strings.TrimPrefix(path, pathPrefix), "/")
+	if trimmed == "" {
+		return "", ""
+	}
+	parts := strings.SplitN(trimmed, "/", 2)
+	if len(parts) == 1 {
+		if subresources[parts[0]] {
+			return "", parts[0]
+		}
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// poll returns the room's messages following the message with ID sinceID.
+// If there are none yet, it waits up to wait for one to arrive.
+func poll(r *http.Request, cm *chat.ChatManager, roomName string, sinceID uint64, wait time.Duration) ([]*chat.Message, error) {
+	sub, msgs, err := cm.Subscribe(roomName, sinceID)
+	if err != nil {
+		return nil, err
+	}
+	defer cm.Unsubscribe(sub)
+	if len(msgs) > 0 || wait <= 0 {
+		return msgs, nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case msg, ok := <-sub.C:
+		if ok {
+			msgs = append(msgs, msg)
+		}
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	return msgs, nil
+}
+
+// parseCursor parses a message ID cursor parameter (0 if it isn't set).
+func parseCursor(r *http.Request, param string) (uint64, *HandlerError) {
+	val := r.URL.Query().Get(param)
+	if val == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(val, 10, 64)
+	if err != nil || id == 0 {
+		return 0, &HandlerError{http.StatusBadRequest, "invalid " + param}
+	}
+	return id, nil
+}
+
+// getPage reads a page of up to numLines messages from a room, before or
+// after the message ID given by the "before" or "after" parameter.  The
+// cursors for the adjacent pages are reported in the X-Prev-Cursor and
+// X-Next-Cursor headers (or the page object, for JSON clients) when there
+// are such pages.
+func getPage(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, roomName string, numLines int) (hndlErr *HandlerError) {
+	before, hndlErr := parseCursor(r, beforeParam)
+	if hndlErr != nil {
+		return hndlErr
+	}
+	after, hndlErr := parseCursor(r, afterParam)
+	if hndlErr != nil {
+		return hndlErr
+	}
+	if before != 0 && after != 0 {
+		return &HandlerError{http.StatusBadRequest, "before and after can't be combined"}
+	}
+	page, err := cm.HistoryPage(roomName, before, after, numLines)
+	if err != nil {
+		return handlerErrorFromChat(err)
+	}
+	if page.Prev != 0 {
+		w.Header().Set(prevCursorHeader, strconv.FormatUint(page.Prev, 10))
+	}
+	if page.Next != 0 {
+		w.Header().Set(nextCursorHeader, strconv.FormatUint(page.Next, 10))
+	}
+	if wantsJSON(r) {
+		return writeJSON(w, http.StatusOK, page)
+	}
+	_, err = w.Write(chat.Format(chat.TextFormatter, page.Messages))
+	if err != nil {
+		return &HandlerError{http.StatusInternalServerError, err.Error()}
+	}
+	return hndlErr
+}
+
+// get reads from a room.  The HTTP requests's "lines" parameter is used to
+// specify the number of lines to read from the room.  If the "since"
+// parameter is set to a message ID, only the messages following that message
+// are read, and the "wait" parameter may be used to wait up to that many
+// seconds for one to arrive.  The ID of the last message read is reported in
+// the X-Last-Message-ID header so that the client can pass it as "since" in
+// its next request; if some of the messages following it can no longer be
+// read (see chat.ChatManager.Subscribe), a 410 error is returned instead.
+// Clients that ask for JSON get an array of message objects instead of
+// text.  See getPage for the "before" and "after"
+// pagination parameters, which read up to maxHistoryLines messages.
+func get(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, roomName string, maxHistoryLines int) (hndlErr *HandlerError) {
+	query := r.URL.Query()
+	numLines, err := strconv.Atoi(query.Get(linesParam))
 	// If a lines parameter was invalid or missing, just ask for all of
 	// the history lines.
 	if err != nil || numLines < minLinesParamVal {
 		numLines = maxHistoryLines
 	}
-	_, err = w.Write(cm.History(numLines))
+	if query.Get(beforeParam) != "" || query.Get(afterParam) != "" {
+		if query.Get(sinceParam) != "" {
+			return &HandlerError{http.StatusBadRequest, "since can't be combined with before or after"}
+		}
+		if numLines > maxHistoryLines {
+			numLines = maxHistoryLines
+		}
+		return getPage(w, r, cm, roomName, numLines)
+	}
+	var history []*chat.Message
+	var lastID uint64
+	if sinceParamVal := query.Get(sinceParam); sinceParamVal != "" {
+		lastID, err = strconv.ParseUint(sinceParamVal, 10, 64)
+		if err != nil {
+			return &HandlerError{http.StatusBadRequest, "invalid since"}
+		}
+		wait, err := strconv.Atoi(query.Get(waitParam))
+		if err != nil || wait < 0 {
+			wait = 0
+		} else if wait > maxWaitParamVal {
+			wait = maxWaitParamVal
+		}
+		history, err = poll(r, cm, roomName, lastID, time.Duration(wait)*time.Second)
+		if err != nil {
+			return handlerErrorFromChat(err)
+		}
+		// Return the oldest messages so that the next poll picks up
+		// where this one left off.
+		if len(history) > numLines {
+			history = history[:numLines]
+		}
+	} else {
+		history, err = cm.History(roomName, numLines)
+		if err != nil {
+			return handlerErrorFromChat(err)
+		}
+	}
+	for _, msg := range history {
+		// Notices have no ID (see chat.KindNotice)
+		if msg.ID > lastID {
+			lastID = msg.ID
+		}
+	}
+	w.Header().Set(lastIDHeader, strconv.FormatUint(lastID, 10))
+	if wantsJSON(r) {
+		if history == nil {
+			history = []*chat.Message{}
+		}
+		return writeJSON(w, http.StatusOK, history)
+	}
+	_, err = w.Write(chat.Format(chat.TextFormatter, history))
 	if err != nil {
 		return &HandlerError{http.StatusInternalServerError, err.Error()}
 	}
 	return hndlErr
 }
 
-// post posts a message (the HTTP body) to the chat
-func post(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, maxNameSize int) (hndlErr *HandlerError) {
+// post posts a message (the HTTP body) to a room.  If the HTTP request's "to"
+// parameter is set, the message is instead sent privately to that user.  A
+// JSON body is a {"name": ..., "body": ...} object (with an optional "to"),
+// and clients that ask for JSON get the sent message back.  See sender for
+// how the sender is authenticated; tokenName is the name of the request's
+// token, if any.
+func post(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, roomName string, tokenName string, maxNameSize int) (hndlErr *HandlerError) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return &HandlerError{http.StatusInternalServerError, err.Error()}
 	}
-	name := r.FormValue(nameParam)
-	if name == "" {
-		return &HandlerError{http.StatusBadRequest, "missing name"}
-	} else if len(name) > maxNameSize {
-		return &HandlerError{http.StatusBadRequest, "name too long"}
+	req := postRequest{r.FormValue(nameParam), r.FormValue(toParam), string(body)}
+	if isJSON(r) {
+		req = postRequest{}
+		if err = json.Unmarshal(body, &req); err != nil {
+			return &HandlerError{http.StatusBadRequest, "invalid JSON: " + err.Error()}
+		}
+	}
+	if req.Name, hndlErr = sender(w, r, cm, tokenName, req.Name, maxNameSize); hndlErr != nil {
+		return hndlErr
+	}
+	var msg *chat.Message
+	if req.To != "" {
+		msg, err = cm.Whisper(req.Name, req.To, []byte(req.Body))
+	} else {
+		msg, err = cm.Broadcast(roomName, req.Name, []byte(req.Body))
+	}
+	if err != nil {
+		return handlerErrorFromChat(err)
+	}
+	if wantsJSON(r) {
+		return writeJSON(w, http.StatusOK, msg)
 	}
-	cm.Broadcast(name, body)
 	return hndlErr
 }
 
-// Handle supports HTTP writing (via POST) and reading (via GET) to the chat.
+// put creates a room
+func put(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, roomName string) (hndlErr *HandlerError) {
+	err := cm.CreateRoom(roomName)
+	if err != nil {
+		return handlerErrorFromChat(err)
+	}
+	w.WriteHeader(http.StatusCreated)
+	return hndlErr
+}
+
+// Handle supports HTTP writing (via POST) and reading (via GET) to a room,
+// and room creation (via PUT).  The room is addressed by the request path
+// ("/chat/{room}"); "/chat" addresses the DefaultRoom.  A room's messages
+// can also be streamed as Server-Sent Events from "/chat/{room}/stream", and
+// searched at "/chat/{room}/search" ("/chat/search" searches every room).
+// "/chat/{room}/users" lists the users in a room and "/chat/users" lists
+// every connected user, or streams their presence changes (see getUsers);
+// connected users can go away and come back with a POST to "/chat/users"
+// (see postAway).
+// Requests may carry an API token ("Authorization: Bearer {token}"), which
+// needs the read permission for GET and the post permission otherwise.
+// Only GET requests are accepted from banned addresses.
 func Handle(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, maxBodySize int, maxNameSize int, maxHistoryLines int) (hndlErr *HandlerError) {
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBodySize))
+	perm := chat.PermPost
+	if r.Method == "GET" {
+		perm = chat.PermRead
+	}
+	tokenName, hndlErr := authorize(w, r, cm, perm)
+	if hndlErr != nil {
+		return hndlErr
+	}
+	if r.Method != "GET" {
+		if err := cm.CheckAddress(clientIP(r)); err != nil {
+			return handlerErrorFromChat(err)
+		}
+	}
+	roomName, resource := parsePath(r.URL.Path)
+	if resource == searchResource {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			return handlerErrorFromCode(http.StatusMethodNotAllowed)
+		}
+		return searchRooms(w, r, cm, roomName, maxHistoryLines)
+	}
+	if resource == usersResource {
+		if r.Method == "POST" && roomName == "" {
+			return postAway(w, r, cm, tokenName)
+		} else if r.Method != "GET" {
+			allow := "GET"
+			if roomName == "" {
+				allow = "GET, POST"
+			}
+			w.Header().Set("Allow", allow)
+			return handlerErrorFromCode(http.StatusMethodNotAllowed)
+		}
+		return getUsers(w, r, cm, roomName)
+	}
+	if roomName == "" {
+		roomName = chat.DefaultRoom
+	}
+	if resource == streamResource {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			return handlerErrorFromCode(http.StatusMethodNotAllowed)
+		}
+		return stream(w, r, cm, roomName)
+	} else if resource != "" {
+		return handlerErrorFromCode(http.StatusNotFound)
+	}
 	if r.Method == "GET" {
-		hndlErr = get(w, r, cm, maxHistoryLines)
+		hndlErr = get(w, r, cm, roomName, maxHistoryLines)
 	} else if r.Method == "POST" {
-		hndlErr = post(w, r, cm, maxNameSize)
+		hndlErr = post(w, r, cm, roomName, tokenName, maxNameSize)
+	} else if r.Method == "PUT" {
+		hndlErr = put(w, r, cm, roomName)
 	} else {
 		// HTTP/1.1 spec says we must indicate which methods we allow
-		w.Header().Set("Allow", "GET, POST")
+		w.Header().Set("Allow", "GET, POST, PUT")
 		hndlErr = handlerErrorFromCode(http.StatusMethodNotAllowed)
 	}
 	return hndlErr
 }
+
+// HandleRooms lists the names of all rooms, one per line (or as a JSON array
+// for clients that ask for JSON).
+func HandleRooms(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager) (hndlErr *HandlerError) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		return handlerErrorFromCode(http.StatusMethodNotAllowed)
+	}
+	if wantsJSON(r) {
+		return writeJSON(w, http.StatusOK, cm.Rooms())
+	}
+	for _, roomName := range cm.Rooms() {
+		_, err := w.Write([]byte(roomName + "\n"))
+		if err != nil {
+			return &HandlerError{http.StatusInternalServerError, err.Error()}
+		}
+	}
+	return hndlErr
+}
@@ -1,11 +1,18 @@
 package http
 
 import (
+	"bufio"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bgmerrell/gochatd/chat"
+	"github.com/bgmerrell/gochatd/dummyconn"
+	"github.com/bgmerrell/gochatd/internal/chattest"
 )
 
 const (
@@ -13,19 +20,22 @@ const (
 	testTime        = "02-Jan-06 15:04"
 )
 
+// testNow is rendered as testTime
+var testNow = time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+
 func TestGet(t *testing.T) {
-	chat.Timestamp = func() string { return testTime }
+	chat.Now = func() time.Time { return testNow }
 	cm := chat.NewChatManager(nil, historySize)
-	cm.Broadcast("user1", []byte("1"))
-	cm.Broadcast("user2", []byte("2"))
+	cm.Broadcast(chat.DefaultRoom, "user1", []byte("1"))
+	cm.Broadcast(chat.DefaultRoom, "user2", []byte("2"))
 	req, err := http.NewRequest("GET", "http://example.com/foo", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	w := httptest.NewRecorder()
-	hErr := get(w, req, cm, historySize)
+	hErr := get(w, req, cm, chat.DefaultRoom, historySize)
 	if hErr != nil {
-		t.Fatal("Unexpected error: ", err)
+		t.Fatal("Unexpected error: ", hErr.Msg)
 	}
 	if w.Code != http.StatusOK {
 		t.Errorf("Response code = %d, want: %d", w.Code, http.StatusOK)
@@ -36,4 +46,361 @@ func TestGet(t *testing.T) {
 	}
 }
 
-// TODO: Add more tests
+func TestGetSince(t *testing.T) {
+	chat.Now = func() time.Time { return testNow }
+	cm := chat.NewChatManager(nil, historySize)
+	first, _ := cm.Broadcast(chat.DefaultRoom, "user1", []byte("1"))
+	second, _ := cm.Broadcast(chat.DefaultRoom, "user2", []byte("2"))
+	third, _ := cm.Broadcast(chat.DefaultRoom, "user3", []byte("3"))
+	tests := []struct {
+		query    string
+		expected string
+		lastID   uint64
+	}{
+		{"", "<user1> 1<user2> 2<user3> 3", third.ID},
+		{"?since=" + strconv.FormatUint(first.ID, 10), "<user2> 2<user3> 3", third.ID},
+		{"?lines=1&since=" + strconv.FormatUint(first.ID, 10), "<user2> 2", second.ID},
+		{"?since=" + strconv.FormatUint(third.ID, 10), "", third.ID},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "http://example.com/chat"+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		if hErr := get(w, req, cm, chat.DefaultRoom, historySize); hErr != nil {
+			t.Fatal("Unexpected error: ", hErr.Msg)
+		}
+		body := strings.Replace(w.Body.String(), testTime+" ", "", -1)
+		body = strings.Replace(body, "\n", "", -1)
+		if body != test.expected {
+			t.Errorf("GET %s body = %q, want: %q", test.query, body, test.expected)
+		}
+		lastID := strconv.FormatUint(test.lastID, 10)
+		if h := w.Header().Get(lastIDHeader); h != lastID {
+			t.Errorf("GET %s %s = %s, want: %s", test.query, lastIDHeader, h, lastID)
+		}
+	}
+}
+
+func TestGetSinceGone(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	first, _ := cm.Broadcast(chat.DefaultRoom, "user1", []byte("first"))
+	for i := 0; i < historySize; i++ {
+		cm.Broadcast(chat.DefaultRoom, "user1", []byte("more"))
+	}
+	req := httptest.NewRequest("GET", "/chat?since="+strconv.FormatUint(first.ID-1, 10), nil)
+	hErr := get(httptest.NewRecorder(), req, cm, chat.DefaultRoom, historySize)
+	if hErr == nil || hErr.Code != http.StatusGone {
+		t.Errorf("hErr = %v, want: %d", hErr, http.StatusGone)
+	}
+}
+
+func TestGetSinceWait(t *testing.T) {
+	chat.Now = func() time.Time { return testNow }
+	cm := chat.NewChatManager(nil, historySize)
+	first, _ := cm.Broadcast(chat.DefaultRoom, "user1", []byte("1"))
+	url := "http://example.com/chat?wait=5&since=" + strconv.FormatUint(first.ID, 10)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	done := make(chan *HandlerError)
+	go func() {
+		done <- get(w, req, cm, chat.DefaultRoom, historySize)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	second, _ := cm.Broadcast(chat.DefaultRoom, "user2", []byte("2"))
+	select {
+	case hErr := <-done:
+		if hErr != nil {
+			t.Fatal("Unexpected error: ", hErr.Msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the poll to return")
+	}
+	expected := testTime + " <user2> 2\n"
+	if w.Body.String() != expected {
+		t.Errorf("Response body = %s, want: %s", w.Body.String(), expected)
+	}
+	lastID := strconv.FormatUint(second.ID, 10)
+	if h := w.Header().Get(lastIDHeader); h != lastID {
+		t.Errorf("%s = %s, want: %s", lastIDHeader, h, lastID)
+	}
+}
+
+func TestPostRegisteredName(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	cm.SetAccounts(chattest.MemAccounts{"alice": "secret1"}, false)
+	tests := []struct {
+		query    string
+		user     string
+		password string
+		code     int
+	}{
+		{"?name=alice", "", "", http.StatusUnauthorized},
+		{"", "alice", "wrong", http.StatusUnauthorized},
+		{"?name=bob", "alice", "secret1", http.StatusBadRequest},
+		{"", "alice", "secret1", http.StatusOK},
+		{"?name=alice", "alice", "secret1", http.StatusOK},
+		{"?name=bob", "", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", "http://example.com/chat"+test.query, strings.NewReader("hi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		w := httptest.NewRecorder()
+		code := http.StatusOK
+		if hErr := post(w, req, cm, chat.DefaultRoom, "", 16); hErr != nil {
+			code = hErr.Code
+		}
+		if code != test.code {
+			t.Errorf("POST %s as %q/%q = %d, want: %d", test.query, test.user, test.password, code, test.code)
+		}
+	}
+}
+
+func TestGetPage(t *testing.T) {
+	chat.Now = func() time.Time { return testNow }
+	cm := chat.NewChatManager(nil, historySize)
+	first, _ := cm.Broadcast(chat.DefaultRoom, "user1", []byte("1"))
+	second, _ := cm.Broadcast(chat.DefaultRoom, "user2", []byte("2"))
+	third, _ := cm.Broadcast(chat.DefaultRoom, "user3", []byte("3"))
+	id := func(msg *chat.Message) string { return strconv.FormatUint(msg.ID, 10) }
+	tests := []struct {
+		query    string
+		expected string
+		prev     string
+		next     string
+	}{
+		{"?lines=2&before=" + id(third), "<user1> 1<user2> 2", "", id(second)},
+		{"?lines=2&after=" + id(first), "<user2> 2<user3> 3", id(second), ""},
+		{"?lines=1&after=" + id(first), "<user2> 2", id(second), id(second)},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "http://example.com/chat"+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		if hErr := get(w, req, cm, chat.DefaultRoom, historySize); hErr != nil {
+			t.Fatal("Unexpected error: ", hErr.Msg)
+		}
+		body := strings.Replace(w.Body.String(), testTime+" ", "", -1)
+		body = strings.Replace(body, "\n", "", -1)
+		if body != test.expected {
+			t.Errorf("GET %s body = %q, want: %q", test.query, body, test.expected)
+		}
+		prev, next := w.Header().Get(prevCursorHeader), w.Header().Get(nextCursorHeader)
+		if prev != test.prev || next != test.next {
+			t.Errorf("GET %s cursors = (%q, %q), want: (%q, %q)",
+				test.query, prev, next, test.prev, test.next)
+		}
+	}
+
+	for _, query := range []string{"?before=x", "?before=1&after=1", "?since=1&after=1"} {
+		req, err := http.NewRequest("GET", "http://example.com/chat"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hErr := get(httptest.NewRecorder(), req, cm, chat.DefaultRoom, historySize)
+		if hErr == nil || hErr.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %v, want: %d error", query, hErr, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	tests := map[string][2]string{
+		"/chat":            {"", ""},
+		"/chat/":           {"", ""},
+		"/chat/dev":        {"dev", ""},
+		"/chat/dev/":       {"dev", ""},
+		"/chat/stream":     {"", "stream"},
+		"/chat/search":     {"", "search"},
+		"/chat/users":      {"", "users"},
+		"/chat/dev/stream": {"dev", "stream"},
+		"/chat/dev/bogus":  {"dev", "bogus"},
+	}
+	for path, expected := range tests {
+		roomName, resource := parsePath(path)
+		if roomName != expected[0] || resource != expected[1] {
+			t.Errorf("parsePath(%s) = (%s, %s), want: (%s, %s)",
+				path, roomName, resource, expected[0], expected[1])
+		}
+	}
+}
+
+func TestHandleRoom(t *testing.T) {
+	chat.Now = func() time.Time { return testNow }
+	cm := chat.NewChatManager(nil, historySize)
+
+	req := httptest.NewRequest("POST", "/chat/dev?name=user1", strings.NewReader("hi"))
+	w := httptest.NewRecorder()
+	hErr := Handle(w, req, cm, 512, 32, historySize)
+	if hErr == nil || hErr.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d error for missing room, got: %v", http.StatusNotFound, hErr)
+	}
+
+	req = httptest.NewRequest("PUT", "/chat/dev", nil)
+	w = httptest.NewRecorder()
+	hErr = Handle(w, req, cm, 512, 32, historySize)
+	if hErr != nil {
+		t.Fatal("Unexpected error: ", hErr.Msg)
+	}
+	if w.Code != http.StatusCreated {
+		t.Errorf("Response code = %d, want: %d", w.Code, http.StatusCreated)
+	}
+
+	req = httptest.NewRequest("POST", "/chat/dev?name=user1", strings.NewReader("hi"))
+	w = httptest.NewRecorder()
+	hErr = Handle(w, req, cm, 512, 32, historySize)
+	if hErr != nil {
+		t.Fatal("Unexpected error: ", hErr.Msg)
+	}
+
+	req = httptest.NewRequest("GET", "/chat/dev", nil)
+	w = httptest.NewRecorder()
+	hErr = Handle(w, req, cm, 512, 32, historySize)
+	if hErr != nil {
+		t.Fatal("Unexpected error: ", hErr.Msg)
+	}
+	expected := testTime + " <user1> hi\n"
+	if w.Body.String() != expected {
+		t.Errorf("Response body = %s, want: %s", w.Body.String(), expected)
+	}
+
+	req = httptest.NewRequest("GET", "/chat", nil)
+	w = httptest.NewRecorder()
+	hErr = Handle(w, req, cm, 512, 32, historySize)
+	if hErr != nil {
+		t.Fatal("Unexpected error: ", hErr.Msg)
+	}
+	if w.Body.String() != "" {
+		t.Errorf("Response body = %s, want it empty", w.Body.String())
+	}
+}
+
+func TestHandleRooms(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	cm.CreateRoom("dev")
+	req := httptest.NewRequest("GET", "/rooms", nil)
+	w := httptest.NewRecorder()
+	hErr := HandleRooms(w, req, cm)
+	if hErr != nil {
+		t.Fatal("Unexpected error: ", hErr.Msg)
+	}
+	expected := "dev\nlobby\n"
+	if w.Body.String() != expected {
+		t.Errorf("Response body = %s, want: %s", w.Body.String(), expected)
+	}
+}
+
+func TestPostWhisper(t *testing.T) {
+	chat.Now = func() time.Time { return testNow }
+	cm := chat.NewChatManager(nil, historySize)
+	dc := dummyconn.NewDummyConn()
+	err := cm.Join(chat.DefaultRoom, "user2", dc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	buf := make([]byte, 512)
+	_, err = dc.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/chat?name=user1&to=user2", strings.NewReader("psst"))
+	w := httptest.NewRecorder()
+	hErr := post(w, req, cm, chat.DefaultRoom, "", 32)
+	if hErr != nil {
+		t.Fatal("Unexpected error: ", hErr.Msg)
+	}
+	n, err := dc.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := testTime + " *user1 -> user2* psst\n"
+	if string(buf[:n]) != expected {
+		t.Errorf("Read: %s, want: %s", buf[:n], expected)
+	}
+	msgs, _ := cm.History(chat.DefaultRoom, historySize)
+	history := string(chat.Format(chat.TextFormatter, msgs))
+	if strings.Contains(history, "psst") {
+		t.Errorf("history = %s, want no private messages", history)
+	}
+
+	req = httptest.NewRequest("POST", "/chat?name=user1&to=nobody", strings.NewReader("psst"))
+	w = httptest.NewRecorder()
+	hErr = post(w, req, cm, chat.DefaultRoom, "", 32)
+	if hErr == nil || hErr.Code != http.StatusNotFound {
+		t.Errorf("Expected %d error for missing user, got: %v", http.StatusNotFound, hErr)
+	}
+}
+
+func TestStream(t *testing.T) {
+	chat.Now = func() time.Time { return testNow }
+	cm := chat.NewChatManager(nil, historySize)
+	first, _ := cm.Broadcast(chat.DefaultRoom, "user1", []byte("missed"))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hErr := Handle(w, r, cm, 1024, 16, historySize); hErr != nil {
+			http.Error(w, hErr.Msg, hErr.Code)
+		}
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/chat/stream?format=text", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(lastEventIDHeader, strconv.FormatUint(first.ID-1, 10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %s, want: text/event-stream", ct)
+	}
+	br := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		var event string
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				return event
+			}
+			event += line
+		}
+	}
+	expected := fmt.Sprintf("id: %d\ndata: %s <user1> missed\n", first.ID, testTime)
+	if event := readEvent(); event != expected {
+		t.Errorf("Backlog event = %q, want: %q", event, expected)
+	}
+	second, _ := cm.Broadcast(chat.DefaultRoom, "user2", []byte("live"))
+	expected = fmt.Sprintf("id: %d\ndata: %s <user2> live\n", second.ID, testTime)
+	if event := readEvent(); event != expected {
+		t.Errorf("Live event = %q, want: %q", event, expected)
+	}
+}
+
+func TestStreamUnknownRoom(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	req, err := http.NewRequest("GET", "http://example.com/chat/nope/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	hErr := Handle(w, req, cm, 1024, 16, historySize)
+	if hErr == nil || hErr.Code != http.StatusNotFound {
+		t.Errorf("Handle() = %v, want: %d error", hErr, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,71 @@
+package http
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const jsonContentType = "application/json"
+
+// postRequest is the body of a JSON POST request.
+type postRequest struct {
+	Name string `json:"name"`
+	To   string `json:"to,omitempty"`
+	Body string `json:"body"`
+}
+
+// errorResponse is the body of a JSON error response.
+type errorResponse struct {
+	Code  int    `json:"code"`
+	Error string `json:"error"`
+}
+
+// isJSON returns true if the request's body is JSON.
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == jsonContentType
+}
+
+// wantsJSON returns true if the client asked for a JSON response, either
+// explicitly (via the Accept header) or by sending JSON itself.
+func wantsJSON(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && mediaType == jsonContentType {
+			return true
+		}
+	}
+	return isJSON(r)
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) *HandlerError {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return &HandlerError{http.StatusInternalServerError, err.Error()}
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(code)
+	_, err = w.Write(append(b, '\n'))
+	if err != nil {
+		return &HandlerError{http.StatusInternalServerError, err.Error()}
+	}
+	return nil
+}
+
+// WriteError replies to the request with a HandlerError.  Clients that asked
+// for JSON get a JSON object with "code" and "error" fields, everyone else a
+// plain text message.
+func WriteError(w http.ResponseWriter, r *http.Request, hndlErr *HandlerError) {
+	if !wantsJSON(r) {
+		http.Error(w, hndlErr.Msg, hndlErr.Code)
+		return
+	}
+	b, _ := json.Marshal(errorResponse{hndlErr.Code, hndlErr.Msg})
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(hndlErr.Code)
+	w.Write(append(b, '\n'))
+}
@@ -0,0 +1,128 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+func TestWantsJSON(t *testing.T) {
+	tests := []struct {
+		accept      string
+		contentType string
+		expected    bool
+	}{
+		{"", "", false},
+		{"text/plain", "", false},
+		{"application/json", "", true},
+		{"text/html, application/json;q=0.9", "", true},
+		{"", "application/json; charset=utf-8", true},
+		{"", "text/plain", false},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "http://example.com/chat", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", test.accept)
+		req.Header.Set("Content-Type", test.contentType)
+		if wantsJSON(req) != test.expected {
+			t.Errorf("wantsJSON(Accept: %q, Content-Type: %q) = %t, want: %t",
+				test.accept, test.contentType, !test.expected, test.expected)
+		}
+	}
+}
+
+func TestGetJSON(t *testing.T) {
+	chat.Now = func() time.Time { return testNow }
+	cm := chat.NewChatManager(nil, historySize)
+	req, err := http.NewRequest("GET", "http://example.com/chat", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", jsonContentType)
+	w := httptest.NewRecorder()
+	if hErr := get(w, req, cm, chat.DefaultRoom, historySize); hErr != nil {
+		t.Fatal("Unexpected error: ", hErr.Msg)
+	}
+	if w.Body.String() != "[]\n" {
+		t.Errorf("Empty room body = %q, want: %q", w.Body.String(), "[]\n")
+	}
+
+	sent, _ := cm.Broadcast(chat.DefaultRoom, "user1", []byte("hi"))
+	w = httptest.NewRecorder()
+	if hErr := get(w, req, cm, chat.DefaultRoom, historySize); hErr != nil {
+		t.Fatal("Unexpected error: ", hErr.Msg)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != jsonContentType {
+		t.Errorf("Content-Type = %s, want: %s", ct, jsonContentType)
+	}
+	var msgs []*chat.Message
+	if err := json.Unmarshal(w.Body.Bytes(), &msgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || *msgs[0] != *sent {
+		t.Errorf("Messages = %+v, want: [%+v]", msgs, sent)
+	}
+}
+
+func TestPostJSON(t *testing.T) {
+	chat.Now = func() time.Time { return testNow }
+	cm := chat.NewChatManager(nil, historySize)
+	body := strings.NewReader(`{"name": "user1", "body": "hi"}`)
+	req, err := http.NewRequest("POST", "http://example.com/chat", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", jsonContentType)
+	w := httptest.NewRecorder()
+	if hErr := post(w, req, cm, chat.DefaultRoom, "", 16); hErr != nil {
+		t.Fatal("Unexpected error: ", hErr.Msg)
+	}
+	var msg chat.Message
+	if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil {
+		t.Fatal(err)
+	}
+	history, _ := cm.History(chat.DefaultRoom, historySize)
+	if len(history) != 1 || *history[0] != msg {
+		t.Errorf("Response = %+v, want the stored message: %+v", msg, history)
+	}
+	if msg.ID == 0 || msg.Sender != "user1" || msg.Body != "hi" {
+		t.Errorf("Unexpected response message: %+v", msg)
+	}
+
+	req, err = http.NewRequest("POST", "http://example.com/chat", strings.NewReader("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", jsonContentType)
+	hErr := post(httptest.NewRecorder(), req, cm, chat.DefaultRoom, "", 16)
+	if hErr == nil || hErr.Code != http.StatusBadRequest {
+		t.Errorf("post(invalid JSON) = %v, want: %d error", hErr, http.StatusBadRequest)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/chat", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	WriteError(w, req, &HandlerError{http.StatusNotFound, "Room not found"})
+	if w.Code != http.StatusNotFound || w.Body.String() != "Room not found\n" {
+		t.Errorf("Text error = %d %q", w.Code, w.Body.String())
+	}
+
+	req.Header.Set("Accept", jsonContentType)
+	w = httptest.NewRecorder()
+	WriteError(w, req, &HandlerError{http.StatusNotFound, "Room not found"})
+	expected := `{"code":404,"error":"Room not found"}` + "\n"
+	if w.Code != http.StatusNotFound || w.Body.String() != expected {
+		t.Errorf("JSON error = %d %q, want: 404 %q", w.Code, w.Body.String(), expected)
+	}
+}
@@ -0,0 +1,36 @@
+package http
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bgmerrell/gochatd/ratelimit"
+)
+
+// clientIP returns the IP address that a request came from.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Limit counts a request against its client IP's rate limit.  Requests over
+// the limit get a 429 error, with a Retry-After header giving the number of
+// seconds until the client may try again.  A nil limiter allows everything.
+func Limit(w http.ResponseWriter, r *http.Request, limiter *ratelimit.Limiter) *HandlerError {
+	ok, retryAfter := limiter.Allow(clientIP(r), time.Now())
+	if ok {
+		return nil
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return handlerErrorFromCode(http.StatusTooManyRequests)
+}
@@ -0,0 +1,36 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bgmerrell/gochatd/ratelimit"
+)
+
+func TestLimit(t *testing.T) {
+	// Slow enough that no tokens are gained during the test
+	limiter := ratelimit.NewLimiter(0.1, 2)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/chat", nil)
+		if hErr := Limit(httptest.NewRecorder(), req, limiter); hErr != nil {
+			t.Fatalf("Request %d of the burst: unexpected error: %s", i, hErr.Msg)
+		}
+	}
+	req := httptest.NewRequest("POST", "/chat", nil)
+	w := httptest.NewRecorder()
+	hErr := Limit(w, req, limiter)
+	if hErr == nil || hErr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected a %d error, got: %v", http.StatusTooManyRequests, hErr)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "10" {
+		t.Errorf("Retry-After = %q, want: \"10\"", retryAfter)
+	}
+
+	// Other clients have limits of their own
+	req = httptest.NewRequest("POST", "/chat", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	if hErr = Limit(httptest.NewRecorder(), req, limiter); hErr != nil {
+		t.Errorf("Unexpected error for another client: %s", hErr.Msg)
+	}
+}
@@ -0,0 +1,39 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+const (
+	searchResource = "search"
+	queryParam     = "q"
+	limitParam     = "limit"
+)
+
+// searchRooms searches room messages for the query in the "q" parameter (see
+// search.ParseQuery for the syntax).  If roomName is empty every room is
+// searched.  Up to "limit" (at most maxResults) matches are returned, newest
+// first, as lines prefixed with the message ID, or as an array of message
+// objects for clients that ask for JSON.
+func searchRooms(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, roomName string, maxResults int) (hndlErr *HandlerError) {
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get(limitParam))
+	if err != nil || limit < 1 || limit > maxResults {
+		limit = maxResults
+	}
+	results, err := cm.Search(query.Get(queryParam), roomName, limit)
+	if err != nil {
+		return handlerErrorFromChat(err)
+	}
+	if wantsJSON(r) {
+		return writeJSON(w, http.StatusOK, results)
+	}
+	_, err = w.Write(chat.Format(chat.ResultFormatter, results))
+	if err != nil {
+		return &HandlerError{http.StatusInternalServerError, err.Error()}
+	}
+	return hndlErr
+}
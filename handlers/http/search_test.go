@@ -0,0 +1,67 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+	"github.com/bgmerrell/gochatd/search"
+)
+
+func TestSearch(t *testing.T) {
+	chat.Now = func() time.Time { return testNow }
+	cm := chat.NewChatManager(nil, historySize)
+	cm.CreateRoom("dev")
+	if err := cm.SetIndex(search.New(100)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	failed, _ := cm.Broadcast(chat.DefaultRoom, "user1", []byte("the build failed"))
+	fixed, _ := cm.Broadcast("dev", "user2", []byte("build fixed"))
+	tests := []struct {
+		path     string
+		code     int
+		expected string
+	}{
+		{"/chat/search?q=build&limit=1", http.StatusOK,
+			fmt.Sprintf("#%d [dev] %s <user2> build fixed\n", fixed.ID, testTime)},
+		{"/chat/search?q=build+from:user1", http.StatusOK,
+			fmt.Sprintf("#%d [lobby] %s <user1> the build failed\n", failed.ID, testTime)},
+		{"/chat/lobby/search?q=fixed", http.StatusOK, ""},
+		{"/chat/search?q=%22build", http.StatusBadRequest, ""},
+		{"/chat/nope/search?q=build", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "http://example.com"+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		hErr := Handle(w, req, cm, 1024, 16, historySize)
+		if hErr != nil {
+			if hErr.Code != test.code {
+				t.Errorf("GET %s error = %d %s, want: %d", test.path, hErr.Code, hErr.Msg, test.code)
+			}
+			continue
+		}
+		if test.code != http.StatusOK {
+			t.Errorf("GET %s succeeded, want: %d", test.path, test.code)
+		} else if w.Body.String() != test.expected {
+			t.Errorf("GET %s body = %q, want: %q", test.path, w.Body.String(), test.expected)
+		}
+	}
+}
+
+func TestSearchDisabled(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	req, err := http.NewRequest("GET", "http://example.com/chat/search?q=build", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hErr := Handle(httptest.NewRecorder(), req, cm, 1024, 16, historySize)
+	if hErr == nil || hErr.Code != http.StatusNotImplemented {
+		t.Errorf("Handle() = %v, want: %d error", hErr, http.StatusNotImplemented)
+	}
+}
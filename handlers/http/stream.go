@@ -0,0 +1,106 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+const (
+	streamResource    = "stream"
+	lastEventIDHeader = "Last-Event-ID"
+	formatParam       = "format"
+)
+
+// heartbeatInterval is how often an idle stream sends a comment to keep
+// intermediaries from timing the connection out.
+var heartbeatInterval = 15 * time.Second
+
+// writeEvent writes a message as a Server-Sent Event.  The event's ID is the
+// message ID (if it has one), so a reconnecting EventSource resumes where it
+// left off.
+func writeEvent(w http.ResponseWriter, f chat.Formatter, msg *chat.Message) error {
+	var buf bytes.Buffer
+	// Notices have no ID (see chat.KindNotice), and must not reset the
+	// EventSource's last event ID
+	if msg.ID != 0 {
+		fmt.Fprintf(&buf, "id: %d\n", msg.ID)
+	}
+	data := bytes.TrimRight(f.Format(msg), "\n")
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// stream streams a room's messages to the client as Server-Sent Events
+// until the client goes away.  The messages are rendered with the formatter
+// named by the "format" request parameter (JSON by default).  A client that
+// sends a Last-Event-ID header first receives the messages it missed (or
+// a 410 error, if they can no longer be read).
+func stream(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, roomName string) *HandlerError {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return &HandlerError{http.StatusInternalServerError, "Streaming unsupported"}
+	}
+	format := r.FormValue(formatParam)
+	if format == "" {
+		format = "json"
+	}
+	formatter, ok := chat.FormatterByName(format)
+	if !ok {
+		return &HandlerError{http.StatusBadRequest, "Unknown format: " + format}
+	}
+	var sinceID uint64 = math.MaxUint64
+	if lastEventID := r.Header.Get(lastEventIDHeader); lastEventID != "" {
+		var err error
+		sinceID, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			return &HandlerError{http.StatusBadRequest, "Invalid " + lastEventIDHeader}
+		}
+	}
+	sub, backlog, err := cm.Subscribe(roomName, sinceID)
+	if err != nil {
+		return handlerErrorFromChat(err)
+	}
+	defer cm.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, msg := range backlog {
+		if err := writeEvent(w, formatter, msg); err != nil {
+			return nil
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case msg, ok := <-sub.C:
+			if !ok {
+				log.Printf("Ending %s stream for %s", roomName, r.RemoteAddr)
+				return nil
+			}
+			err = writeEvent(w, formatter, msg)
+		case <-heartbeat.C:
+			_, err = w.Write([]byte(": heartbeat\n\n"))
+		}
+		if err != nil {
+			return nil
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,195 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+const (
+	usersResource   = "users"
+	eventStreamType = "text/event-stream"
+	usersEvent      = "users"
+	presenceEvent   = "presence"
+)
+
+// awayRequest is the body of a JSON away request.  Form values with the
+// same names can be used instead of JSON.
+type awayRequest struct {
+	Name   string `json:"name"`
+	Away   *bool  `json:"away"`
+	Reason string `json:"reason"`
+}
+
+// userResponse is a user in a JSON users response: the user's presence and
+// how long the user has been idle.
+type userResponse struct {
+	*chat.Presence
+	IdleSeconds int64 `json:"idle_seconds"`
+}
+
+// userResponses returns the JSON representation of users at now.
+func userResponses(users []*chat.Presence, now time.Time) []userResponse {
+	resp := make([]userResponse, 0, len(users))
+	for _, p := range users {
+		resp = append(resp, userResponse{p, int64(p.Idle(now) / time.Second)})
+	}
+	return resp
+}
+
+// wantsEventStream returns true if the client asked for Server-Sent Events
+// (as an EventSource does).
+func wantsEventStream(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && mediaType == eventStreamType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNamedEvent writes v as a JSON Server-Sent Event named name.
+func writeNamedEvent(w http.ResponseWriter, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "event: %s\ndata: %s\n\n", name, data)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// streamUsers streams presence changes to the client as Server-Sent Events
+// until the client goes away.  The first event, "users", holds every
+// connected user (as a JSON array); each following "presence" event is a
+// chat.PresenceEvent.
+func streamUsers(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager) *HandlerError {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return &HandlerError{http.StatusInternalServerError, "Streaming unsupported"}
+	}
+	sub, users, err := cm.SubscribePresence()
+	if err != nil {
+		return handlerErrorFromChat(err)
+	}
+	defer cm.UnsubscribePresence(sub)
+
+	w.Header().Set("Content-Type", eventStreamType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err = writeNamedEvent(w, usersEvent, userResponses(users, chat.Now())); err != nil {
+		return nil
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case event, ok := <-sub.C:
+			if !ok {
+				log.Printf("Ending presence stream for %s", r.RemoteAddr)
+				return nil
+			}
+			err = writeNamedEvent(w, presenceEvent, event)
+		case <-heartbeat.C:
+			_, err = w.Write([]byte(": heartbeat\n\n"))
+		}
+		if err != nil {
+			return nil
+		}
+		flusher.Flush()
+	}
+}
+
+// getUsers lists the users in a room, or every connected user if roomName
+// is empty, one per line (or as a JSON array for clients that ask for JSON).
+// Clients that ask for Server-Sent Events get every user's presence and
+// then its changes instead (see streamUsers); this is only supported for
+// every connected user.
+func getUsers(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, roomName string) *HandlerError {
+	if roomName == "" && wantsEventStream(r) {
+		return streamUsers(w, r, cm)
+	}
+	users := cm.Presence()
+	if roomName != "" {
+		var err error
+		if users, err = cm.RoomPresence(roomName); err != nil {
+			return handlerErrorFromChat(err)
+		}
+	}
+	now := chat.Now()
+	if wantsJSON(r) {
+		return writeJSON(w, http.StatusOK, userResponses(users, now))
+	}
+	for _, p := range users {
+		if _, err := w.Write([]byte(p.Format(now) + "\n")); err != nil {
+			return &HandlerError{http.StatusInternalServerError, err.Error()}
+		}
+	}
+	return nil
+}
+
+// postAway marks the sender as away (if the "away" parameter is true, with
+// an optional "reason") or as back (if it is false).  The sender must be
+// connected (e.g., over a WebSocket) and authenticated as the user (see
+// identity).  Clients that ask for JSON get the sender's presence back.
+func postAway(w http.ResponseWriter, r *http.Request, cm *chat.ChatManager, tokenName string) *HandlerError {
+	req := &awayRequest{}
+	if isJSON(r) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return &HandlerError{http.StatusInternalServerError, err.Error()}
+		}
+		if err = json.Unmarshal(body, req); err != nil {
+			return &HandlerError{http.StatusBadRequest, "invalid JSON: " + err.Error()}
+		}
+	} else {
+		req.Name, req.Reason = r.FormValue(nameParam), r.FormValue("reason")
+		if value := r.FormValue("away"); value != "" {
+			away, err := strconv.ParseBool(value)
+			if err != nil {
+				return &HandlerError{http.StatusBadRequest, "invalid away"}
+			}
+			req.Away = &away
+		}
+	}
+	if req.Away == nil {
+		return &HandlerError{http.StatusBadRequest, "missing away"}
+	}
+	name, hndlErr := identity(w, r, cm, tokenName, req.Name)
+	if hndlErr != nil {
+		return hndlErr
+	}
+	var err error
+	if *req.Away {
+		err = cm.SetAway(name, req.Reason)
+	} else {
+		err = cm.Back(name)
+	}
+	if err != nil {
+		return handlerErrorFromChat(err)
+	}
+	if !wantsJSON(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	p, err := cm.UserPresence(name)
+	if err != nil {
+		return handlerErrorFromChat(err)
+	}
+	return writeJSON(w, http.StatusOK, userResponses([]*chat.Presence{p}, chat.Now())[0])
+}
@@ -0,0 +1,218 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+	"github.com/bgmerrell/gochatd/dummyconn"
+	"github.com/bgmerrell/gochatd/internal/chattest"
+)
+
+func TestGetUsers(t *testing.T) {
+	chat.Now = func() time.Time { return testNow }
+	cm := chat.NewChatManager(nil, historySize)
+	aliceConn := dummyconn.NewDummyConn()
+	for _, join := range [][2]string{{chat.DefaultRoom, "alice"}, {"dev", "alice"}} {
+		if err := cm.Join(join[0], join[1], aliceConn); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if err := cm.Join(chat.DefaultRoom, "bob", dummyconn.NewDummyConn()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	chat.Now = func() time.Time { return testNow.Add(90 * time.Second) }
+	defer func() { chat.Now = func() time.Time { return testNow } }()
+
+	tests := map[string]string{
+		"/chat/users": "alice (raw from remote) in dev, lobby; connected " + testTime + ", idle 1m30s\n" +
+			"bob (raw from remote) in lobby; connected " + testTime + ", idle 1m30s\n",
+		"/chat/dev/users": "alice (raw from remote) in dev, lobby; connected " + testTime + ", idle 1m30s\n",
+	}
+	for path, expected := range tests {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		if hErr := Handle(w, req, cm, 1024, 16, historySize); hErr != nil {
+			t.Fatalf("GET %s: unexpected error: %s", path, hErr.Msg)
+		}
+		if w.Body.String() != expected {
+			t.Errorf("GET %s = %q, want: %q", path, w.Body.String(), expected)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/chat/users", nil)
+	req.Header.Set("Accept", jsonContentType)
+	w := httptest.NewRecorder()
+	if hErr := Handle(w, req, cm, 1024, 16, historySize); hErr != nil {
+		t.Fatalf("Unexpected error: %s", hErr.Msg)
+	}
+	var users []struct {
+		Name        string   `json:"name"`
+		Transport   string   `json:"transport"`
+		Rooms       []string `json:"rooms"`
+		IdleSeconds int64    `json:"idle_seconds"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(users) != 2 || users[0].Name != "alice" || users[0].Transport != chat.DefaultTransport ||
+		len(users[0].Rooms) != 2 || users[0].IdleSeconds != 90 {
+		t.Errorf("GET /chat/users (JSON) = %+v", users)
+	}
+
+	for _, test := range []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"PUT", "/chat/users", http.StatusMethodNotAllowed},
+		{"POST", "/chat/dev/users", http.StatusMethodNotAllowed},
+		{"GET", "/chat/nope/users", http.StatusNotFound},
+	} {
+		req = httptest.NewRequest(test.method, test.path, strings.NewReader("hi"))
+		hErr := Handle(httptest.NewRecorder(), req, cm, 1024, 16, historySize)
+		if hErr == nil || hErr.Code != test.code {
+			t.Errorf("%s %s = %v, want: %d error", test.method, test.path, hErr, test.code)
+		}
+	}
+}
+
+func TestStreamUsers(t *testing.T) {
+	chat.Now = func() time.Time { return testNow }
+	cm := chat.NewChatManager(nil, historySize)
+	if err := cm.Join(chat.DefaultRoom, "alice", dummyconn.NewDummyConn()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hErr := Handle(w, r, cm, 1024, 16, historySize); hErr != nil {
+			http.Error(w, hErr.Msg, hErr.Code)
+		}
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/chat/users", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %s, want: text/event-stream", ct)
+	}
+	br := bufio.NewReader(resp.Body)
+	readEvent := func() (string, string) {
+		var name, data string
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				return name, data
+			}
+			if strings.HasPrefix(line, "event: ") {
+				name = strings.TrimSpace(strings.TrimPrefix(line, "event: "))
+			} else if strings.HasPrefix(line, "data: ") {
+				data = strings.TrimSpace(strings.TrimPrefix(line, "data: "))
+			}
+		}
+	}
+
+	name, data := readEvent()
+	var users []userResponse
+	if err = json.Unmarshal([]byte(data), &users); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if name != usersEvent || len(users) != 1 || users[0].Name != "alice" {
+		t.Errorf("First event = %s %s, want the users event with alice", name, data)
+	}
+	if err = cm.Join(chat.DefaultRoom, "bob", dummyconn.NewDummyConn()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	name, data = readEvent()
+	event := &chat.PresenceEvent{}
+	if err = json.Unmarshal([]byte(data), event); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if name != presenceEvent || event.Change != chat.PresenceConnect || event.Presence.Name != "bob" {
+		t.Errorf("Second event = %s %s, want bob's connection", name, data)
+	}
+}
+
+func TestPostAway(t *testing.T) {
+	chat.Now = func() time.Time { return testNow }
+	cm := chat.NewChatManager(nil, historySize)
+	cm.SetAccounts(chattest.MemAccounts{"alice": "secret1", "bob": "secret2"}, false)
+	for _, name := range []string{"alice", "carol"} {
+		if err := cm.Join(chat.DefaultRoom, name, dummyconn.NewDummyConn()); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	for _, test := range []struct {
+		body     string
+		user     string
+		password string
+		code     int
+	}{
+		{"name=alice&reason=lunch", "alice", "secret1", http.StatusBadRequest},
+		{"name=alice&away=maybe", "alice", "secret1", http.StatusBadRequest},
+		// The user must be authenticated as the target
+		{"name=alice&away=true", "", "", http.StatusUnauthorized},
+		{"name=alice&away=true", "alice", "wrong", http.StatusUnauthorized},
+		{"name=alice&away=true", "bob", "secret2", http.StatusBadRequest},
+		// Unregistered names can't be authenticated
+		{"name=carol&away=true", "carol", "", http.StatusUnauthorized},
+		{"away=true", "bob", "secret2", http.StatusNotFound},
+		{"name=alice&away=false", "alice", "secret1", http.StatusConflict},
+		{"name=alice&away=true&reason=lunch", "alice", "secret1", http.StatusNoContent},
+	} {
+		req := httptest.NewRequest("POST", "/chat/users", strings.NewReader(test.body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		w := httptest.NewRecorder()
+		hErr := Handle(w, req, cm, 1024, 16, historySize)
+		if hErr != nil {
+			w.Code = hErr.Code
+		}
+		if w.Code != test.code {
+			t.Errorf("POST /chat/users %s as %q = %d, want: %d", test.body, test.user, w.Code, test.code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/chat/users", nil)
+	w := httptest.NewRecorder()
+	if hErr := Handle(w, req, cm, 1024, 16, historySize); hErr != nil {
+		t.Fatalf("Unexpected error: %s", hErr.Msg)
+	}
+	expected := "alice (raw from remote) in lobby; connected " + testTime + ", idle 0s, away since " + testTime + ": lunch\n" +
+		"carol (raw from remote) in lobby; connected " + testTime + ", idle 0s\n"
+	if w.Body.String() != expected {
+		t.Errorf("GET /chat/users = %q, want: %q", w.Body.String(), expected)
+	}
+
+	req = httptest.NewRequest("POST", "/chat/users", strings.NewReader(`{"name": "alice", "away": false}`))
+	req.Header.Set("Content-Type", jsonContentType)
+	req.SetBasicAuth("alice", "secret1")
+	w = httptest.NewRecorder()
+	if hErr := Handle(w, req, cm, 1024, 16, historySize); hErr != nil {
+		t.Fatalf("Unexpected error: %s", hErr.Msg)
+	}
+	user := &userResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), user); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if user.Name != "alice" || user.Away != nil {
+		t.Errorf("POST /chat/users (JSON) = %s, want alice, back", w.Body.String())
+	}
+}
@@ -0,0 +1,330 @@
+package raw
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+// defaultHistoryLines is the number of lines shown by "/history" when no
+// number is given.
+const defaultHistoryLines = 20
+
+// maxSearchResults is the number of matches shown by "/search".
+const maxSearchResults = 20
+
+// quitErr is returned by a command to indicate that the client should be
+// disconnected.
+var quitErr = errors.New("Quit")
+
+// usageErr is returned by a command to indicate that it was called with bad
+// arguments; the command's usage is sent to the client.
+var usageErr = errors.New("Bad usage")
+
+// command is a slash command that can be run by raw clients.  run is called
+// with the text following the command name.
+type command struct {
+	usage string
+	help  string
+	run   func(s *session, args string) error
+}
+
+// commands maps command names (without the leading '/') to commands.  New
+// commands should be added with registerCommand.
+var commands = map[string]*command{}
+
+// registerCommand adds a command to the command table.  Registering a name
+// twice is a programming error.
+func registerCommand(name string, usage string, help string, run func(s *session, args string) error) {
+	if _, ok := commands[name]; ok {
+		panic("raw: command registered twice: " + name)
+	}
+	commands[name] = &command{usage, help, run}
+}
+
+func init() {
+	registerCommand("help", "/help", "List the available commands", cmdHelp)
+	registerCommand("who", "/who [room]", "List the users in the chat (or in a room)", cmdWho)
+	registerCommand("away", "/away [reason]", "Mark yourself as away (messages to you get the reason as a reply)", cmdAway)
+	registerCommand("back", "/back", "Mark yourself as no longer away", cmdBack)
+	registerCommand("me", "/me <action>", "Send an action to the current room", cmdMe)
+	registerCommand("nick", "/nick <name>", "Change your name", cmdNick)
+	registerCommand("register", "/register <password>", "Register your name", cmdRegister)
+	registerCommand("passwd", "/passwd <old> <new>", "Change your password", cmdPasswd)
+	registerCommand("token", "/token [read|post|moderate|revoke]", "Get an HTTP API token (or revoke yours)", cmdToken)
+	registerCommand("msg", "/msg <name> <message>", "Send a private message", cmdMsg)
+	registerCommand("history", "/history [lines] [before|after <id>]", "Show the current room's history", cmdHistory)
+	registerCommand("search", "/search <query>", "Search messages (words, \"phrases\", from:, since:, until:)", cmdSearch)
+	registerCommand("join", "/join <room>", "Join a room (or switch to it)", cmdJoin)
+	registerCommand("leave", "/leave [room]", "Leave a room (default: the current room)", cmdLeave)
+	registerCommand("rooms", "/rooms", "List the rooms", cmdRooms)
+	registerCommand("quit", "/quit", "Disconnect", cmdQuit)
+}
+
+// isCommand returns a bool indicating whether msg should be run as a
+// command.  Messages starting with "//" are not commands.
+func isCommand(msg []byte) bool {
+	return bytes.HasPrefix(msg, []byte("/")) && !bytes.HasPrefix(msg, []byte("//"))
+}
+
+// splitCommand splits a command line into the command name (without the
+// leading '/') and its arguments.
+func splitCommand(line string) (name string, args string) {
+	line = strings.TrimSpace(strings.TrimPrefix(line, "/"))
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], strings.TrimSpace(line[i+1:])
+}
+
+// runCommand runs the command in line and sends any error to the client.
+// quitErr is returned if the client asked to disconnect.
+func (s *session) runCommand(line []byte) error {
+	name, args := splitCommand(string(line))
+	cmd, ok := commands[name]
+	if !ok {
+		s.reply("Error: unknown command /%s (try /help)", name)
+		return nil
+	}
+	err := cmd.run(s, args)
+	switch err {
+	case nil, quitErr:
+	case usageErr:
+		s.reply("Usage: %s", cmd.usage)
+	default:
+		s.reply("Error: %s", err)
+	}
+	return err
+}
+
+func cmdHelp(s *session, args string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	width := 0
+	for _, name := range names {
+		if len(commands[name].usage) > width {
+			width = len(commands[name].usage)
+		}
+	}
+	help := []byte{}
+	for _, name := range names {
+		help = append(help, fmt.Sprintf(
+			"%-*s %s\n", width, commands[name].usage, commands[name].help)...)
+	}
+	s.write(help)
+	return nil
+}
+
+func cmdWho(s *session, args string) error {
+	if strings.ContainsAny(args, " \t") {
+		return usageErr
+	}
+	users := s.cm.Presence()
+	if args != "" {
+		var err error
+		if users, err = s.cm.RoomPresence(args); err != nil {
+			return err
+		}
+	}
+	now := chat.Now()
+	for _, p := range users {
+		s.reply("%s", p.Format(now))
+	}
+	return nil
+}
+
+func cmdAway(s *session, args string) error {
+	if err := s.cm.SetAway(s.name, args); err != nil {
+		return err
+	}
+	s.reply("You are marked as away")
+	return nil
+}
+
+func cmdBack(s *session, args string) error {
+	if args != "" {
+		return usageErr
+	}
+	if err := s.cm.Back(s.name); err != nil {
+		return err
+	}
+	s.reply("You are no longer marked as away")
+	return nil
+}
+
+func cmdMe(s *session, args string) error {
+	if args == "" {
+		return usageErr
+	}
+	_, err := s.cm.Action(s.room, s.name, []byte(args))
+	return err
+}
+
+func cmdNick(s *session, args string) error {
+	if args == "" || strings.ContainsAny(args, " \t") {
+		return usageErr
+	}
+	if !s.h.validateName(args) {
+		return errors.New("Invalid name")
+	}
+	err := s.cm.Rename(s.name, args)
+	if err != nil {
+		return err
+	}
+	s.name = args
+	return nil
+}
+
+func cmdRegister(s *session, args string) error {
+	if args == "" {
+		return usageErr
+	}
+	if err := s.cm.Register(s.name, args); err != nil {
+		return err
+	}
+	s.reply("Registered \"%s\"", s.name)
+	return nil
+}
+
+func cmdPasswd(s *session, args string) error {
+	oldPassword, newPassword := splitCommand(args)
+	if oldPassword == "" || newPassword == "" {
+		return usageErr
+	}
+	if err := s.cm.SetPassword(s.name, oldPassword, newPassword); err != nil {
+		return err
+	}
+	s.reply("Password changed")
+	return nil
+}
+
+func cmdToken(s *session, args string) error {
+	var perms []chat.Permission
+	switch strings.TrimSpace(args) {
+	case "", "post":
+		perms = []chat.Permission{chat.PermRead, chat.PermPost}
+	case "read":
+		perms = []chat.Permission{chat.PermRead}
+	case "moderate":
+		perms = []chat.Permission{chat.PermRead, chat.PermPost, chat.PermModerate}
+	case "revoke":
+		n, err := s.cm.RevokeTokens(s.name)
+		if err != nil {
+			return err
+		}
+		s.reply("Revoked %d token(s)", n)
+		return nil
+	default:
+		return usageErr
+	}
+	token, err := s.cm.IssueToken(s.name, perms)
+	if err != nil {
+		return err
+	}
+	s.reply("Token: %s", token)
+	return nil
+}
+
+func cmdMsg(s *session, args string) error {
+	to, msg := splitCommand(args)
+	if to == "" || msg == "" {
+		return usageErr
+	}
+	_, err := s.cm.Whisper(s.name, to, []byte(msg))
+	return err
+}
+
+func cmdHistory(s *session, args string) error {
+	numLines := defaultHistoryLines
+	fields := strings.Fields(args)
+	if len(fields) == 1 || len(fields) == 3 {
+		n, err := strconv.Atoi(fields[0])
+		if err != nil || n < 1 {
+			return usageErr
+		}
+		numLines = n
+		fields = fields[1:]
+	}
+	if max := s.cm.MaxHistoryLines(); numLines > max {
+		numLines = max
+	}
+	var before, after uint64
+	if len(fields) == 2 {
+		id, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil || id == 0 {
+			return usageErr
+		}
+		switch fields[0] {
+		case "before":
+			before = id
+		case "after":
+			after = id
+		default:
+			return usageErr
+		}
+	} else if len(fields) != 0 {
+		return usageErr
+	}
+	page, err := s.cm.HistoryPage(s.room, before, after, numLines)
+	if err != nil {
+		return err
+	}
+	s.write(chat.Format(chat.TextFormatter, page.Messages))
+	if page.Prev != 0 {
+		s.reply("Older: /history %d before %d", numLines, page.Prev)
+	}
+	if page.Next != 0 {
+		s.reply("Newer: /history %d after %d", numLines, page.Next)
+	}
+	return nil
+}
+
+func cmdSearch(s *session, args string) error {
+	if args == "" {
+		return usageErr
+	}
+	results, err := s.cm.Search(args, "", maxSearchResults)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		s.reply("No matches")
+		return nil
+	}
+	s.write(chat.Format(chat.ResultFormatter, results))
+	return nil
+}
+
+func cmdJoin(s *session, args string) error {
+	if args == "" || strings.ContainsAny(args, " \t") {
+		return usageErr
+	}
+	return s.join(args)
+}
+
+func cmdLeave(s *session, args string) error {
+	roomName := s.room
+	if args != "" {
+		roomName = args
+	}
+	return s.leave(roomName)
+}
+
+func cmdRooms(s *session, args string) error {
+	s.reply("Rooms: %s", strings.Join(s.cm.Rooms(), ", "))
+	return nil
+}
+
+func cmdQuit(s *session, args string) error {
+	s.reply("Bye!")
+	return quitErr
+}
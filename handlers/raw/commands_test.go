@@ -0,0 +1,308 @@
+package raw
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+	"github.com/bgmerrell/gochatd/dummyconn"
+	"github.com/bgmerrell/gochatd/internal/chattest"
+	"github.com/bgmerrell/gochatd/search"
+)
+
+const testTime = "02-Jan-06 15:04"
+
+// testNow is rendered as testTime
+var testNow = time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+
+func init() {
+	chat.Now = func() time.Time { return testNow }
+}
+
+// newTestSession returns a session for name, which has joined the
+// DefaultRoom of cm over a new dummyconn.
+func newTestSession(t *testing.T, cm *chat.ChatManager, name string) *session {
+	dc := dummyconn.NewDummyConn()
+	err := cm.Join(chat.DefaultRoom, name, dc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return newSession(NewRawHandler(bufSize, maxNameSize), cm, name, dc)
+}
+
+func TestSplitCommand(t *testing.T) {
+	name, args := splitCommand("/msg  bob  hello there\r\n")
+	if name != "msg" || args != "bob  hello there" {
+		t.Errorf("splitCommand = (%q, %q), want: (\"msg\", \"bob  hello there\")", name, args)
+	}
+	name, args = splitCommand("/who\r\n")
+	if name != "who" || args != "" {
+		t.Errorf("splitCommand = (%q, %q), want: (\"who\", \"\")", name, args)
+	}
+}
+
+func TestIsCommand(t *testing.T) {
+	if !isCommand([]byte("/who\r\n")) {
+		t.Error("Expected /who to be a command")
+	}
+	if isCommand([]byte("//who\r\n")) {
+		t.Error("Expected //who not to be a command")
+	}
+	if isCommand([]byte("who\r\n")) {
+		t.Error("Expected who not to be a command")
+	}
+}
+
+func TestRegisterCommandTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a command twice to panic")
+		}
+	}()
+	registerCommand("help", "/help", "", cmdHelp)
+}
+
+func TestUnknownCommand(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	s := newTestSession(t, cm, "testuser")
+	s.runCommand([]byte("/bogus\r\n"))
+	readUntil(t, s.conn, "Error: unknown command /bogus")
+}
+
+func TestCommandUsage(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	s := newTestSession(t, cm, "testuser")
+	s.runCommand([]byte("/history many\r\n"))
+	readUntil(t, s.conn, "Usage: /history [lines]")
+}
+
+func TestHistoryCommand(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	s := newTestSession(t, cm, "testuser")
+	first, _ := cm.Broadcast(chat.DefaultRoom, "other", []byte("1"))
+	second, _ := cm.Broadcast(chat.DefaultRoom, "other", []byte("2"))
+	cm.Broadcast(chat.DefaultRoom, "other", []byte("3"))
+
+	s.runCommand([]byte("/history 2\r\n"))
+	readUntil(t, s.conn, testTime+" <other> 2\n"+testTime+" <other> 3\n")
+	older := fmt.Sprintf("Older: /history 2 before %d", second.ID)
+	readUntil(t, s.conn, older)
+
+	// The older page includes testuser's join
+	s.runCommand([]byte(older[len("Older: "):] + "\r\n"))
+	readUntil(t, s.conn, testTime+" * testuser has joined\n"+testTime+" <other> 1\n")
+	readUntil(t, s.conn, fmt.Sprintf("Newer: /history 2 after %d", first.ID))
+
+	s.runCommand([]byte("/history 2 sideways 1\r\n"))
+	readUntil(t, s.conn, "Usage: /history")
+
+	// The page size is capped at the history size
+	s.runCommand([]byte(fmt.Sprintf("/history 9223372036854775807 before %d\r\n", second.ID)))
+	readUntil(t, s.conn, testTime+" * testuser has joined\n"+testTime+" <other> 1\n")
+	readUntil(t, s.conn, fmt.Sprintf("Newer: /history %d after %d", historySize, first.ID))
+}
+
+func TestSearchCommand(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	s := newTestSession(t, cm, "testuser")
+	s.runCommand([]byte("/search build\r\n"))
+	readUntil(t, s.conn, "Error: Search is disabled")
+
+	cm.SetIndex(search.New(100))
+	msg, _ := cm.Broadcast(chat.DefaultRoom, "other", []byte("build fixed"))
+	s.runCommand([]byte("/search build\r\n"))
+	readUntil(t, s.conn, fmt.Sprintf("#%d [lobby] %s <other> build fixed\n", msg.ID, testTime))
+	s.runCommand([]byte("/search deploy\r\n"))
+	readUntil(t, s.conn, "No matches")
+	s.runCommand([]byte("/search \"build\r\n"))
+	readUntil(t, s.conn, "Error: Invalid query: unterminated phrase")
+}
+
+func TestHelpCommand(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	s := newTestSession(t, cm, "testuser")
+	s.runCommand([]byte("/help\r\n"))
+	// The help doesn't fit in the buffer readUntil uses
+	buf := make([]byte, 4096)
+	help := ""
+	for !strings.HasPrefix(help, "/") {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		help = string(buf[:n])
+	}
+	for name := range commands {
+		if !strings.Contains(help, "/"+name) {
+			t.Errorf("help is missing /%s: %s", name, help)
+		}
+	}
+}
+
+func TestJoinLeaveCommands(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	s := newTestSession(t, cm, "testuser")
+
+	s.runCommand([]byte("/join dev\r\n"))
+	if s.room != "dev" {
+		t.Errorf("room = %s, want: dev", s.room)
+	}
+	members, err := cm.Members("dev")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Join(members, ",") != "testuser" {
+		t.Errorf("dev members = %v, want: [testuser]", members)
+	}
+
+	s.runCommand([]byte("/leave\r\n"))
+	if s.room != chat.DefaultRoom {
+		t.Errorf("room = %s, want: %s", s.room, chat.DefaultRoom)
+	}
+	members, err = cm.Members("dev")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(members) != 0 {
+		t.Errorf("dev members = %v, want none", members)
+	}
+
+	s.runCommand([]byte("/leave\r\n"))
+	readUntil(t, s.conn, "Error: Can't leave your only room")
+}
+
+func TestNickCommand(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	s := newTestSession(t, cm, "testuser")
+	newTestSession(t, cm, "taken")
+
+	s.runCommand([]byte("/nick taken\r\n"))
+	readUntil(t, s.conn, "Error: Another \"taken\" is already connected")
+
+	err := s.runCommand([]byte("/nick renamed\r\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s.name != "renamed" {
+		t.Errorf("name = %s, want: renamed", s.name)
+	}
+	members, err := cm.Members(chat.DefaultRoom)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Join(members, ",") != "renamed,taken" {
+		t.Errorf("members = %v, want: [renamed taken]", members)
+	}
+}
+
+func TestRegisterCommands(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	s := newTestSession(t, cm, "testuser")
+	s.runCommand([]byte("/register secret1\r\n"))
+	readUntil(t, s.conn, "Error: Registration is disabled")
+
+	accounts := chattest.MemAccounts{}
+	cm.SetAccounts(accounts, false)
+	s.runCommand([]byte("/register secret1\r\n"))
+	readUntil(t, s.conn, "Registered \"testuser\"")
+	s.runCommand([]byte("/passwd wrong secret2\r\n"))
+	readUntil(t, s.conn, "Error: Wrong password")
+	s.runCommand([]byte("/passwd secret1 secret2\r\n"))
+	readUntil(t, s.conn, "Password changed")
+	if !accounts.Authenticate("testuser", "secret2") {
+		t.Error("Expected the password to be changed")
+	}
+
+	other := newTestSession(t, cm, "other")
+	other.runCommand([]byte("/nick testuser2\r\n"))
+	// Unregistered names can still be taken
+	readUntil(t, other.conn, testTime+" * other is now known as testuser2")
+	accounts["taken"] = "secret1"
+	other.runCommand([]byte("/nick taken\r\n"))
+	readUntil(t, other.conn, "Error: Name is registered")
+}
+
+func TestTokenCommand(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	s := newTestSession(t, cm, "testuser")
+	s.runCommand([]byte("/token\r\n"))
+	readUntil(t, s.conn, "Error: Tokens are disabled")
+
+	cm.SetAccounts(chattest.MemAccounts{"testuser": "secret1"}, false)
+	cm.SetTokens(chattest.MemTokens{}, "")
+	s.runCommand([]byte("/token\r\n"))
+	readUntil(t, s.conn, "Token: testuser-1")
+	s.runCommand([]byte("/token read\r\n"))
+	readUntil(t, s.conn, "Token: testuser-2")
+	s.runCommand([]byte("/token write\r\n"))
+	readUntil(t, s.conn, "Usage: /token")
+	s.runCommand([]byte("/token revoke\r\n"))
+	readUntil(t, s.conn, "Revoked 2 token(s)")
+
+	other := newTestSession(t, cm, "other")
+	other.runCommand([]byte("/token\r\n"))
+	readUntil(t, other.conn, "Error: Only registered names can have tokens")
+}
+
+func TestMsgCommand(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	s := newTestSession(t, cm, "testuser")
+	other := newTestSession(t, cm, "other")
+
+	err := s.runCommand([]byte("/msg other psst\r\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	readUntil(t, other.conn, testTime+" *testuser -> other* psst")
+	readUntil(t, s.conn, testTime+" *testuser -> other* psst")
+
+	s.runCommand([]byte("/msg nobody psst\r\n"))
+	readUntil(t, s.conn, "Error: \"nobody\" is not connected")
+}
+
+func TestWhoCommand(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	s := newTestSession(t, cm, "testuser")
+	other := newTestSession(t, cm, "other")
+	other.runCommand([]byte("/join dev\r\n"))
+	readUntil(t, other.conn, testTime+" * other has joined")
+
+	s.runCommand([]byte("/who\r\n"))
+	readUntil(t, s.conn, "other (raw from remote) in dev, lobby; connected "+testTime+", idle 0s")
+	readUntil(t, s.conn, "testuser (raw from remote) in lobby; connected "+testTime+", idle 0s")
+	s.runCommand([]byte("/who dev\r\n"))
+	readUntil(t, s.conn, "other (raw from remote) in dev, lobby")
+	s.runCommand([]byte("/who nowhere\r\n"))
+	readUntil(t, s.conn, "Error: No such room")
+}
+
+func TestAwayCommands(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	s := newTestSession(t, cm, "testuser")
+	other := newTestSession(t, cm, "other")
+
+	s.runCommand([]byte("/back\r\n"))
+	readUntil(t, s.conn, "Error: Not away")
+	s.runCommand([]byte("/away gone fishing\r\n"))
+	readUntil(t, s.conn, "You are marked as away")
+	s.runCommand([]byte("/who\r\n"))
+	readUntil(t, s.conn, "testuser (raw from remote) in lobby; connected "+testTime+
+		", idle 0s, away since "+testTime+": gone fishing")
+	other.runCommand([]byte("/msg testuser hello\r\n"))
+	readUntil(t, other.conn, testTime+" *** testuser is away: gone fishing")
+	s.runCommand([]byte("/back now\r\n"))
+	readUntil(t, s.conn, "Usage: /back")
+	s.runCommand([]byte("/back\r\n"))
+	readUntil(t, s.conn, "You are no longer marked as away")
+}
+
+func TestQuitCommand(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	s := newTestSession(t, cm, "testuser")
+	if err := s.runCommand([]byte("/quit\r\n")); err != quitErr {
+		t.Errorf("err = %v, want: %v", err, quitErr)
+	}
+	readUntil(t, s.conn, "Bye!")
+}
@@ -0,0 +1,94 @@
+package raw
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+)
+
+// lineTooLongErr is returned by readLine when a line is longer than the
+// maximum line length.  The rest of the line is discarded, so reading can
+// continue with the next line.
+type lineTooLongErr struct {
+	maxLen int
+}
+
+func (e *lineTooLongErr) Error() string {
+	return fmt.Sprintf("Line too long (the maximum is %d bytes)", e.maxLen)
+}
+
+// lineReader frames the bytes read from a client into lines.  Lines may end
+// with "\n" or "\r\n", and may arrive over any number of reads.
+type lineReader struct {
+	r      *bufio.Reader
+	maxLen int
+	// partial holds the start of a line that a read timed out in the
+	// middle of
+	partial []byte
+}
+
+// newLineReader returns a lineReader that reads lines of up to maxLen bytes
+// (not counting the line ending) from r.
+func newLineReader(r io.Reader, maxLen int) *lineReader {
+	// Leave room for the "\r\n"
+	return &lineReader{bufio.NewReaderSize(r, maxLen+2), maxLen, nil}
+}
+
+// readLine returns the next line, without its line ending.  A
+// *lineTooLongErr is returned for lines longer than the maximum length, and
+// a partial line at the end of the input is discarded.  If a read times out
+// (see isTimeout), the timeout is returned and the partial line is kept, so
+// that reading can continue where it left off.
+func (l *lineReader) readLine() ([]byte, error) {
+	line, err := l.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		for err == bufio.ErrBufferFull {
+			_, err = l.r.ReadSlice('\n')
+		}
+		if isTimeout(err) {
+			// Whatever follows belongs to the line that is too long
+			l.partial = make([]byte, l.maxLen+2)
+			return nil, err
+		}
+		l.partial = nil
+		if err != nil {
+			return nil, err
+		}
+		return nil, &lineTooLongErr{l.maxLen}
+	} else if isTimeout(err) {
+		l.partial = append(l.partial, line...)
+		if len(l.partial) > l.maxLen+2 {
+			// Too long already; the rest of it only needs to be skipped
+			l.partial = l.partial[:l.maxLen+2]
+		}
+		return nil, err
+	} else if err != nil {
+		l.partial = nil
+		return nil, err
+	}
+	if l.partial != nil {
+		line = append(l.partial, line...)
+		l.partial = nil
+	}
+	line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+	if len(line) > l.maxLen {
+		return nil, &lineTooLongErr{l.maxLen}
+	}
+	// ReadSlice's result is only valid until the next read
+	return append([]byte{}, line...), nil
+}
+
+// isLineTooLong returns a bool indicating whether err is a *lineTooLongErr.
+func isLineTooLong(err error) bool {
+	_, ok := err.(*lineTooLongErr)
+	return ok
+}
+
+// isTimeout returns a bool indicating whether err is a timeout, e.g., a read
+// that passed the connection's read deadline.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
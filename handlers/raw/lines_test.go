@@ -0,0 +1,111 @@
+package raw
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadLine(t *testing.T) {
+	// OneByteReader makes every line arrive over several reads
+	r := iotest.OneByteReader(strings.NewReader("one\r\ntwo\nthree\r\n\npartial"))
+	lines := newLineReader(r, 16)
+	for _, expected := range []string{"one", "two", "three", ""} {
+		line, err := lines.readLine()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if string(line) != expected {
+			t.Errorf("line = %q, want: %q", line, expected)
+		}
+	}
+	_, err := lines.readLine()
+	if err != io.EOF {
+		t.Errorf("err = %v, want: %v", err, io.EOF)
+	}
+}
+
+func TestReadLineTooLong(t *testing.T) {
+	long := strings.Repeat("x", 40)
+	r := strings.NewReader("12345678901234567\n" + long + "\r\n1234567890123456\r\nok\n")
+	lines := newLineReader(r, 16)
+	for i := 0; i < 2; i++ {
+		_, err := lines.readLine()
+		if !isLineTooLong(err) {
+			t.Fatalf("err = %v, want a line too long error", err)
+		}
+	}
+	for _, expected := range []string{"1234567890123456", "ok"} {
+		line, err := lines.readLine()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if string(line) != expected {
+			t.Errorf("line = %q, want: %q", line, expected)
+		}
+	}
+}
+
+// TestReadLineSeveral makes sure that several lines arriving in one read
+// are read as separate lines.
+func TestReadLineSeveral(t *testing.T) {
+	lines := newLineReader(strings.NewReader("a\nb\nc\n"), 16)
+	for _, expected := range []string{"a", "b", "c"} {
+		line, err := lines.readLine()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if string(line) != expected {
+			t.Errorf("line = %q, want: %q", line, expected)
+		}
+	}
+}
+
+// timeoutReader returns the reads of a script in order, where a nil read
+// times out.
+type timeoutReader struct {
+	reads [][]byte
+}
+
+func (r *timeoutReader) Read(b []byte) (int, error) {
+	if len(r.reads) == 0 {
+		return 0, io.EOF
+	}
+	read := r.reads[0]
+	r.reads = r.reads[1:]
+	if read == nil {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return copy(b, read), nil
+}
+
+// TestReadLineTimeout makes sure that a line that a read timed out in the
+// middle of is completed by the following reads.
+func TestReadLineTimeout(t *testing.T) {
+	long := []byte(strings.Repeat("x", 12))
+	r := &timeoutReader{[][]byte{[]byte("hel"), nil, []byte("lo\r\n"),
+		long, nil, long, []byte("\n"), nil, []byte("ok\n")}}
+	lines := newLineReader(r, 16)
+	for _, expected := range []string{"timeout", "hello", "timeout", "too long", "timeout", "ok"} {
+		line, err := lines.readLine()
+		switch expected {
+		case "timeout":
+			if !isTimeout(err) {
+				t.Fatalf("err = %v, want a timeout", err)
+			}
+		case "too long":
+			if !isLineTooLong(err) {
+				t.Fatalf("err = %v, want a line too long error", err)
+			}
+		default:
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if string(line) != expected {
+				t.Errorf("line = %q, want: %q", line, expected)
+			}
+		}
+	}
+}
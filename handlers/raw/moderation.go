@@ -0,0 +1,111 @@
+package raw
+
+import (
+	"strings"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+func init() {
+	registerCommand("op", "/op <name>", "Make a registered user an operator (operators only)", cmdOp)
+	registerCommand("kick", "/kick <name> [reason]", "Disconnect a user (operators only)", cmdKick)
+	registerCommand("ban", "/ban <name|ip|cidr> [duration] [reason]", "Ban a user or addresses, e.g. for 24h (operators only)", cmdBan)
+	registerCommand("unban", "/unban <name|ip|cidr>", "Lift a ban (operators only)", cmdUnban)
+	registerCommand("mute", "/mute <name> [duration] [reason]", "Keep a user from sending messages (operators only)", cmdMute)
+	registerCommand("unmute", "/unmute <name>", "Let a muted user send messages again (operators only)", cmdUnmute)
+	registerCommand("bans", "/bans", "List the bans and mutes (operators only)", cmdBans)
+}
+
+// parseSanction splits the arguments of /ban and /mute into the target, the
+// duration (0 if none is given) and the reason.
+func parseSanction(args string) (target string, d time.Duration, reason string) {
+	target, rest := splitCommand(args)
+	first, afterFirst := splitCommand(rest)
+	if parsed, err := time.ParseDuration(first); err == nil {
+		return target, parsed, afterFirst
+	}
+	return target, 0, rest
+}
+
+func cmdOp(s *session, args string) error {
+	if args == "" || strings.ContainsAny(args, " \t") {
+		return usageErr
+	}
+	if err := s.cm.Op(s.name, args); err != nil {
+		return err
+	}
+	s.reply("%s is now an operator", args)
+	return nil
+}
+
+func cmdKick(s *session, args string) error {
+	name, reason := splitCommand(args)
+	if name == "" {
+		return usageErr
+	}
+	return s.cm.Kick(s.name, name, reason)
+}
+
+func cmdBan(s *session, args string) error {
+	target, d, reason := parseSanction(args)
+	if target == "" {
+		return usageErr
+	}
+	ban, err := s.cm.Ban(s.name, target, d, reason)
+	if err != nil {
+		return err
+	}
+	s.reply("Banned %s%s", target, ban.Describe())
+	return nil
+}
+
+func cmdUnban(s *session, args string) error {
+	if args == "" || strings.ContainsAny(args, " \t") {
+		return usageErr
+	}
+	if err := s.cm.Unban(s.name, args); err != nil {
+		return err
+	}
+	s.reply("Unbanned %s", args)
+	return nil
+}
+
+func cmdMute(s *session, args string) error {
+	name, d, reason := parseSanction(args)
+	if name == "" {
+		return usageErr
+	}
+	mute, err := s.cm.Mute(s.name, name, d, reason)
+	if err != nil {
+		return err
+	}
+	s.reply("Muted %s%s", name, mute.Describe())
+	return nil
+}
+
+func cmdUnmute(s *session, args string) error {
+	if args == "" || strings.ContainsAny(args, " \t") {
+		return usageErr
+	}
+	if err := s.cm.Unmute(s.name, args); err != nil {
+		return err
+	}
+	s.reply("Unmuted %s", args)
+	return nil
+}
+
+func cmdBans(s *session, args string) error {
+	if !s.cm.IsOperator(s.name) {
+		return chat.PermissionDeniedErr
+	}
+	sanctions := s.cm.Sanctions()
+	if len(sanctions) == 0 {
+		s.reply("No bans or mutes")
+		return nil
+	}
+	for _, sanction := range sanctions {
+		s.reply("%s %s (by %s)%s", sanction.Kind, sanction.Target, sanction.By, sanction.Describe())
+	}
+	return nil
+}
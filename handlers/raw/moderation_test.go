@@ -0,0 +1,59 @@
+package raw
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+	"github.com/bgmerrell/gochatd/internal/chattest"
+	"github.com/bgmerrell/gochatd/moderation"
+)
+
+func TestParseSanction(t *testing.T) {
+	target, d, reason := parseSanction("bob 24h too much spam")
+	if target != "bob" || d != 24*time.Hour || reason != "too much spam" {
+		t.Errorf("parseSanction = (%q, %s, %q), want: (\"bob\", 24h0m0s, \"too much spam\")", target, d, reason)
+	}
+	target, d, reason = parseSanction("10.0.0.0/8 spam")
+	if target != "10.0.0.0/8" || d != 0 || reason != "spam" {
+		t.Errorf("parseSanction = (%q, %s, %q), want: (\"10.0.0.0/8\", 0s, \"spam\")", target, d, reason)
+	}
+}
+
+func TestModerationCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gochatd-moderation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mod, err := moderation.Open(filepath.Join(dir, "moderation.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := chat.NewChatManager(nil, historySize)
+	cm.SetAccounts(chattest.MemAccounts{"alice": "secret1", "bob": "secret2"}, false)
+	cm.SetOperators([]string{"alice"})
+	cm.SetModeration(mod)
+	alice := newTestSession(t, cm, "alice")
+	bob := newTestSession(t, cm, "bob")
+
+	bob.runCommand([]byte("/kick alice\r\n"))
+	readUntil(t, bob.conn, "Error: Permission denied")
+	alice.runCommand([]byte("/mute bob 1h flooding\r\n"))
+	readUntil(t, alice.conn, "Muted bob until 02-Jan-06 16:04: flooding")
+	readUntil(t, bob.conn, testTime+" *** You have been muted by alice until 02-Jan-06 16:04: flooding")
+	alice.runCommand([]byte("/bans\r\n"))
+	readUntil(t, alice.conn, "mute bob (by alice) until 02-Jan-06 16:04: flooding")
+	alice.runCommand([]byte("/unmute bob\r\n"))
+	readUntil(t, alice.conn, "Unmuted bob")
+	readUntil(t, bob.conn, testTime+" *** You are no longer muted")
+
+	alice.runCommand([]byte("/ban bob\r\n"))
+	readUntil(t, bob.conn, testTime+" *** You have been banned by alice")
+	readUntil(t, alice.conn, "Banned bob")
+	alice.runCommand([]byte("/unban bob\r\n"))
+	readUntil(t, alice.conn, "Unbanned bob")
+}
@@ -6,55 +6,113 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"time"
 
 	"github.com/bgmerrell/gochatd/chat"
+	"github.com/bgmerrell/gochatd/ratelimit"
 )
 
 const (
-	namePrompt = "What's your name?: "
+	namePrompt     = "What's your name?: "
+	passwordPrompt = "Password: "
+	// registerPrompt is shown when registration is required and the name
+	// isn't registered yet
+	registerPrompt = "\"%s\" isn't registered; choose a password to register it: "
+	// farewellTimeout bounds the time spent telling a client that failed
+	// to log in or timed out why it is being disconnected.
+	farewellTimeout = time.Second
 )
 
+var RateLimitErr = errors.New("Rate limit exceeded")
+var LoginTimeoutErr = errors.New("Login timed out")
+var IdleTimeoutErr = errors.New("Idle for too long")
+
 // rawHandler handles raw (as opposed to HTTP, e.g.) TCP connections from
 // clients.
 type rawHandler struct {
-	buf         []byte
-	maxNameSize int
+	maxLineLen    int
+	maxNameSize   int
+	rate          float64
+	burst         int
+	maxViolations int
+	loginTimeout  time.Duration
+	idleTimeout   time.Duration
+	idleWarning   time.Duration
 }
 
-// NewRawHandler returns an initialized rawHandler.  bufSize indicates the
-// size of the read buffer to be used, and maxNameSize indicates the
-// maximum allowed length of a client username.
-func NewRawHandler(bufSize int, maxNameSize int) *rawHandler {
+// NewRawHandler returns an initialized rawHandler.  maxLineLen indicates the
+// maximum allowed length of a line read from a client, and maxNameSize
+// indicates the maximum allowed length of a client username.
+func NewRawHandler(maxLineLen int, maxNameSize int) *rawHandler {
 	return &rawHandler{
-		make([]byte, bufSize),
+		maxLineLen,
 		maxNameSize,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+	}
+}
+
+// SetRateLimit limits each connection to rate lines per second, in bursts
+// of up to burst lines.  Lines over the limit are dropped with a warning,
+// and a client is disconnected when it goes over the limit again after
+// maxViolations warnings (0 only warns).  A rate of 0 disables the limit.
+func (r *rawHandler) SetRateLimit(rate float64, burst int, maxViolations int) {
+	if burst < 1 {
+		burst = 1
+	}
+	r.rate = rate
+	r.burst = burst
+	r.maxViolations = maxViolations
+}
+
+// SetTimeouts limits how long a client has to log in (send its name and,
+// if needed, its password) and how long a logged-in client may go without
+// sending a line before it is disconnected.  An idle client is warned
+// idleWarning before it is disconnected (a warning that isn't shorter than
+// idleTimeout is not sent).  A timeout of 0 disables it.
+func (r *rawHandler) SetTimeouts(loginTimeout time.Duration, idleTimeout time.Duration, idleWarning time.Duration) {
+	if idleWarning >= idleTimeout {
+		idleWarning = 0
 	}
+	r.loginTimeout = loginTimeout
+	r.idleTimeout = idleTimeout
+	r.idleWarning = idleWarning
 }
 
 // validateName returns a bool indicating whether the client username is
-// acceptable.
+// acceptable (see chat.ValidName).
 func (r *rawHandler) validateName(name string) (ok bool) {
-	if len(name) == 0 || len(name) > r.maxNameSize {
+	if len(name) > r.maxNameSize || !chat.ValidName(name) {
 		return false
 	}
 	return true
 }
 
-// getName queries and reads the username from the client.  The username is
-// returned as a string and an error is returned if any problems are
-// encountered.
-func (r *rawHandler) getName(conn net.Conn) (name string, err error) {
+// getName queries and reads the username (a line) from the client.  The
+// username is returned as a string and an error is returned if any problems
+// are encountered.
+func (r *rawHandler) getName(conn net.Conn, lines *lineReader) (name string, err error) {
 	_, err = conn.Write([]byte(namePrompt))
 	if err != nil {
 		log.Println("Error requesting name:", err.Error())
 		return name, errors.New("Error requesting name: " + err.Error())
 	}
-	n, err := conn.Read(r.buf)
-	if err != nil {
+	line, err := lines.readLine()
+	if isLineTooLong(err) {
+		log.Println("Name line too long")
+		return name, errors.New("Invalid name: " + err.Error())
+	} else if isTimeout(err) {
+		log.Printf("Login timed out for %s", conn.RemoteAddr())
+		return name, LoginTimeoutErr
+	} else if err != nil {
 		log.Println("Error reading name: ", err.Error())
 		return name, errors.New("Error reading name: " + err.Error())
 	}
-	name = string(bytes.TrimSpace(r.buf[:n]))
+	name = string(bytes.TrimSpace(line))
 	if !r.validateName(name) {
 		log.Printf("Invalid name: %s", name)
 		return name, errors.New("Invalid name")
@@ -62,30 +120,252 @@ func (r *rawHandler) getName(conn net.Conn) (name string, err error) {
 	return name, err
 }
 
+// readPassword prompts for and reads a password (a line) from the client.
+func (r *rawHandler) readPassword(conn net.Conn, lines *lineReader, prompt string) (password string, err error) {
+	_, err = conn.Write([]byte(prompt))
+	if err != nil {
+		return password, errors.New("Error requesting password: " + err.Error())
+	}
+	line, err := lines.readLine()
+	if isTimeout(err) {
+		log.Printf("Login timed out for %s", conn.RemoteAddr())
+		return password, LoginTimeoutErr
+	} else if err != nil {
+		return password, errors.New("Error reading password: " + err.Error())
+	}
+	return string(bytes.TrimSpace(line)), nil
+}
+
+// login checks that the client may use name.  Registered names require
+// their password.  If registration is required, an unregistered name is
+// registered with a password chosen by the client.
+func (r *rawHandler) login(cm *chat.ChatManager, conn net.Conn, lines *lineReader, name string) error {
+	if cm.Registered(name) {
+		password, err := r.readPassword(conn, lines, passwordPrompt)
+		if err != nil {
+			return err
+		}
+		return cm.Login(conn.RemoteAddr().String(), name, password)
+	}
+	if cm.RegistrationRequired() {
+		password, err := r.readPassword(conn, lines, fmt.Sprintf(registerPrompt, name))
+		if err != nil {
+			return err
+		}
+		return cm.Register(name, password)
+	}
+	return nil
+}
+
+// session holds the per-connection state of a joined client.  bucket is
+// nil if the handler has no rate limit.  warned is set once an idle client
+// has been warned that it is about to be disconnected.
+type session struct {
+	h          *rawHandler
+	cm         *chat.ChatManager
+	name       string
+	conn       net.Conn
+	room       string
+	joined     []string
+	bucket     *ratelimit.Bucket
+	violations int
+	warned     bool
+}
+
+// newSession returns a session for a client that has joined the
+// DefaultRoom.
+func newSession(h *rawHandler, cm *chat.ChatManager, name string, conn net.Conn) *session {
+	var bucket *ratelimit.Bucket
+	if h.rate > 0 {
+		bucket = ratelimit.NewBucket(h.rate, h.burst)
+	}
+	return &session{h, cm, name, conn, chat.DefaultRoom, []string{chat.DefaultRoom}, bucket, 0, false}
+}
+
+// active restarts the idle timeout (see SetTimeouts) after the client has
+// sent a line.  The read deadline is set for when the client is to be
+// warned (or disconnected, if there is no warning).
+func (s *session) active() {
+	if s.h.idleTimeout <= 0 {
+		return
+	}
+	s.warned = false
+	_ = s.conn.SetReadDeadline(time.Now().Add(s.h.idleTimeout - s.h.idleWarning))
+}
+
+// idle handles a read that passed the idle deadline.  The client is warned
+// first, if it hasn't been already; after that, IdleTimeoutErr is returned.
+func (s *session) idle() error {
+	if s.warned || s.h.idleWarning <= 0 {
+		return IdleTimeoutErr
+	}
+	s.warned = true
+	_ = s.conn.SetReadDeadline(time.Now().Add(s.h.idleWarning))
+	s.reply("Warning: you will be disconnected in %s unless you send something", s.h.idleWarning)
+	return nil
+}
+
+// limit returns a bool indicating whether a line from the client is within
+// the rate limit (see SetRateLimit).  The client is warned about lines over
+// the limit, and RateLimitErr is returned once it has had too many warnings.
+func (s *session) limit() (ok bool, err error) {
+	if s.bucket == nil {
+		return true, nil
+	}
+	ok, retryAfter := s.bucket.Allow(time.Now())
+	if ok {
+		return true, nil
+	}
+	s.violations++
+	if s.h.maxViolations > 0 && s.violations > s.h.maxViolations {
+		return false, RateLimitErr
+	}
+	s.reply("Warning: you are sending too fast; wait %s", retryAfter.Round(time.Millisecond))
+	return false, nil
+}
+
+// reply writes a line to the client only (see write).
+func (s *session) reply(format string, a ...interface{}) {
+	s.write([]byte(fmt.Sprintf(format+"\n", a...)))
+}
+
+// write writes data to the client only.  It is queued after the messages
+// that are already queued for the client, so the two don't interleave.
+func (s *session) write(data []byte) {
+	if err := s.cm.Reply(s.conn, data); err != nil {
+		log.Printf("Error replying to %s: %s", s.name, err)
+	}
+}
+
+// disconnect removes the client from the chat once what is queued for it
+// (e.g., a farewell reply) has been written, or farewellTimeout has passed,
+// and closes its connection.
+func (s *session) disconnect() {
+	_ = s.conn.SetWriteDeadline(time.Now().Add(farewellTimeout))
+	s.cm.Disconnect(s.conn)
+	s.conn.Close()
+}
+
+// inRoom returns a bool indicating whether the client has joined roomName.
+func (s *session) inRoom(roomName string) bool {
+	for _, joined := range s.joined {
+		if joined == roomName {
+			return true
+		}
+	}
+	return false
+}
+
+// join joins roomName (or switches to it if it has already been joined) and
+// makes it the room that the client's messages are sent to.
+func (s *session) join(roomName string) error {
+	if !s.inRoom(roomName) {
+		err := s.cm.Join(roomName, s.name, s.conn)
+		if err != nil {
+			return err
+		}
+		s.joined = append(s.joined, roomName)
+	}
+	s.room = roomName
+	return nil
+}
+
+// leave quits roomName.  The last joined room can't be left; the client
+// should disconnect instead.
+func (s *session) leave(roomName string) error {
+	if !s.inRoom(roomName) {
+		return errors.New("Not in " + roomName)
+	}
+	if len(s.joined) == 1 {
+		return errors.New("Can't leave your only room")
+	}
+	s.cm.Quit(roomName, s.name)
+	for i, joined := range s.joined {
+		if joined == roomName {
+			s.joined = append(s.joined[:i], s.joined[i+1:]...)
+			break
+		}
+	}
+	if s.room == roomName {
+		s.room = s.joined[len(s.joined)-1]
+	}
+	return nil
+}
+
 // Handle conditionally adds a new connection (conn) to the ChatManager (cm)
-// and continuously reads from the client and broadcasts its messages until the
-// client disconnects.
+// and continuously reads lines from the client until the client disconnects
+// (or times out; see SetTimeouts).  Lines starting with '/' are run as
+// commands; anything else is broadcast to the client's current room.
 func (r *rawHandler) Handle(cm *chat.ChatManager, conn net.Conn) {
-	name, err := r.getName(conn)
+	lines := newLineReader(conn, r.maxLineLen)
+	if r.loginTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(r.loginTimeout))
+	}
+	name, err := r.getName(conn, lines)
+	if err == nil {
+		err = r.login(cm, conn, lines, name)
+	}
+	if err == nil {
+		err = conn.SetReadDeadline(time.Time{})
+	}
 	if err != nil {
+		_ = conn.SetWriteDeadline(time.Now().Add(farewellTimeout))
 		_, _ = conn.Write([]byte(fmt.Sprintf("Disconnecting: %s\n", err)))
 		conn.Close()
 		return
 	}
-	err = cm.Join(name, conn)
+	err = cm.Join(chat.DefaultRoom, name, conn)
 	if err != nil {
 		_, _ = conn.Write([]byte(fmt.Sprintf("Disconnecting: %s\n", err)))
 		conn.Close()
 		return
 	}
+	s := newSession(r, cm, name, conn)
+	s.active()
 	for {
-		n, err := conn.Read(r.buf)
-		if err != nil {
+		msg, err := lines.readLine()
+		if isTimeout(err) {
+			if err = s.idle(); err != nil {
+				log.Printf("Disconnecting %s: %s", s.name, err)
+				s.reply("Disconnecting: %s", err)
+				s.disconnect()
+				return
+			}
+			continue
+		}
+		s.active()
+		if isLineTooLong(err) {
+			s.reply("Error: %s", err)
+			continue
+		} else if err != nil {
 			log.Println(err)
-			cm.Quit(name)
-			conn.Close()
+			s.disconnect()
+			return
+		}
+		if len(bytes.TrimSpace(msg)) == 0 {
+			continue
+		}
+		if ok, err := s.limit(); err != nil {
+			s.reply("Disconnecting: %s", err)
+			s.disconnect()
 			return
+		} else if !ok {
+			continue
+		}
+		if isCommand(msg) {
+			if s.runCommand(msg) == quitErr {
+				s.disconnect()
+				return
+			}
+			continue
+		}
+		// "//" escapes a message that should start with a '/'
+		if bytes.HasPrefix(msg, []byte("//")) {
+			msg = msg[1:]
+		}
+		_, err = cm.Broadcast(s.room, s.name, msg)
+		if err != nil {
+			s.reply("Error: %s", err)
 		}
-		cm.Broadcast(name, r.buf[:n])
 	}
 }
@@ -2,12 +2,16 @@ package raw
 
 import (
 	"bytes"
+	"fmt"
+	"net"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/bgmerrell/gochatd/chat"
 	"github.com/bgmerrell/gochatd/dummyconn"
+	"github.com/bgmerrell/gochatd/internal/chattest"
 )
 
 var bufSize int = 512
@@ -42,14 +46,14 @@ func TestHandle(t *testing.T) {
 	n, err = dc.Write(wMsg)
 	expectedN := len(wMsg)
 	if n != expectedN {
-		t.Error("n: %d, want: %d.", n, expectedN)
+		t.Errorf("n: %d, want: %d.", n, expectedN)
 	}
 
 	wMsg = []byte("A test message\r\n")
 	n, err = dc.Write(wMsg)
 	expectedN = len(wMsg)
 	if n != expectedN {
-		t.Error("n: %d, want: %d.", n, expectedN)
+		t.Errorf("n: %d, want: %d.", n, expectedN)
 	}
 
 	// mock client disconnecting
@@ -86,7 +90,7 @@ func TestHandleEmptyName(t *testing.T) {
 	n, err = dc.Write(wMsg)
 	expectedN := len(wMsg)
 	if n != expectedN {
-		t.Error("n: %d, want: %d.", n, expectedN)
+		t.Errorf("n: %d, want: %d.", n, expectedN)
 	}
 
 	n, err = dc.Read(buf)
@@ -125,7 +129,7 @@ func TestHandleLongName(t *testing.T) {
 	n, err = dc.Write(wMsg)
 	expectedN := len(wMsg)
 	if n != expectedN {
-		t.Error("n: %d, want: %d.", n, expectedN)
+		t.Errorf("n: %d, want: %d.", n, expectedN)
 	}
 
 	n, err = dc.Read(buf)
@@ -144,7 +148,7 @@ func TestGetNameErrRequesting(t *testing.T) {
 	dc := dummyconn.NewDummyConn()
 	rh := NewRawHandler(bufSize, maxNameSize)
 	dc.Close()
-	_, err := rh.getName(dc)
+	_, err := rh.getName(dc, newLineReader(dc, bufSize))
 	if !strings.HasPrefix(err.Error(), "Error requesting name") {
 		t.Error("Expected error requesting name")
 	}
@@ -205,7 +209,7 @@ func TestHandleDuplicateUser(t *testing.T) {
 	n, err = dc1.Write(wMsg)
 	expectedN := len(wMsg)
 	if n != expectedN {
-		t.Error("n: %d, want: %d.", n, expectedN)
+		t.Errorf("n: %d, want: %d.", n, expectedN)
 	}
 
 	// "testuser" logging in on dc2
@@ -222,7 +226,7 @@ func TestHandleDuplicateUser(t *testing.T) {
 	n, err = dc2.Write(wMsg)
 	expectedN = len(wMsg)
 	if n != expectedN {
-		t.Error("n: %d, want: %d.", n, expectedN)
+		t.Errorf("n: %d, want: %d.", n, expectedN)
 	}
 
 	// mock client disconnect of dc1; no need to disconnect dc2 due to
@@ -234,3 +238,191 @@ func TestHandleDuplicateUser(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+// readUntil reads from dc until a read starting with prefix is seen and
+// returns it.  Reads of other messages (e.g., join announcements) are
+// skipped.
+func readUntil(t *testing.T, dc interface {
+	Read([]byte) (int, error)
+}, prefix string) []byte {
+	buf := make([]byte, bufSize)
+	for {
+		n, err := dc.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.HasPrefix(buf[:n], []byte(prefix)) {
+			return buf[:n]
+		}
+	}
+}
+
+// testLogin runs login for name on a new dummyconn, answering the prompt
+// (which must be expectedPrompt) with password.
+func testLogin(t *testing.T, cm *chat.ChatManager, name string, expectedPrompt string, password string) error {
+	dc := dummyconn.NewDummyConn()
+	rh := NewRawHandler(bufSize, maxNameSize)
+	errCh := make(chan error)
+	go func() { errCh <- rh.login(cm, dc, newLineReader(dc, bufSize), name) }()
+	if expectedPrompt != "" {
+		buf := make([]byte, bufSize)
+		n, err := dc.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != expectedPrompt {
+			t.Fatalf("Prompt = %q, want: %q", buf[:n], expectedPrompt)
+		}
+		dc.Write([]byte(password + "\r\n"))
+	}
+	return <-errCh
+}
+
+func TestLogin(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	if err := testLogin(t, cm, "anyone", "", ""); err != nil {
+		t.Errorf("Login without accounts error = %s", err)
+	}
+	accounts := chattest.MemAccounts{"alice": "secret1"}
+	cm.SetAccounts(accounts, false)
+	if err := testLogin(t, cm, "alice", passwordPrompt, "secret1"); err != nil {
+		t.Errorf("Login with the right password error = %s", err)
+	}
+	if err := testLogin(t, cm, "alice", passwordPrompt, "wrong"); err != chat.AuthFailedErr {
+		t.Errorf("Login with a wrong password error = %v, want: %s", err, chat.AuthFailedErr)
+	}
+	if err := testLogin(t, cm, "bob", "", ""); err != nil {
+		t.Errorf("Login with an unregistered name error = %s", err)
+	}
+
+	cm.SetAccounts(accounts, true)
+	if err := testLogin(t, cm, "bob", fmt.Sprintf(registerPrompt, "bob"), "secret2"); err != nil {
+		t.Errorf("Login registering a name error = %s", err)
+	}
+	if !accounts.Authenticate("bob", "secret2") {
+		t.Error("Expected bob to be registered")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	dc := dummyconn.NewDummyConn()
+	if err := cm.Join(chat.DefaultRoom, "testuser", dc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	rh := NewRawHandler(bufSize, maxNameSize)
+	// Slow enough that no tokens are gained during the test
+	rh.SetRateLimit(0.001, 2, 1)
+	s := newSession(rh, cm, "testuser", dc)
+	for i := 0; i < 2; i++ {
+		if ok, err := s.limit(); !ok || err != nil {
+			t.Fatalf("Line %d of the burst: limit = (%t, %v), want: (true, nil)", i, ok, err)
+		}
+	}
+	type result struct {
+		ok  bool
+		err error
+	}
+	resultCh := make(chan result)
+	go func() {
+		ok, err := s.limit()
+		resultCh <- result{ok, err}
+	}()
+	readUntil(t, dc, "Warning: you are sending too fast")
+	if r := <-resultCh; r.ok || r.err != nil {
+		t.Errorf("First violation: limit = (%t, %v), want: (false, nil)", r.ok, r.err)
+	}
+	if ok, err := s.limit(); ok || err != RateLimitErr {
+		t.Errorf("Second violation: limit = (%t, %v), want: (false, %s)", ok, err, RateLimitErr)
+	}
+
+	// Without a rate limit, everything is allowed
+	s = newSession(NewRawHandler(bufSize, maxNameSize), cm, "testuser", dc)
+	for i := 0; i < 10; i++ {
+		if ok, err := s.limit(); !ok || err != nil {
+			t.Fatalf("limit without a rate limit = (%t, %v), want: (true, nil)", ok, err)
+		}
+	}
+}
+
+// waitHandled waits up to five seconds for the Handle calls of a test to
+// return.
+func waitHandled(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handle didn't return")
+	}
+}
+
+func TestGetNameTimeout(t *testing.T) {
+	dc := dummyconn.NewDummyConn()
+	rh := NewRawHandler(bufSize, maxNameSize)
+	errCh := make(chan error)
+	go func() {
+		_, err := rh.getName(dc, newLineReader(dc, bufSize))
+		errCh <- err
+	}()
+	readUntil(t, dc, namePrompt)
+	dc.SetReadDeadline(time.Now())
+	if err := <-errCh; err != LoginTimeoutErr {
+		t.Errorf("getName error = %v, want: %s", err, LoginTimeoutErr)
+	}
+}
+
+func TestLoginTimeout(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	dc := dummyconn.NewDummyConn()
+	rh := NewRawHandler(bufSize, maxNameSize)
+	rh.SetTimeouts(100*time.Millisecond, 0, 0)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rh.Handle(cm, dc)
+	}()
+	readUntil(t, dc, namePrompt)
+	// No name is sent, so the handler gives up on the client
+	waitHandled(t)
+	if users := cm.Presence(); len(users) != 0 {
+		t.Errorf("Presence = %v, want nobody", users)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	// Unlike the dummyconn loopback, a pipe keeps what the handler's writer
+	// sends (e.g., the warning) from being read back by the handler
+	server, client := net.Pipe()
+	defer client.Close()
+	rh := NewRawHandler(bufSize, maxNameSize)
+	rh.SetTimeouts(time.Second, 200*time.Millisecond, 100*time.Millisecond)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rh.Handle(cm, server)
+	}()
+	readUntil(t, client, namePrompt)
+	client.Write([]byte("testuser\r\n"))
+	warning := "Warning: you will be disconnected in 100ms unless you send something\n"
+	if msg := readUntil(t, client, "Warning"); string(msg) != warning {
+		t.Errorf("Warning = %q, want: %q", msg, warning)
+	}
+	// Sending something restarts the timeout
+	client.Write([]byte("still here\r\n"))
+	readUntil(t, client, "Warning")
+	if users := cm.Presence(); len(users) != 1 {
+		t.Fatalf("Presence = %v, want testuser only", users)
+	}
+
+	// Nothing is sent after the warning, so the client is disconnected
+	readUntil(t, client, "Disconnecting: "+IdleTimeoutErr.Error())
+	waitHandled(t)
+	if users := cm.Presence(); len(users) != 0 {
+		t.Errorf("Presence = %v, want nobody", users)
+	}
+}
@@ -0,0 +1,145 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Frame opcodes (RFC 6455, section 5.2)
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Close status codes (RFC 6455, section 7.4.1)
+const (
+	closeNormal       = 1000
+	closeGoingAway    = 1001
+	closeProtocol     = 1002
+	closeUnsupported  = 1003
+	closeInvalidData  = 1007
+	closePolicy       = 1008
+	closeTooBig       = 1009
+	maxControlPayload = 125
+)
+
+// closeError is returned when the connection has to be closed with a
+// specific status code.
+type closeError struct {
+	code   int
+	reason string
+}
+
+func (e *closeError) Error() string {
+	return fmt.Sprintf("WebSocket close %d: %s", e.code, e.reason)
+}
+
+// frame is a single WebSocket frame.
+type frame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// isControl returns a bool indicating whether the frame is a control frame.
+func (f *frame) isControl() bool {
+	return f.opcode&0x8 != 0
+}
+
+// readFrame reads a frame sent by a client.  Client frames must be masked,
+// and payloads longer than maxSize are refused.
+func readFrame(r *bufio.Reader, maxSize int) (*frame, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	f := &frame{fin: header[0]&0x80 != 0, opcode: header[0] & 0x0f}
+	if header[0]&0x70 != 0 {
+		return nil, &closeError{closeProtocol, "reserved bits set"}
+	}
+	if header[1]&0x80 == 0 {
+		return nil, &closeError{closeProtocol, "client frames must be masked"}
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		_, err = io.ReadFull(r, ext)
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		_, err = io.ReadFull(r, ext)
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.isControl() && (length > maxControlPayload || !f.fin) {
+		return nil, &closeError{closeProtocol, "invalid control frame"}
+	}
+	if length > uint64(maxSize) {
+		return nil, &closeError{closeTooBig, "message too big"}
+	}
+	mask := make([]byte, 4)
+	_, err = io.ReadFull(r, mask)
+	if err != nil {
+		return nil, err
+	}
+	f.payload = make([]byte, length)
+	_, err = io.ReadFull(r, f.payload)
+	if err != nil {
+		return nil, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+// writeFrame writes a single, final, unmasked (as server frames are) frame.
+func writeFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// closePayload returns the payload of a close frame with code and reason.
+func closePayload(code int, reason string) []byte {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	return payload
+}
+
+// parseClosePayload returns the status code of a close frame's payload.
+// closeNormal is returned for an empty payload.
+func parseClosePayload(payload []byte) (int, error) {
+	if len(payload) == 0 {
+		return closeNormal, nil
+	}
+	if len(payload) == 1 {
+		return 0, errors.New("Invalid close payload")
+	}
+	return int(binary.BigEndian.Uint16(payload)), nil
+}
@@ -0,0 +1,59 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestWriteFrameLengths(t *testing.T) {
+	for _, length := range []int{0, 125, 126, 0xffff, 0x10000} {
+		buf := &bytes.Buffer{}
+		err := writeFrame(buf, opText, make([]byte, length))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		headerLen := 2
+		if length > 0xffff {
+			headerLen = 10
+		} else if length > 125 {
+			headerLen = 4
+		}
+		if buf.Len() != headerLen+length {
+			t.Errorf("frame length = %d, want: %d", buf.Len(), headerLen+length)
+		}
+	}
+}
+
+func TestReadFrameTooBig(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writeClientFrame(t, buf, true, opText, []byte("too big"))
+	_, err := readFrame(bufio.NewReader(buf), 3)
+	if ce, ok := err.(*closeError); !ok || ce.code != closeTooBig {
+		t.Errorf("err = %v, want a too big close error", err)
+	}
+}
+
+func TestReadFrameFragmentedControl(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writeClientFrame(t, buf, false, opPing, nil)
+	_, err := readFrame(bufio.NewReader(buf), 16)
+	if ce, ok := err.(*closeError); !ok || ce.code != closeProtocol {
+		t.Errorf("err = %v, want a protocol close error", err)
+	}
+}
+
+func TestParseClosePayload(t *testing.T) {
+	code, err := parseClosePayload(closePayload(closeGoingAway, "bye"))
+	if err != nil || code != closeGoingAway {
+		t.Errorf("parseClosePayload = (%d, %v), want: (%d, nil)", code, err, closeGoingAway)
+	}
+	code, err = parseClosePayload(nil)
+	if err != nil || code != closeNormal {
+		t.Errorf("parseClosePayload = (%d, %v), want: (%d, nil)", code, err, closeNormal)
+	}
+	_, err = parseClosePayload([]byte{3})
+	if err == nil {
+		t.Error("Expected error for a one byte payload")
+	}
+}
@@ -0,0 +1,459 @@
+// Package websocket lets browsers join the chat over WebSocket connections.
+// The RFC 6455 handshake and framing are implemented with the standard
+// library only.
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bgmerrell/gochatd/chat"
+	"github.com/bgmerrell/gochatd/ratelimit"
+)
+
+// websocketGUID is appended to the client's key to compute the accept key
+// (RFC 6455, section 1.3).
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	nameParam     = "name"
+	passwordParam = "password"
+	roomParam     = "room"
+	formatParam   = "format"
+	defaultFormat = "json"
+)
+
+// writeTimeout bounds the time it may take to write a frame to a client; a
+// client that doesn't read for that long is disconnected.
+const writeTimeout = 10 * time.Second
+
+var ClosedErr = errors.New("WebSocket connection is closed")
+var RateLimitErr = errors.New("Rate limit exceeded")
+
+// webSocketHandler handles WebSocket connections from clients.
+type webSocketHandler struct {
+	maxMsgSize     int
+	maxNameSize    int
+	pingInterval   time.Duration
+	allowedOrigins []string
+	rate           float64
+	burst          int
+	maxViolations  int
+}
+
+// NewWebSocketHandler returns an initialized webSocketHandler.  maxMsgSize
+// indicates the maximum allowed size of a message read from a client,
+// maxNameSize indicates the maximum allowed length of a client username, and
+// pingInterval indicates how often clients are pinged.  A client that sends
+// nothing (not even a pong) for two ping intervals is disconnected.  Pings
+// are disabled if pingInterval is zero.
+func NewWebSocketHandler(maxMsgSize int, maxNameSize int, pingInterval time.Duration) *webSocketHandler {
+	return &webSocketHandler{
+		maxMsgSize,
+		maxNameSize,
+		pingInterval,
+		nil,
+		0,
+		0,
+		0,
+	}
+}
+
+// SetRateLimit limits each connection to rate messages per second, in
+// bursts of up to burst messages.  Messages over the limit are dropped with
+// a warning, and a client is disconnected when it goes over the limit again
+// after maxViolations warnings (0 only warns).  A rate of 0 disables the
+// limit.
+func (h *webSocketHandler) SetRateLimit(rate float64, burst int, maxViolations int) {
+	if burst < 1 {
+		burst = 1
+	}
+	h.rate = rate
+	h.burst = burst
+	h.maxViolations = maxViolations
+}
+
+// rateLimit is the rate limit state of a connection (see SetRateLimit).
+// bucket is nil if the handler has no rate limit.
+type rateLimit struct {
+	bucket     *ratelimit.Bucket
+	violations int
+}
+
+// newRateLimit returns the rate limit state of a new connection.
+func (h *webSocketHandler) newRateLimit() *rateLimit {
+	var bucket *ratelimit.Bucket
+	if h.rate > 0 {
+		bucket = ratelimit.NewBucket(h.rate, h.burst)
+	}
+	return &rateLimit{bucket, 0}
+}
+
+// limit returns a bool indicating whether a message from the client is
+// within the rate limit.  The client is warned (with a notice, queued
+// through cm) about messages over the limit, and RateLimitErr is returned
+// once it has had too many warnings.
+func (h *webSocketHandler) limit(cm *chat.ChatManager, ws *wsConn, rl *rateLimit) (ok bool, err error) {
+	if rl.bucket == nil {
+		return true, nil
+	}
+	ok, retryAfter := rl.bucket.Allow(time.Now())
+	if ok {
+		return true, nil
+	}
+	rl.violations++
+	if h.maxViolations > 0 && rl.violations > h.maxViolations {
+		return false, RateLimitErr
+	}
+	notify(cm, ws, fmt.Sprintf("Warning: you are sending too fast; wait %s", retryAfter.Round(time.Millisecond)))
+	return false, nil
+}
+
+// notify queues a notice with body for the client through cm, behind the
+// messages that are already queued for it.
+func notify(cm *chat.ChatManager, ws *wsConn, body string) {
+	notice := &chat.Message{Time: chat.Now(), Kind: chat.KindNotice, Body: body}
+	if err := cm.Reply(ws, ws.Format(notice)); err != nil {
+		log.Printf("Error notifying WebSocket client: %s", err)
+	}
+}
+
+// SetAllowedOrigins sets the origins (e.g., "https://example.com") that
+// browsers may open WebSocket connections from, besides the server's own
+// host (see checkOrigin).
+func (h *webSocketHandler) SetAllowedOrigins(origins []string) {
+	h.allowedOrigins = origins
+}
+
+// checkOrigin returns a bool indicating whether a handshake's Origin is
+// allowed: requests without one (i.e., not from a browser) and requests
+// from a page on the server's own host are, and so are requests from the
+// allowed origins.  Otherwise any web page could make its visitors'
+// browsers chat as them.
+func (h *webSocketHandler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range h.allowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// passwordFor returns the password that a handshake gives for name: the
+// password of HTTP basic authentication as name, or else the "password"
+// parameter (browsers can't set headers on WebSocket requests).  The
+// parameter is only accepted over TLS, since URLs are logged and cached
+// in all sorts of places, but a plain-text one would be exposed anyway.
+func passwordFor(r *http.Request, name string) (string, error) {
+	if user, pass, ok := r.BasicAuth(); ok && user == name {
+		return pass, nil
+	}
+	pass := r.FormValue(passwordParam)
+	if pass != "" && r.TLS == nil {
+		return "", errors.New("the password parameter requires TLS; use basic authentication")
+	}
+	return pass, nil
+}
+
+// acceptKey returns the Sec-WebSocket-Accept value for a client's
+// Sec-WebSocket-Key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains returns a bool indicating whether the comma separated
+// header contains token (case insensitively).
+func headerContains(h http.Header, name string, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is a WebSocket connection.  Each Write is sent as a text message.
+// It renders chat messages itself (see chat.ChatManager.Join) with the
+// Formatter that the client asked for.
+type wsConn struct {
+	net.Conn
+	formatter chat.Formatter
+	closed    bool
+	mu        sync.Mutex
+}
+
+// Format renders a chat message for the client.
+func (c *wsConn) Format(m *chat.Message) []byte {
+	return c.formatter.Format(m)
+}
+
+// Transport names the client's transport (see chat.Transporter).
+func (c *wsConn) Transport() string {
+	return "websocket"
+}
+
+// Write sends b, without its trailing newline, as a text message.
+func (c *wsConn) Write(b []byte) (n int, err error) {
+	err = c.writeFrame(opText, bytes.TrimSuffix(b, []byte("\n")))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame writes a frame, giving up after writeTimeout.  Nothing can be
+// written once a close frame has been sent.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ClosedErr
+	}
+	if opcode == opClose {
+		c.closed = true
+	}
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	return writeFrame(c.Conn, opcode, payload)
+}
+
+// sendClose sends a close frame with code and reason.
+func (c *wsConn) sendClose(code int, reason string) {
+	err := c.writeFrame(opClose, closePayload(code, reason))
+	if err != nil && err != ClosedErr {
+		log.Printf("Error sending WebSocket close: %s", err)
+	}
+}
+
+// handshake validates the client's opening handshake.  The HTTP status code
+// to fail with is returned along with any error.
+func handshake(r *http.Request) (code int, err error) {
+	if r.Method != "GET" {
+		return http.StatusMethodNotAllowed, errors.New("WebSocket handshakes must use GET")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		return http.StatusUpgradeRequired, errors.New("Not a WebSocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return http.StatusUpgradeRequired, errors.New("Unsupported WebSocket version")
+	}
+	if r.Header.Get("Sec-WebSocket-Key") == "" {
+		return http.StatusBadRequest, errors.New("Missing Sec-WebSocket-Key")
+	}
+	return http.StatusSwitchingProtocols, nil
+}
+
+// Handle upgrades an HTTP request to a WebSocket connection, joins the
+// client to the ChatManager (cm) and broadcasts every text message from the
+// client until it disconnects.  The client's name, room (the DefaultRoom if
+// empty) and message format ("json" if empty, or "text") are taken from the
+// "name", "room" and "format" request parameters.  A registered name needs
+// its password (see passwordFor).  Handshakes from other origins are refused
+// (see checkOrigin).
+func (h *webSocketHandler) Handle(cm *chat.ChatManager, w http.ResponseWriter, r *http.Request) {
+	code, err := handshake(r)
+	if err != nil {
+		if code == http.StatusUpgradeRequired {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+		} else if code == http.StatusMethodNotAllowed {
+			w.Header().Set("Allow", "GET")
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if !h.checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	name := r.FormValue(nameParam)
+	if name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	} else if len(name) > h.maxNameSize {
+		http.Error(w, "name too long", http.StatusBadRequest)
+		return
+	} else if !chat.ValidName(name) {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+	password, err := passwordFor(r, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = cm.Login(r.RemoteAddr, name, password); err == chat.TooManyLoginsErr {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gochatd"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	roomName := r.FormValue(roomParam)
+	if roomName == "" {
+		roomName = chat.DefaultRoom
+	}
+	format := r.FormValue(formatParam)
+	if format == "" {
+		format = defaultFormat
+	}
+	formatter, ok := chat.FormatterByName(format)
+	if !ok {
+		http.Error(w, "unknown format", http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("Error hijacking WebSocket connection: %s", err)
+		return
+	}
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n",
+		acceptKey(r.Header.Get("Sec-WebSocket-Key")))
+	if err != nil {
+		log.Printf("Error completing WebSocket handshake: %s", err)
+		conn.Close()
+		return
+	}
+	ws := &wsConn{Conn: conn, formatter: formatter}
+	err = cm.Join(roomName, name, ws)
+	if err != nil {
+		ws.sendClose(closePolicy, err.Error())
+		conn.Close()
+		return
+	}
+	done := make(chan struct{})
+	if h.pingInterval > 0 {
+		go h.keepalive(ws, done)
+	}
+	h.readLoop(cm, ws, bufrw.Reader, roomName, name)
+	close(done)
+	cm.Disconnect(ws)
+	conn.Close()
+}
+
+// keepalive pings the client every ping interval until done is closed.
+func (h *webSocketHandler) keepalive(ws *wsConn, done chan struct{}) {
+	ticker := time.NewTicker(h.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := ws.writeFrame(opPing, nil)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLoop reads frames from the client until the connection is closed.
+// Control frames are answered, and fragmented messages are reassembled
+// before being broadcast to roomName (see SetRateLimit).  The client is
+// notified of messages that can't be broadcast (e.g., while it is muted).
+func (h *webSocketHandler) readLoop(cm *chat.ChatManager, ws *wsConn, r *bufio.Reader, roomName string, name string) {
+	var message []byte
+	var messageOp byte
+	rl := h.newRateLimit()
+	for {
+		if h.pingInterval > 0 {
+			ws.SetReadDeadline(time.Now().Add(2 * h.pingInterval))
+		}
+		f, err := readFrame(r, h.maxMsgSize-len(message))
+		if ce, ok := err.(*closeError); ok {
+			ws.sendClose(ce.code, ce.reason)
+			return
+		} else if err != nil {
+			log.Printf("Error reading from WebSocket client %s: %s", name, err)
+			ws.sendClose(closeGoingAway, "")
+			return
+		}
+		switch f.opcode {
+		case opPing:
+			ws.writeFrame(opPong, f.payload)
+			continue
+		case opPong:
+			// The read deadline has already been extended
+			continue
+		case opClose:
+			code, err := parseClosePayload(f.payload)
+			if err != nil {
+				ws.sendClose(closeProtocol, err.Error())
+			} else {
+				ws.sendClose(code, "")
+			}
+			return
+		case opText, opBinary:
+			if message != nil {
+				ws.sendClose(closeProtocol, "expected continuation frame")
+				return
+			}
+			messageOp = f.opcode
+			message = f.payload
+		case opContinuation:
+			if message == nil {
+				ws.sendClose(closeProtocol, "unexpected continuation frame")
+				return
+			}
+			message = append(message, f.payload...)
+		default:
+			ws.sendClose(closeProtocol, "unknown opcode")
+			return
+		}
+		if !f.fin {
+			continue
+		}
+		if messageOp == opBinary {
+			ws.sendClose(closeUnsupported, "binary messages are not supported")
+			return
+		}
+		if !utf8.Valid(message) {
+			ws.sendClose(closeInvalidData, "invalid UTF-8")
+			return
+		}
+		if len(bytes.TrimSpace(message)) > 0 {
+			if ok, err := h.limit(cm, ws, rl); err != nil {
+				log.Printf("Disconnecting WebSocket client %s: %s", name, err)
+				ws.sendClose(closePolicy, err.Error())
+				return
+			} else if ok {
+				_, err = cm.Broadcast(roomName, name, message)
+				if err != nil {
+					notify(cm, ws, fmt.Sprintf("Error: %s", err))
+				}
+			}
+		}
+		message = nil
+	}
+}
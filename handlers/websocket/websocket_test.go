@@ -0,0 +1,444 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+	"github.com/bgmerrell/gochatd/internal/chattest"
+	"github.com/bgmerrell/gochatd/moderation"
+)
+
+const (
+	historySize = 8
+	maxMsgSize  = 512
+	maxNameSize = 32
+	testKey     = "dGhlIHNhbXBsZSBub25jZQ=="
+)
+
+// newTestServer returns a server that handles WebSocket connections for cm.
+func newTestServer(cm *chat.ChatManager, pingInterval time.Duration) *httptest.Server {
+	h := NewWebSocketHandler(maxMsgSize, maxNameSize, pingInterval)
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			h.Handle(cm, w, r)
+		}))
+}
+
+// dial performs the opening handshake with srv and returns the connection.
+func dial(t *testing.T, srv *httptest.Server, query string) (net.Conn, *bufio.Reader) {
+	return dialWith(t, srv, query, "")
+}
+
+// dialWith is dial with extra header lines (each ending in "\r\n").
+func dialWith(t *testing.T, srv *httptest.Server, query string, header string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.WriteString(conn, "GET /ws?"+query+" HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: "+testKey+"\r\n"+
+		"Sec-WebSocket-Version: 13\r\n"+header+"\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Response code = %d, want: %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	// The example from RFC 6455, section 1.3
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Sec-WebSocket-Accept = %s", accept)
+	}
+	return conn, r
+}
+
+// writeClientFrame writes a masked frame, as clients do.
+func writeClientFrame(t *testing.T, w io.Writer, fin bool, opcode byte, payload []byte) {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0, 0x80 | byte(len(payload))}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readServerFrame reads an (unmasked, short) frame sent by the server.
+func readServerFrame(t *testing.T, r *bufio.Reader) (opcode byte, payload []byte) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		ext := make([]byte, 2)
+		io.ReadFull(r, ext)
+		length = int(binary.BigEndian.Uint16(ext))
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+// readMessage reads a text frame and decodes it as a JSON chat message.
+func readMessage(t *testing.T, r *bufio.Reader) *chat.Message {
+	opcode, payload := readServerFrame(t, r)
+	if opcode != opText {
+		t.Fatalf("opcode = %d, want: %d", opcode, opText)
+	}
+	m := &chat.Message{}
+	err := json.Unmarshal(payload, m)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding %s: %s", payload, err)
+	}
+	return m
+}
+
+func TestAcceptKey(t *testing.T) {
+	if key := acceptKey(testKey); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("acceptKey = %s, want: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", key)
+	}
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	srv := newTestServer(cm, 0)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/ws?name=testuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("Response code = %d, want: %d", resp.StatusCode, http.StatusUpgradeRequired)
+	}
+
+	resp, err = http.Post(srv.URL+"/ws?name=testuser", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Response code = %d, want: %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestChat(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	srv := newTestServer(cm, 0)
+	defer srv.Close()
+	conn, r := dial(t, srv, "name=testuser&room=dev")
+	defer conn.Close()
+
+	m := readMessage(t, r)
+	if m.Kind != chat.KindJoin || m.Sender != "testuser" || m.Room != "dev" {
+		t.Errorf("Unexpected message: %+v", m)
+	}
+
+	// A fragmented message is broadcast once it is complete
+	writeClientFrame(t, conn, false, opText, []byte("hello "))
+	writeClientFrame(t, conn, true, opPing, []byte("ping"))
+	writeClientFrame(t, conn, true, opContinuation, []byte("world"))
+	opcode, payload := readServerFrame(t, r)
+	if opcode != opPong || string(payload) != "ping" {
+		t.Errorf("frame = (%d, %s), want a pong", opcode, payload)
+	}
+	m = readMessage(t, r)
+	if m.Kind != chat.KindChat || m.Body != "hello world" {
+		t.Errorf("Unexpected message: %+v", m)
+	}
+	history, _ := cm.History("dev", historySize)
+	if len(history) != 2 || history[1].Body != "hello world" {
+		t.Errorf("Unexpected history: %v", history)
+	}
+
+	writeClientFrame(t, conn, true, opClose, closePayload(closeNormal, ""))
+	opcode, payload = readServerFrame(t, r)
+	if opcode != opClose || binary.BigEndian.Uint16(payload) != closeNormal {
+		t.Errorf("frame = (%d, %v), want a normal close", opcode, payload)
+	}
+	for i := 0; i < 100; i++ {
+		members, _ := cm.Members("dev")
+		if len(members) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected testuser to quit after closing")
+}
+
+func TestTextFormat(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	srv := newTestServer(cm, 0)
+	defer srv.Close()
+	conn, r := dial(t, srv, "name=testuser&format=text")
+	defer conn.Close()
+	_, payload := readServerFrame(t, r)
+	if !strings.HasSuffix(string(payload), "* testuser has joined") {
+		t.Errorf("payload = %s, want a plain-text join", payload)
+	}
+}
+
+func TestDuplicateName(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	srv := newTestServer(cm, 0)
+	defer srv.Close()
+	conn1, r1 := dial(t, srv, "name=testuser")
+	defer conn1.Close()
+	readMessage(t, r1)
+	conn2, r2 := dial(t, srv, "name=testuser")
+	defer conn2.Close()
+	opcode, payload := readServerFrame(t, r2)
+	if opcode != opClose || binary.BigEndian.Uint16(payload) != closePolicy {
+		t.Errorf("frame = (%d, %v), want a policy close", opcode, payload)
+	}
+}
+
+// handshakeStatus sends a handshake for query, with the given extra headers
+// (e.g., Origin), to srv and returns the response code.  Handshakes that
+// succeed are closed right away.
+func handshakeStatus(t *testing.T, srv *httptest.Server, query string, header map[string]string) int {
+	req, err := http.NewRequest("GET", srv.URL+"/ws?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", testKey)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRegisteredName(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	cm.SetAccounts(chattest.MemAccounts{"alice": "secret1"}, false)
+	srv := newTestServer(cm, 0)
+	defer srv.Close()
+
+	wrong := map[string]string{"Authorization": "Basic " +
+		base64.StdEncoding.EncodeToString([]byte("alice:wrong"))}
+	for _, header := range []map[string]string{nil, wrong} {
+		if code := handshakeStatus(t, srv, "name=alice", header); code != http.StatusUnauthorized {
+			t.Errorf("%v response code = %d, want: %d", header, code, http.StatusUnauthorized)
+		}
+	}
+	// The password parameter is refused without TLS, even if it is right
+	if code := handshakeStatus(t, srv, "name=alice&password=secret1", nil); code != http.StatusBadRequest {
+		t.Errorf("Password parameter response code = %d, want: %d", code, http.StatusBadRequest)
+	}
+
+	conn, r := dialWith(t, srv, "name=alice", "Authorization: Basic "+
+		base64.StdEncoding.EncodeToString([]byte("alice:secret1"))+"\r\n")
+	defer conn.Close()
+	if m := readMessage(t, r); m.Kind != chat.KindJoin || m.Sender != "alice" {
+		t.Errorf("Unexpected message: %+v", m)
+	}
+}
+
+func TestPasswordFor(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws?name=alice&password=secret1", nil)
+	if _, err := passwordFor(r, "alice"); err == nil {
+		t.Error("Expected the password parameter to be refused without TLS")
+	}
+	r.TLS = &tls.ConnectionState{}
+	if password, err := passwordFor(r, "alice"); err != nil || password != "secret1" {
+		t.Errorf("passwordFor over TLS = (%q, %v), want: (secret1, nil)", password, err)
+	}
+	// Basic authentication as someone else doesn't count
+	r.SetBasicAuth("bob", "secret2")
+	if password, err := passwordFor(r, "alice"); err != nil || password != "secret1" {
+		t.Errorf("passwordFor = (%q, %v), want: (secret1, nil)", password, err)
+	}
+	r.SetBasicAuth("alice", "secret3")
+	if password, err := passwordFor(r, "alice"); err != nil || password != "secret3" {
+		t.Errorf("passwordFor = (%q, %v), want: (secret3, nil)", password, err)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	h := NewWebSocketHandler(maxMsgSize, maxNameSize, 0)
+	h.SetAllowedOrigins([]string{"https://chat.example.com"})
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			h.Handle(cm, w, r)
+		}))
+	defer srv.Close()
+
+	// srv.URL is a page on the server's own host
+	tests := map[string]int{
+		"https://evil.example.com": http.StatusForbidden,
+		"null":                     http.StatusForbidden,
+		"https://chat.example.com": http.StatusSwitchingProtocols,
+		srv.URL:                    http.StatusSwitchingProtocols,
+	}
+	for origin, expected := range tests {
+		header := map[string]string{"Origin": origin}
+		if code := handshakeStatus(t, srv, "name=testuser", header); code != expected {
+			t.Errorf("Origin %s response code = %d, want: %d", origin, code, expected)
+		}
+	}
+}
+
+func TestInvalidName(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	srv := newTestServer(cm, 0)
+	defer srv.Close()
+	for _, query := range []string{"name=eve%0A12:00+<alice>+hi", "name=eve%1B", "name=eve+smith"} {
+		if code := handshakeStatus(t, srv, query, nil); code != http.StatusBadRequest {
+			t.Errorf("%s response code = %d, want: %d", query, code, http.StatusBadRequest)
+		}
+	}
+	if members, _ := cm.Members(chat.DefaultRoom); len(members) != 0 {
+		t.Errorf("Members = %v, want none", members)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	h := NewWebSocketHandler(maxMsgSize, maxNameSize, 0)
+	// Slow enough that no tokens are gained during the test
+	h.SetRateLimit(0.001, 1, 1)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			h.Handle(cm, w, r)
+		}))
+	defer srv.Close()
+	conn, r := dial(t, srv, "name=testuser")
+	defer conn.Close()
+	readMessage(t, r)
+
+	writeClientFrame(t, conn, true, opText, []byte("one"))
+	if m := readMessage(t, r); m.Kind != chat.KindChat || m.Body != "one" {
+		t.Errorf("Unexpected message: %+v", m)
+	}
+	writeClientFrame(t, conn, true, opText, []byte("two"))
+	if m := readMessage(t, r); m.Kind != chat.KindNotice || !strings.HasPrefix(m.Body, "Warning: you are sending too fast") {
+		t.Errorf("Message = %+v, want a warning", m)
+	}
+	writeClientFrame(t, conn, true, opText, []byte("three"))
+	opcode, payload := readServerFrame(t, r)
+	if opcode != opClose || binary.BigEndian.Uint16(payload) != closePolicy {
+		t.Errorf("frame = (%d, %v), want a policy close", opcode, payload)
+	}
+	history, _ := cm.History(chat.DefaultRoom, historySize)
+	for _, m := range history {
+		if m.Body == "two" || m.Body == "three" {
+			t.Errorf("Expected %q not to be broadcast", m.Body)
+		}
+	}
+}
+
+func TestMuted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gochatd-moderation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mod, err := moderation.Open(filepath.Join(dir, "moderation.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := chat.NewChatManager(nil, historySize)
+	cm.SetAccounts(chattest.MemAccounts{"alice": "secret1"}, false)
+	cm.SetOperators([]string{"alice"})
+	cm.SetModeration(mod)
+	srv := newTestServer(cm, 0)
+	defer srv.Close()
+	conn, r := dial(t, srv, "name=testuser")
+	defer conn.Close()
+	readMessage(t, r)
+	if _, err = cm.Mute("alice", "testuser", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if m := readMessage(t, r); m.Kind != chat.KindNotice || !strings.HasPrefix(m.Body, "You have been muted") {
+		t.Errorf("Message = %+v, want a mute notice", m)
+	}
+
+	writeClientFrame(t, conn, true, opText, []byte("hello"))
+	if m := readMessage(t, r); m.Kind != chat.KindNotice || !strings.HasPrefix(m.Body, "Error: Muted") {
+		t.Errorf("Message = %+v, want an error notice", m)
+	}
+	history, _ := cm.History(chat.DefaultRoom, historySize)
+	for _, m := range history {
+		if m.Body == "hello" {
+			t.Error("Expected a muted message not to be broadcast")
+		}
+	}
+}
+
+func TestUnmaskedFrame(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	srv := newTestServer(cm, 0)
+	defer srv.Close()
+	conn, r := dial(t, srv, "name=testuser")
+	defer conn.Close()
+	readMessage(t, r)
+	conn.Write([]byte{0x80 | opText, 2, 'h', 'i'})
+	opcode, payload := readServerFrame(t, r)
+	if opcode != opClose || binary.BigEndian.Uint16(payload) != closeProtocol {
+		t.Errorf("frame = (%d, %v), want a protocol error close", opcode, payload)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	cm := chat.NewChatManager(nil, historySize)
+	srv := newTestServer(cm, 20*time.Millisecond)
+	defer srv.Close()
+	conn, r := dial(t, srv, "name=testuser")
+	defer conn.Close()
+	readMessage(t, r)
+	opcode, _ := readServerFrame(t, r)
+	if opcode != opPing {
+		t.Fatalf("opcode = %d, want: %d", opcode, opPing)
+	}
+	// Never answering makes the server give up on the client
+	for {
+		opcode, payload := readServerFrame(t, r)
+		if opcode == opClose {
+			if binary.BigEndian.Uint16(payload) != closeGoingAway {
+				t.Errorf("close payload = %v, want going away", payload)
+			}
+			return
+		}
+	}
+}
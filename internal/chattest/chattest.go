@@ -0,0 +1,88 @@
+// Package chattest provides in-memory implementations of chat.Accounts and
+// chat.Tokens for unit tests.
+package chattest
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+// MemAccounts is an in-memory chat.Accounts that maps registered names to
+// plain-text passwords.
+type MemAccounts map[string]string
+
+// Registered returns a bool indicating whether name is registered.
+func (m MemAccounts) Registered(name string) bool {
+	_, ok := m[name]
+	return ok
+}
+
+// Authenticate returns a bool indicating whether password is the password
+// of the registered name.
+func (m MemAccounts) Authenticate(name string, password string) bool {
+	p, ok := m[name]
+	return ok && p == password
+}
+
+// Register registers name with a password.
+func (m MemAccounts) Register(name string, password string) error {
+	m[name] = password
+	return nil
+}
+
+// SetPassword changes the password of a registered name.
+func (m MemAccounts) SetPassword(name string, oldPassword string, newPassword string) error {
+	if !m.Authenticate(name, oldPassword) {
+		return errors.New("Wrong password")
+	}
+	m[name] = newPassword
+	return nil
+}
+
+// MemGrant is what a MemTokens token allows.
+type MemGrant struct {
+	Name  string
+	Perms []chat.Permission
+}
+
+// MemTokens is an in-memory chat.Tokens that maps tokens to what they allow.  A
+// name's nth token is "{name}-{n}".
+type MemTokens map[string]MemGrant
+
+// count returns the number of name's tokens.
+func (m MemTokens) count(name string) int {
+	n := 0
+	for _, g := range m {
+		if g.Name == name {
+			n++
+		}
+	}
+	return n
+}
+
+// Issue returns a new token for name with the given permissions.
+func (m MemTokens) Issue(name string, perms []chat.Permission) (string, error) {
+	token := fmt.Sprintf("%s-%d", name, m.count(name)+1)
+	m[token] = MemGrant{name, perms}
+	return token, nil
+}
+
+// Lookup returns the name and permissions of a token.
+func (m MemTokens) Lookup(token string) (string, []chat.Permission, bool) {
+	g, ok := m[token]
+	return g.Name, g.Perms, ok
+}
+
+// Revoke revokes all of name's tokens and returns how many there were.
+func (m MemTokens) Revoke(name string) (int, error) {
+	n := 0
+	for token, g := range m {
+		if g.Name == name {
+			delete(m, token)
+			n++
+		}
+	}
+	return n, nil
+}
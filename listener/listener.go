@@ -0,0 +1,141 @@
+// Package listener wraps a net.Listener with connection limits.
+//
+// A Listener caps the number of open connections, both in total and per
+// client IP.  Connections over a limit are told so and closed instead of
+// being returned by Accept.  Temporary accept errors (e.g., running out of
+// file descriptors) are retried with exponential backoff rather than being
+// returned.
+package listener
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	minBackoff = 5 * time.Millisecond
+	maxBackoff = time.Second
+	// rejectTimeout bounds the time spent telling a client that it is
+	// over a limit.
+	rejectTimeout = time.Second
+)
+
+const (
+	ServerFullMsg = "Server full; please try again later\n"
+	IPFullMsg     = "Too many connections from your address; please try again later\n"
+)
+
+// sleep is time.Sleep; tests replace it.
+var sleep = time.Sleep
+
+// temporary is implemented by errors that may go away on their own.
+type temporary interface {
+	Temporary() bool
+}
+
+// Listener is a net.Listener with connection limits.
+type Listener struct {
+	net.Listener
+	maxConns      int
+	maxConnsPerIP int
+	conns         int
+	perIP         map[string]int
+	mu            sync.Mutex
+}
+
+// New returns a Listener that accepts connections from ln.  maxConns limits
+// the number of open connections and maxConnsPerIP the number of open
+// connections from a single IP; 0 means no limit.
+func New(ln net.Listener, maxConns int, maxConnsPerIP int) *Listener {
+	return &Listener{ln, maxConns, maxConnsPerIP, 0, map[string]int{}, sync.Mutex{}}
+}
+
+// hostOf returns the IP address of a remote address.
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Accept waits for and returns the next connection that is within the
+// limits.  The connection's slot is released when it is closed.
+func (l *Listener) Accept() (net.Conn, error) {
+	backoff := time.Duration(0)
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if te, ok := err.(temporary); ok && te.Temporary() {
+				if backoff == 0 {
+					backoff = minBackoff
+				} else if backoff *= 2; backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				log.Printf("Accept error: %s; retrying in %s", err, backoff)
+				sleep(backoff)
+				continue
+			}
+			return nil, err
+		}
+		backoff = 0
+		ip := hostOf(conn.RemoteAddr())
+		if msg := l.acquire(ip); msg != "" {
+			log.Printf("Rejecting connection from %s: %s", conn.RemoteAddr(), msg)
+			go reject(conn, msg)
+			continue
+		}
+		return &limitedConn{conn, l, ip, sync.Once{}}, nil
+	}
+}
+
+// acquire takes a connection slot for ip.  If a limit has been reached, it
+// returns the message for the client instead.
+func (l *Listener) acquire(ip string) (msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxConns > 0 && l.conns >= l.maxConns {
+		return ServerFullMsg
+	}
+	if l.maxConnsPerIP > 0 && l.perIP[ip] >= l.maxConnsPerIP {
+		return IPFullMsg
+	}
+	l.conns++
+	l.perIP[ip]++
+	return ""
+}
+
+// release gives back a connection slot of ip.
+func (l *Listener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// reject writes msg to a connection and closes it.
+func reject(conn net.Conn, msg string) {
+	_ = conn.SetWriteDeadline(time.Now().Add(rejectTimeout))
+	_, _ = conn.Write([]byte(msg))
+	conn.Close()
+}
+
+// limitedConn is a connection that holds a slot of its Listener.
+type limitedConn struct {
+	net.Conn
+	l    *Listener
+	ip   string
+	once sync.Once
+}
+
+// Close closes the connection and releases its slot.  Close can be called
+// multiple times.
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.l.release(c.ip) })
+	return err
+}
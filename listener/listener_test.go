@@ -0,0 +1,130 @@
+package listener
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// accepted is the result of a fakeListener Accept.
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+// fakeListener returns the connections and errors sent on its channel.
+type fakeListener chan accepted
+
+func (f fakeListener) Accept() (net.Conn, error) {
+	a, ok := <-f
+	if !ok {
+		return nil, errors.New("closed")
+	}
+	return a.conn, a.err
+}
+
+func (f fakeListener) Close() error   { return nil }
+func (f fakeListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+// remoteConn is a connection with a given remote address.
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.addr }
+
+// dial returns the server side of a new connection from ip and the client
+// side.
+func dial(ip string) (net.Conn, net.Conn) {
+	server, client := net.Pipe()
+	return remoteConn{server, &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}}, client
+}
+
+// tempErr is a temporary accept error.
+type tempErr struct{}
+
+func (tempErr) Error() string   { return "temporary" }
+func (tempErr) Temporary() bool { return true }
+
+// expectRejected checks that client is sent msg and closed.
+func expectRejected(t *testing.T, client net.Conn, msg string) {
+	got, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != msg {
+		t.Errorf("Rejected client read %q, want: %q", got, msg)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	f := make(fakeListener, 8)
+	l := New(f, 3, 2)
+
+	server1, _ := dial("192.0.2.1")
+	server2, _ := dial("192.0.2.1")
+	server3, client3 := dial("192.0.2.1")
+	server4, _ := dial("192.0.2.2")
+	f <- accepted{server1, nil}
+	f <- accepted{server2, nil}
+	f <- accepted{server3, nil}
+	f <- accepted{server4, nil}
+	conn1, _ := l.Accept()
+	l.Accept()
+	// The third connection from 192.0.2.1 is rejected
+	conn4, err := l.Accept()
+	if err != nil || conn4.RemoteAddr().String() != "192.0.2.2:1234" {
+		t.Fatalf("Accept = (%v, %v), want the connection from 192.0.2.2", conn4, err)
+	}
+	expectRejected(t, client3, IPFullMsg)
+
+	server5, client5 := dial("192.0.2.3")
+	f <- accepted{server5, nil}
+	// The server is full until a connection is closed
+	go func() {
+		expectRejected(t, client5, ServerFullMsg)
+		conn1.Close()
+		conn1.Close()
+		server6, _ := dial("192.0.2.3")
+		f <- accepted{server6, nil}
+	}()
+	conn6, err := l.Accept()
+	if err != nil || conn6.RemoteAddr().String() != "192.0.2.3:1234" {
+		t.Fatalf("Accept = (%v, %v), want the connection from 192.0.2.3", conn6, err)
+	}
+	if l.conns != 3 || l.perIP["192.0.2.1"] != 1 {
+		t.Errorf("conns = %d and %d from 192.0.2.1, want: 3 and 1", l.conns, l.perIP["192.0.2.1"])
+	}
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	defer func() { sleep = time.Sleep }()
+
+	f := make(fakeListener, 16)
+	for i := 0; i < 9; i++ {
+		f <- accepted{nil, tempErr{}}
+	}
+	server, _ := dial("192.0.2.1")
+	f <- accepted{server, nil}
+	f <- accepted{nil, tempErr{}}
+	f <- accepted{nil, errors.New("fatal")}
+	l := New(f, 0, 0)
+	if _, err := l.Accept(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := l.Accept(); err == nil || err.Error() != "fatal" {
+		t.Errorf("Accept error = %v, want: fatal", err)
+	}
+	ms := time.Millisecond
+	expected := []time.Duration{5 * ms, 10 * ms, 20 * ms, 40 * ms, 80 * ms,
+		160 * ms, 320 * ms, 640 * ms, time.Second, 5 * ms}
+	if !reflect.DeepEqual(slept, expected) {
+		t.Errorf("Backoffs = %v, want: %v", slept, expected)
+	}
+}
@@ -0,0 +1,182 @@
+// Package moderation keeps the bans, mutes and granted operators of the chat
+// in a JSON file.
+package moderation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+var _ chat.Moderation = (*Moderation)(nil)
+
+// state is the contents of the moderation file.
+type state struct {
+	Operators []string         `json:"operators"`
+	Sanctions []*chat.Sanction `json:"sanctions"`
+}
+
+// Moderation is a set of sanctions and operators backed by a file.
+type Moderation struct {
+	path      string
+	operators map[string]bool
+	sanctions []*chat.Sanction
+	mu        sync.Mutex
+}
+
+// Open loads the moderation file at path.  A missing file holds nothing; it
+// is created on the first change.
+func Open(path string) (*Moderation, error) {
+	m := &Moderation{path, map[string]bool{}, []*chat.Sanction{}, sync.Mutex{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	st := state{}
+	if err = json.Unmarshal(data, &st); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid moderation file %s: %s", path, err))
+	}
+	for _, name := range st.Operators {
+		m.operators[name] = true
+	}
+	if st.Sanctions != nil {
+		m.sanctions = st.Sanctions
+	}
+	return m, nil
+}
+
+// save writes the moderation file, leaving out expired sanctions.  The file
+// is replaced atomically so that a crash can't leave it half written.
+func (m *Moderation) save() error {
+	st := state{[]string{}, []*chat.Sanction{}}
+	for name := range m.operators {
+		st.Operators = append(st.Operators, name)
+	}
+	sort.Strings(st.Operators)
+	now := chat.Now()
+	for _, s := range m.sanctions {
+		if s.Expires.IsZero() || now.Before(s.Expires) {
+			st.Sanctions = append(st.Sanctions, s)
+		}
+	}
+	data, err := json.MarshalIndent(st, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(m.path), ".moderation")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), m.path); err != nil {
+		return err
+	}
+	m.sanctions = st.Sanctions
+	return nil
+}
+
+// IsOperator returns a bool indicating whether name has been made an
+// operator.
+func (m *Moderation) IsOperator(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.operators[name]
+}
+
+// Operators returns the sorted names that have been made operators.
+func (m *Moderation) Operators() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.operators))
+	for name := range m.operators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AddOperator makes name an operator.
+func (m *Moderation) AddOperator(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.operators[name] {
+		return nil
+	}
+	m.operators[name] = true
+	if err := m.save(); err != nil {
+		delete(m.operators, name)
+		return err
+	}
+	return nil
+}
+
+// Sanctions returns the sanctions, including any that have expired since
+// the file was last written.
+func (m *Moderation) Sanctions() []*chat.Sanction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*chat.Sanction{}, m.sanctions...)
+}
+
+// find returns the index of the sanction of a kind against target, or -1.
+func (m *Moderation) find(kind chat.SanctionKind, target string) int {
+	for i, s := range m.sanctions {
+		if s.Kind == kind && s.Target == target {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddSanction adds a sanction, replacing any sanction of the same kind
+// against the same target.
+func (m *Moderation) AddSanction(s *chat.Sanction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old := m.sanctions
+	m.sanctions = append([]*chat.Sanction{}, old...)
+	if i := m.find(s.Kind, s.Target); i >= 0 {
+		m.sanctions[i] = s
+	} else {
+		m.sanctions = append(m.sanctions, s)
+	}
+	if err := m.save(); err != nil {
+		m.sanctions = old
+		return err
+	}
+	return nil
+}
+
+// RemoveSanction removes the sanction of a kind against target and returns a
+// bool indicating whether there was one.
+func (m *Moderation) RemoveSanction(kind chat.SanctionKind, target string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.find(kind, target)
+	if i < 0 {
+		return false, nil
+	}
+	old := m.sanctions
+	m.sanctions = append(append([]*chat.Sanction{}, old[:i]...), old[i+1:]...)
+	if err := m.save(); err != nil {
+		m.sanctions = old
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,98 @@
+package moderation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+// tempPath returns the path of a moderation file in a new temporary
+// directory and a function that removes the directory.
+func tempPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gochatd-moderation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "moderation.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestOperators(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+	m, err := Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if m.IsOperator("alice") {
+		t.Error("Expected alice not to be an operator yet")
+	}
+	for _, name := range []string{"bob", "alice", "bob"} {
+		if err = m.AddOperator(name); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	m, err = Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !m.IsOperator("alice") {
+		t.Error("Expected alice to be an operator after reopening")
+	}
+	if ops := m.Operators(); !reflect.DeepEqual(ops, []string{"alice", "bob"}) {
+		t.Errorf("Operators = %v, want: [alice bob]", ops)
+	}
+}
+
+func TestSanctions(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+	m, err := Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	now := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+	chat.Now = func() time.Time { return now }
+	defer func() { chat.Now = time.Now }()
+	ban := &chat.Sanction{Kind: chat.SanctionBan, Target: "10.0.0.0/8", By: "alice", Created: now}
+	mute := &chat.Sanction{Kind: chat.SanctionMute, Target: "bob", By: "alice", Created: now,
+		Expires: now.Add(time.Hour)}
+	for _, s := range []*chat.Sanction{ban, mute} {
+		if err = m.AddSanction(s); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	// Banning the same target again replaces the ban
+	ban.Reason = "spam"
+	if err = m.AddSanction(ban); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	m, err = Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	got := m.Sanctions()
+	if len(got) != 2 || !reflect.DeepEqual(*got[0], *ban) || !reflect.DeepEqual(*got[1], *mute) {
+		t.Errorf("Sanctions = %v, want: [%v %v]", got, ban, mute)
+	}
+	if ok, err := m.RemoveSanction(chat.SanctionMute, "10.0.0.0/8"); ok || err != nil {
+		t.Errorf("RemoveSanction(mute of a banned target) = (%t, %v), want: (false, nil)", ok, err)
+	}
+	if ok, err := m.RemoveSanction(chat.SanctionBan, "10.0.0.0/8"); !ok || err != nil {
+		t.Errorf("RemoveSanction(ban) = (%t, %v), want: (true, nil)", ok, err)
+	}
+
+	// Expired sanctions are dropped when the file is written
+	now = now.Add(2 * time.Hour)
+	if err = m.AddOperator("alice"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got = m.Sanctions(); len(got) != 0 {
+		t.Errorf("Sanctions = %v, want none", got)
+	}
+}
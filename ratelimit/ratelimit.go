@@ -0,0 +1,142 @@
+// Package ratelimit implements token-bucket rate limiting.
+//
+// A Bucket holds up to burst tokens and gains rate tokens per second; every
+// event takes a token, and events that find the bucket empty are over the
+// limit.  A Limiter keeps a Bucket per key (e.g., per client IP).
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// minPrune is the number of buckets a Limiter holds before it first drops
+// idle ones.
+const minPrune = 1024
+
+// Bucket is a token bucket.  The zero Bucket is unusable; see NewBucket.
+type Bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket that gains rate tokens per second, up to
+// burst tokens.
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{rate, float64(burst), float64(burst), time.Time{}}
+}
+
+// fill adds the tokens gained since the bucket was last used.
+func (b *Bucket) fill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	if b.last.IsZero() || now.After(b.last) {
+		b.last = now
+	}
+}
+
+// Allow takes a token at time now.  If the bucket is empty, it returns false
+// and how long it will take for a token to become available.
+func (b *Bucket) Allow(now time.Time) (ok bool, retryAfter time.Duration) {
+	b.fill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Peek is Allow without taking a token: it returns whether an event at time
+// now would be within the limit.
+func (b *Bucket) Peek(now time.Time) (ok bool, retryAfter time.Duration) {
+	b.fill(now)
+	if b.tokens >= 1 {
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full returns a bool indicating whether the bucket is full at time now,
+// i.e., whether it would make no difference to replace it with a new one.
+func (b *Bucket) full(now time.Time) bool {
+	b.fill(now)
+	return b.tokens >= b.burst
+}
+
+// Limiter rate limits events per key.  A nil Limiter allows everything.
+type Limiter struct {
+	rate    float64
+	burst   int
+	buckets map[string]*Bucket
+	pruneAt int
+	mu      sync.Mutex
+}
+
+// NewLimiter returns a Limiter that allows rate events per second per key,
+// in bursts of up to burst events.  A rate of 0 disables rate limiting (the
+// returned Limiter is nil).
+func NewLimiter(rate float64, burst int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{rate, burst, map[string]*Bucket{}, minPrune, sync.Mutex{}}
+}
+
+// Allow records an event for key at time now.  If key is over the limit, it
+// returns false and how long it will take for another event to be allowed.
+func (l *Limiter) Allow(key string, now time.Time) (ok bool, retryAfter time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= l.pruneAt {
+			l.prune(now)
+		}
+		b = NewBucket(l.rate, l.burst)
+		l.buckets[key] = b
+	}
+	return b.Allow(now)
+}
+
+// Peek is Allow without recording the event: it returns whether an event
+// for key at time now would be within the limit.  This allows counting only
+// some events (e.g., failures) against keys that are checked for all of
+// them.
+func (l *Limiter) Peek(key string, now time.Time) (ok bool, retryAfter time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		return true, 0
+	}
+	return b.Peek(now)
+}
+
+// prune drops the buckets of keys that have been idle long enough for their
+// buckets to be full again.
+func (l *Limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+	l.pruneAt = 2 * len(l.buckets)
+	if l.pruneAt < minPrune {
+		l.pruneAt = minPrune
+	}
+}
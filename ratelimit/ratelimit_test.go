@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+
+func TestBucket(t *testing.T) {
+	b := NewBucket(2, 3)
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.Allow(start); !ok {
+			t.Fatalf("Event %d of the burst was refused", i)
+		}
+	}
+	ok, retryAfter := b.Allow(start)
+	if ok || retryAfter != 500*time.Millisecond {
+		t.Errorf("Allow after the burst = (%t, %s), want: (false, 500ms)", ok, retryAfter)
+	}
+	if ok, _ = b.Allow(start.Add(500 * time.Millisecond)); !ok {
+		t.Error("Expected a token after 500ms")
+	}
+	// A long pause only refills up to the burst
+	now := start.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		b.Allow(now)
+	}
+	if ok, _ = b.Allow(now); ok {
+		t.Error("Expected the bucket to hold no more than the burst")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(1, 1)
+	if ok, _ := l.Allow("a", start); !ok {
+		t.Error("Expected the first event of a to be allowed")
+	}
+	if ok, _ := l.Allow("a", start); ok {
+		t.Error("Expected the second event of a to be refused")
+	}
+	if ok, _ := l.Allow("b", start); !ok {
+		t.Error("Expected the first event of b to be allowed")
+	}
+	// Peeking doesn't record anything
+	if ok, retryAfter := l.Peek("a", start); ok || retryAfter != time.Second {
+		t.Errorf("Peek(a) = (%t, %s), want: (false, 1s)", ok, retryAfter)
+	}
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Peek("c", start); !ok {
+			t.Error("Expected peeking at c to allow an event")
+		}
+	}
+	if ok, _ := l.Allow("c", start); !ok {
+		t.Error("Expected the first event of c to be allowed")
+	}
+
+	l = NewLimiter(1, 1)
+	for i := 0; i < minPrune; i++ {
+		l.Allow(fmt.Sprint(i), start)
+	}
+	// All of the buckets are full again a second later, so they're pruned
+	l.Allow("c", start.Add(time.Second))
+	if len(l.buckets) != 1 {
+		t.Errorf("len(buckets) = %d, want: 1", len(l.buckets))
+	}
+
+	disabled := NewLimiter(0, 0)
+	if ok, _ := disabled.Allow("a", start); !ok {
+		t.Error("Expected a disabled Limiter to allow everything")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+// reloadable holds the (JSON names of the) settings that reloadConfig can
+// change without a restart.
+var reloadable = map[string]bool{
+	"log_path":                      true,
+	"max_name_length":               true,
+	"msg_buffer_size":               true,
+	"max_line_length":               true,
+	"max_history_lines":             true,
+	"log_whispers":                  true,
+	"log_format":                    true,
+	"operators":                     true,
+	"websocket_allowed_origins":     true,
+	"raw_rate_limit":                true,
+	"raw_rate_burst":                true,
+	"raw_rate_max_violations":       true,
+	"websocket_rate_limit":          true,
+	"websocket_rate_burst":          true,
+	"websocket_rate_max_violations": true,
+	"raw_login_timeout":             true,
+	"raw_idle_timeout":              true,
+	"raw_idle_warning":              true,
+	"shutdown_notice":               true,
+	"shutdown_grace_period":         true,
+}
+
+// openLog opens (or creates) the chat log for appending.
+func openLog(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+}
+
+// closeLog flushes and closes the chat log.
+func closeLog(f *os.File) {
+	if err := f.Sync(); err != nil {
+		log.Printf("Failed to flush chat log: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Printf("Failed to close chat log: %s", err)
+	}
+}
+
+// reloadConfig re-reads the configuration (on SIGHUP; see loadConfig for
+// the environment and flag overrides, which still apply) and applies the
+// reloadable settings: the chat log is reopened (so that it can be rotated),
+// the history of every room is resized, and the limits in live are updated
+// for new connections and requests.  Changes to other settings are reported
+// and ignored.  If the file is invalid, nothing changes.  The chat log that
+// is in use afterwards is returned.
+func reloadConfig(cm *chat.ChatManager, live *atomic.Value, chatLogFile *os.File) *os.File {
+	log.Printf("Reloading %s", confPath)
+	newCfg, err := loadConfig(confPath, flagOverrides)
+	if err != nil {
+		log.Printf("Not reloading: %s", err)
+		return chatLogFile
+	}
+	old := live.Load().(*config)
+	cfg, restart := old.merge(newCfg)
+	for _, name := range restart {
+		log.Printf("Changing %s requires a restart; keeping the current value", name)
+	}
+	newLogFile, err := openLog(cfg.LogPath)
+	if err != nil {
+		log.Printf("Failed to reopen chat log (keeping %s): %s", old.LogPath, err)
+		cfg.LogPath = old.LogPath
+	} else {
+		cm.SetChatLog(newLogFile)
+		closeLog(chatLogFile)
+		chatLogFile = newLogFile
+	}
+	cm.SetLogWhispers(cfg.LogWhispers)
+	cm.SetOperators(cfg.Operators)
+	logFormatter, _ := chat.FormatterByName(cfg.LogFormat)
+	cm.SetLogFormatter(logFormatter)
+	if cfg.MaxHistoryLines != old.MaxHistoryLines {
+		cm.SetMaxHistoryLines(cfg.MaxHistoryLines)
+	}
+	live.Store(cfg)
+	log.Printf("Reloaded %s", confPath)
+	return chatLogFile
+}
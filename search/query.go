@@ -0,0 +1,159 @@
+package search
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+// dateLayout is accepted by the "since:" and "until:" operators in addition
+// to RFC 3339 timestamps.
+const dateLayout = "2006-01-02"
+
+// Query is a parsed search query.  A message matches if it contains all of
+// the words and phrases and passes the filters.
+type Query struct {
+	Words   []string
+	Phrases [][]string
+	Sender  string
+	Since   time.Time // inclusive; zero means no lower bound
+	Until   time.Time // exclusive; zero means no upper bound
+}
+
+// tokenize splits text into lowercase words.  Anything that isn't a letter
+// or a digit separates words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// parseTime parses the value of a "since:" or "until:" operator.  A date
+// given to "until:" includes the whole day.
+func parseTime(op string, val string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, val); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(dateLayout, val)
+	if err != nil {
+		return t, &chat.QueryError{Reason: "bad time for " + op + " (use YYYY-MM-DD or RFC 3339)"}
+	}
+	if op == "until" {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// splitQuery splits a query into terms.  Double-quoted phrases are single
+// terms (including their quotes).
+func splitQuery(s string) ([]string, error) {
+	terms := []string{}
+	for {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return terms, nil
+		}
+		end := strings.IndexFunc(s, unicode.IsSpace)
+		if s[0] == '"' {
+			closing := strings.IndexByte(s[1:], '"')
+			if closing < 0 {
+				return nil, &chat.QueryError{Reason: "unterminated phrase"}
+			}
+			end = closing + 2
+		} else if end < 0 {
+			end = len(s)
+		}
+		terms = append(terms, s[:end])
+		s = s[end:]
+	}
+}
+
+// ParseQuery parses a search query.  A query is made of words, "quoted
+// phrases", and the filters from:<sender>, since:<time> and until:<time>,
+// where a time is a date (YYYY-MM-DD) or an RFC 3339 timestamp.  Words and
+// phrases are matched case-insensitively.
+func ParseQuery(s string) (*Query, error) {
+	terms, err := splitQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	q := &Query{}
+	for _, term := range terms {
+		if term[0] == '"' {
+			if phrase := tokenize(term); len(phrase) > 0 {
+				q.Phrases = append(q.Phrases, phrase)
+			}
+			continue
+		}
+		op, val := "", term
+		if i := strings.IndexByte(term, ':'); i > 0 {
+			op, val = term[:i], term[i+1:]
+		}
+		switch op {
+		case "from":
+			q.Sender = val
+		case "since":
+			q.Since, err = parseTime(op, val)
+		case "until":
+			q.Until, err = parseTime(op, val)
+		default:
+			q.Words = append(q.Words, tokenize(term)...)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(q.Words) == 0 && len(q.Phrases) == 0 && q.Sender == "" &&
+		q.Since.IsZero() && q.Until.IsZero() {
+		return nil, &chat.QueryError{Reason: "empty query"}
+	}
+	return q, nil
+}
+
+// containsPhrase returns a bool indicating whether phrase occurs in words.
+func containsPhrase(words []string, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		match := true
+		for j, w := range phrase {
+			if words[i+j] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns a bool indicating whether a message matches the query.
+func (q *Query) Match(m *chat.Message) bool {
+	if q.Sender != "" && m.Sender != q.Sender {
+		return false
+	}
+	if !q.Since.IsZero() && m.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !m.Time.Before(q.Until) {
+		return false
+	}
+	words := tokenize(m.Body)
+	present := map[string]bool{}
+	for _, w := range words {
+		present[w] = true
+	}
+	for _, w := range q.Words {
+		if !present[w] {
+			return false
+		}
+	}
+	for _, phrase := range q.Phrases {
+		if !containsPhrase(words, phrase) {
+			return false
+		}
+	}
+	return true
+}
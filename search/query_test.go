@@ -0,0 +1,81 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+func TestTokenize(t *testing.T) {
+	words := tokenize("Hello, World!  It's 3pm")
+	expected := []string{"hello", "world", "it", "s", "3pm"}
+	if !reflect.DeepEqual(words, expected) {
+		t.Errorf("tokenize = %v, want: %v", words, expected)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	q, err := ParseQuery(`deploy "Build Failed" from:alice since:2006-01-02 until:2006-01-03T10:00:00Z`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := &Query{
+		Words:   []string{"deploy"},
+		Phrases: [][]string{{"build", "failed"}},
+		Sender:  "alice",
+		Since:   time.Date(2006, time.January, 2, 0, 0, 0, 0, time.UTC),
+		Until:   time.Date(2006, time.January, 3, 10, 0, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(q, expected) {
+		t.Errorf("ParseQuery = %+v, want: %+v", q, expected)
+	}
+
+	q, err = ParseQuery("until:2006-01-02")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !q.Until.Equal(time.Date(2006, time.January, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("until:2006-01-02 = %s, want the end of the day", q.Until)
+	}
+
+	for _, bad := range []string{"", "  ", `"unterminated`, "since:yesterday", `""`} {
+		_, err := ParseQuery(bad)
+		if _, ok := err.(*chat.QueryError); !ok {
+			t.Errorf("ParseQuery(%q) error = %v, want a QueryError", bad, err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	m := &chat.Message{
+		Sender: "alice",
+		Time:   time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC),
+		Body:   "The build failed again",
+	}
+	tests := map[string]bool{
+		"build":                       true,
+		"BUILD again":                 true,
+		"build passed":                false,
+		`"build failed"`:              true,
+		`"failed build"`:              false,
+		"from:alice build":            true,
+		"from:bob build":              false,
+		"since:2006-01-02":            true,
+		"since:2006-01-03":            false,
+		"until:2006-01-02":            true,
+		"until:2006-01-02T15:04:05Z":  false,
+		"until:2006-01-02T15:04:06Z":  true,
+		"since:2006-01-02T15:04:05Z ": true,
+	}
+	for query, expected := range tests {
+		q, err := ParseQuery(query)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if q.Match(m) != expected {
+			t.Errorf("%q matched = %t, want: %t", query, !expected, expected)
+		}
+	}
+}
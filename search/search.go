@@ -0,0 +1,146 @@
+// Package search provides an in-memory inverted index of chat messages for
+// full-text search.
+package search
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+var _ chat.Index = (*Index)(nil)
+
+// Index is an inverted index of the newest room messages.  Only chat
+// messages and actions are indexed; join, quit and nick announcements are
+// not.
+type Index struct {
+	maxMessages int
+	msgs        []*chat.Message     // oldest first
+	postings    map[string][]uint64 // word -> IDs of messages with the word
+	byID        map[uint64]*chat.Message
+	mu          sync.Mutex
+}
+
+// New returns an empty Index that holds up to maxMessages messages.  Once
+// it is full, the oldest messages are dropped as new ones are added.
+func New(maxMessages int) *Index {
+	return &Index{
+		maxMessages,
+		[]*chat.Message{},
+		map[string][]uint64{},
+		map[uint64]*chat.Message{},
+		sync.Mutex{}}
+}
+
+// uniqueWords returns the distinct words of a message's body.
+func uniqueWords(m *chat.Message) []string {
+	seen := map[string]bool{}
+	words := []string{}
+	for _, w := range tokenize(m.Body) {
+		if !seen[w] {
+			seen[w] = true
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+// Add indexes a message.  Messages must be added in ID order.
+func (idx *Index) Add(m *chat.Message) {
+	if m.Kind != chat.KindChat && m.Kind != chat.KindAction {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if len(idx.msgs) > 0 && m.ID <= idx.msgs[len(idx.msgs)-1].ID {
+		return
+	}
+	idx.msgs = append(idx.msgs, m)
+	idx.byID[m.ID] = m
+	for _, w := range uniqueWords(m) {
+		idx.postings[w] = append(idx.postings[w], m.ID)
+	}
+	if len(idx.msgs) > idx.maxMessages {
+		idx.evictOldest()
+	}
+}
+
+// evictOldest drops the oldest message from the index.  Being the oldest,
+// its ID leads the posting list of each of its words.
+func (idx *Index) evictOldest() {
+	oldest := idx.msgs[0]
+	idx.msgs[0] = nil
+	idx.msgs = idx.msgs[1:]
+	delete(idx.byID, oldest.ID)
+	for _, w := range uniqueWords(oldest) {
+		ids := idx.postings[w][1:]
+		if len(ids) == 0 {
+			delete(idx.postings, w)
+		} else {
+			idx.postings[w] = ids
+		}
+	}
+}
+
+// intersect returns the IDs present in both sorted lists a and b.
+func intersect(a []uint64, b []uint64) []uint64 {
+	out := []uint64{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		if a[i] < b[j] {
+			i++
+		} else if a[i] > b[j] {
+			j++
+		} else {
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// candidates returns the messages that contain all of the query's words
+// (including the words of its phrases), oldest first.
+func (idx *Index) candidates(q *Query) []*chat.Message {
+	words := append([]string{}, q.Words...)
+	for _, phrase := range q.Phrases {
+		words = append(words, phrase...)
+	}
+	if len(words) == 0 {
+		return idx.msgs
+	}
+	// Start from the rarest word to keep the intersections small
+	sort.Slice(words, func(i, j int) bool {
+		return len(idx.postings[words[i]]) < len(idx.postings[words[j]])
+	})
+	ids := idx.postings[words[0]]
+	for _, w := range words[1:] {
+		ids = intersect(ids, idx.postings[w])
+	}
+	msgs := make([]*chat.Message, len(ids))
+	for i, id := range ids {
+		msgs[i] = idx.byID[id]
+	}
+	return msgs
+}
+
+// Search returns up to limit messages matching query (see ParseQuery),
+// newest first.  If roomName isn't empty, only that room's messages match.
+func (idx *Index) Search(query string, roomName string, limit int) ([]*chat.Message, error) {
+	q, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	results := []*chat.Message{}
+	candidates := idx.candidates(q)
+	for i := len(candidates) - 1; i >= 0 && len(results) < limit; i-- {
+		m := candidates[i]
+		if (roomName == "" || m.Room == roomName) && q.Match(m) {
+			results = append(results, m)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,89 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+// ids returns the IDs of msgs.
+func ids(msgs []*chat.Message) []uint64 {
+	out := []uint64{}
+	for _, m := range msgs {
+		out = append(out, m.ID)
+	}
+	return out
+}
+
+func newTestIndex(maxMessages int) *Index {
+	idx := New(maxMessages)
+	bodies := []string{
+		"deploy started",
+		"the build failed",
+		"has joined",
+		"build fixed, deploy again",
+		"deploy failed",
+	}
+	for i, body := range bodies {
+		kind := chat.KindChat
+		if body == "has joined" {
+			kind = chat.KindJoin
+		}
+		room := "lobby"
+		if i == 4 {
+			room = "dev"
+		}
+		idx.Add(&chat.Message{ID: uint64(i + 1), Sender: "alice", Room: room, Kind: kind, Body: body})
+	}
+	return idx
+}
+
+func TestSearch(t *testing.T) {
+	idx := newTestIndex(10)
+	tests := []struct {
+		query    string
+		room     string
+		limit    int
+		expected []uint64
+	}{
+		{"deploy", "", 10, []uint64{5, 4, 1}},
+		{"deploy", "", 2, []uint64{5, 4}},
+		{"deploy", "lobby", 10, []uint64{4, 1}},
+		{"failed deploy", "", 10, []uint64{5}},
+		{`"build failed"`, "", 10, []uint64{2}},
+		{"joined", "", 10, []uint64{}},
+		{"from:alice", "lobby", 10, []uint64{4, 2, 1}},
+		{"nothing", "", 10, []uint64{}},
+	}
+	for _, test := range tests {
+		msgs, err := idx.Search(test.query, test.room, test.limit)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if got := ids(msgs); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Search(%q, %q, %d) = %v, want: %v",
+				test.query, test.room, test.limit, got, test.expected)
+		}
+	}
+	if _, err := idx.Search(`"oops`, "", 10); err == nil {
+		t.Error("Expected an error for a bad query")
+	}
+}
+
+func TestSearchEviction(t *testing.T) {
+	idx := newTestIndex(2)
+	msgs, err := idx.Search("deploy", "", 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := ids(msgs); !reflect.DeepEqual(got, []uint64{5, 4}) {
+		t.Errorf("Search(deploy) = %v, want: [5 4]", got)
+	}
+	if _, ok := idx.postings["started"]; ok {
+		t.Error("Expected the postings of evicted messages to be removed")
+	}
+	if len(idx.byID) != 2 {
+		t.Errorf("%d messages indexed, want: 2", len(idx.byID))
+	}
+}
@@ -0,0 +1,564 @@
+// Package store implements a persistent, append-only message store for
+// chat rooms.
+//
+// Messages are written to segment files ("<first id>.seg") as JSON lines.
+// Every segment has an index file ("<first id>.idx") with one line per
+// message:
+//
+//	<id> <offset> <length> <unix nanoseconds> <room>
+//
+// Private messages (those without a room) aren't written to segments, but
+// they get an index entry with no record and the room "." (which isn't a
+// valid room name), so that the newest ID survives restarts.
+//
+// The indexes are loaded into memory when the store is opened, so reads
+// only touch the segment records that are asked for.  Segments are rolled
+// after a configurable number of messages (or once all of their messages
+// have expired), and whole segments are deleted according to the Retention
+// policy.  Expired messages are never returned, even before their segment
+// is deleted.
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+const (
+	segmentExt = ".seg"
+	indexExt   = ".idx"
+	// noRoom is the room of a private message's index entry
+	noRoom = "."
+)
+
+var ClosedErr = errors.New("Store is closed")
+
+// Retention is the policy that decides when old segments are deleted.  A
+// zero value keeps everything.
+type Retention struct {
+	// MaxAge is how long messages are kept for, going by chat.Now.
+	MaxAge time.Duration
+	// MaxMessages is the number of messages to keep; the oldest segments
+	// are deleted once the newer segments hold at least that many.
+	MaxMessages int
+}
+
+// entry locates a message in a segment.
+type entry struct {
+	id     uint64
+	offset int64
+	length int
+	time   int64
+	room   string
+	seg    *segment
+}
+
+// segment is a segment file and its index.
+type segment struct {
+	firstID uint64
+	data    *os.File
+	index   *os.File
+	entries []*entry
+}
+
+var _ chat.Store = (*Store)(nil)
+
+// Store is a persistent message store.  It implements chat.Store.
+type Store struct {
+	dir         string
+	segmentSize int
+	retention   Retention
+	segments    []*segment
+	rooms       map[string][]*entry
+	lastID      uint64
+	closed      bool
+	mu          sync.Mutex
+}
+
+// Open opens (or creates) the store in dir.  Segments are rolled after
+// segmentSize messages.
+func Open(dir string, segmentSize int, retention Retention) (*Store, error) {
+	if segmentSize < 1 {
+		return nil, errors.New(fmt.Sprintf(
+			"Invalid segment size: %d", segmentSize))
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		dir:         dir,
+		segmentSize: segmentSize,
+		retention:   retention,
+		rooms:       map[string][]*entry{},
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	firstIDs := []uint64{}
+	for _, name := range names {
+		firstID, err := strconv.ParseUint(
+			strings.TrimSuffix(filepath.Base(name), segmentExt), 10, 64)
+		if err != nil {
+			log.Printf("Ignoring unexpected file in store: %s", name)
+			continue
+		}
+		firstIDs = append(firstIDs, firstID)
+	}
+	sort.Slice(firstIDs, func(i, j int) bool { return firstIDs[i] < firstIDs[j] })
+	for _, firstID := range firstIDs {
+		seg, err := s.openSegment(firstID)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.addSegment(seg)
+	}
+	s.applyRetention()
+	return s, nil
+}
+
+// segmentPath returns the path of the file with firstID and ext.
+func (s *Store) segmentPath(firstID uint64, ext string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", firstID, ext))
+}
+
+// openSegment opens a segment and loads its index.  Records that made it
+// to the segment but not to the index (e.g., due to a crash) are indexed,
+// and a partially written trailing record is truncated.
+func (s *Store) openSegment(firstID uint64) (*segment, error) {
+	data, err := os.OpenFile(s.segmentPath(firstID, segmentExt), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(s.segmentPath(firstID, indexExt), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	seg := &segment{firstID, data, index, nil}
+	indexEnd, err := seg.loadIndex()
+	if err != nil {
+		seg.close()
+		return nil, err
+	}
+	err = seg.recover(indexEnd)
+	if err != nil {
+		seg.close()
+		return nil, err
+	}
+	return seg, nil
+}
+
+// loadIndex reads the segment's index.  It returns the offset in the index
+// file after the last complete entry.
+func (seg *segment) loadIndex() (int64, error) {
+	_, err := seg.index.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	var end int64
+	r := bufio.NewReader(seg.index)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			// A partial last line is dropped and rebuilt by recover
+			return end, nil
+		} else if err != nil {
+			return end, err
+		}
+		e := &entry{seg: seg}
+		_, err = fmt.Sscanf(line, "%d %d %d %d %s",
+			&e.id, &e.offset, &e.length, &e.time, &e.room)
+		if err != nil {
+			return end, errors.New(fmt.Sprintf(
+				"Corrupt index entry in %s: %q", seg.index.Name(), line))
+		}
+		seg.entries = append(seg.entries, e)
+		end += int64(len(line))
+	}
+}
+
+// recover indexes any records that follow the last indexed record and
+// truncates a partially written record at the end of the segment.
+func (seg *segment) recover(indexEnd int64) error {
+	var offset int64
+	if len(seg.entries) > 0 {
+		last := seg.entries[len(seg.entries)-1]
+		offset = last.offset + int64(last.length)
+	}
+	err := seg.index.Truncate(indexEnd)
+	if err != nil {
+		return err
+	}
+	_, err = seg.index.Seek(indexEnd, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = seg.data.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(seg.data)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Truncating partial record in %s", seg.data.Name())
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+		m := &chat.Message{}
+		err = json.Unmarshal(line, m)
+		if err != nil {
+			log.Printf("Truncating corrupt record in %s", seg.data.Name())
+			break
+		}
+		err = seg.writeEntry(&entry{m.ID, offset, len(line), m.Time.UnixNano(), m.Room, seg})
+		if err != nil {
+			return err
+		}
+		offset += int64(len(line))
+	}
+	err = seg.data.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = seg.data.Seek(offset, io.SeekStart)
+	return err
+}
+
+// writeEntry appends an entry to the segment's index.
+func (seg *segment) writeEntry(e *entry) error {
+	_, err := fmt.Fprintf(seg.index, "%d %d %d %d %s\n",
+		e.id, e.offset, e.length, e.time, e.room)
+	if err != nil {
+		return err
+	}
+	seg.entries = append(seg.entries, e)
+	return nil
+}
+
+// read reads the message that e locates.
+func (seg *segment) read(e *entry) (*chat.Message, error) {
+	buf := make([]byte, e.length)
+	_, err := seg.data.ReadAt(buf, e.offset)
+	if err != nil {
+		return nil, err
+	}
+	m := &chat.Message{}
+	err = json.Unmarshal(buf, m)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf(
+			"Corrupt record %d in %s: %s", e.id, seg.data.Name(), err))
+	}
+	return m, nil
+}
+
+// close closes the segment's files.
+func (seg *segment) close() error {
+	err := seg.data.Close()
+	if indexErr := seg.index.Close(); err == nil {
+		err = indexErr
+	}
+	return err
+}
+
+// addSegment adds seg's entries to the room indexes.
+func (s *Store) addSegment(seg *segment) {
+	s.segments = append(s.segments, seg)
+	// A segment's name is the ID of its first message, so the IDs before
+	// it are taken even if the segment is empty.
+	if seg.firstID > 0 && seg.firstID-1 > s.lastID {
+		s.lastID = seg.firstID - 1
+	}
+	for _, e := range seg.entries {
+		if e.room != noRoom {
+			s.rooms[e.room] = append(s.rooms[e.room], e)
+		}
+		if e.id > s.lastID {
+			s.lastID = e.id
+		}
+	}
+}
+
+// cutoff returns the time, in Unix nanoseconds, before which messages have
+// expired (see Retention.MaxAge).
+func (s *Store) cutoff() int64 {
+	if s.retention.MaxAge <= 0 {
+		return math.MinInt64
+	}
+	return chat.Now().Add(-s.retention.MaxAge).UnixNano()
+}
+
+// expired returns a bool indicating whether all of seg's messages have
+// expired.
+func (s *Store) expired(seg *segment) bool {
+	return len(seg.entries) > 0 && seg.entries[len(seg.entries)-1].time < s.cutoff()
+}
+
+// unexpired returns the entries that follow the expired ones.  Entries are
+// in ID order, and so in time order.
+func (s *Store) unexpired(entries []*entry) []*entry {
+	cutoff := s.cutoff()
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].time >= cutoff })
+	return entries[i:]
+}
+
+// applyRetention deletes the oldest segments that the retention policy no
+// longer requires.  The active (last) segment is never deleted.
+func (s *Store) applyRetention() {
+	total := 0
+	for _, seg := range s.segments {
+		total += len(seg.entries)
+	}
+	for len(s.segments) > 1 {
+		seg := s.segments[0]
+		expired := s.expired(seg)
+		if s.retention.MaxMessages > 0 && total-len(seg.entries) >= s.retention.MaxMessages {
+			expired = true
+		}
+		if !expired {
+			return
+		}
+		err := s.removeSegment(seg)
+		if err != nil {
+			log.Printf("Error removing expired segment: %s", err)
+			return
+		}
+		total -= len(seg.entries)
+	}
+}
+
+// removeSegment closes and deletes the oldest segment.
+func (s *Store) removeSegment(seg *segment) error {
+	seg.close()
+	err := os.Remove(seg.data.Name())
+	if err != nil {
+		return err
+	}
+	err = os.Remove(seg.index.Name())
+	if err != nil {
+		return err
+	}
+	s.segments = s.segments[1:]
+	for _, e := range seg.entries {
+		entries := s.rooms[e.room]
+		if len(entries) > 0 && entries[0] == e {
+			s.rooms[e.room] = entries[1:]
+		}
+	}
+	for room, entries := range s.rooms {
+		if len(entries) == 0 {
+			delete(s.rooms, room)
+		}
+	}
+	log.Printf("Removed expired segment %s", seg.data.Name())
+	return nil
+}
+
+// Append appends a message to the store.  Messages must be appended in ID
+// order.  Private messages (those without a room) are not stored; only
+// their IDs are kept (see LastID).
+func (s *Store) Append(m *chat.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ClosedErr
+	}
+	if m.ID <= s.lastID {
+		return errors.New(fmt.Sprintf(
+			"Message %d is not newer than %d", m.ID, s.lastID))
+	}
+	seg, err := s.activeSegment(m.ID)
+	if err != nil {
+		return err
+	}
+	s.applyRetention()
+	if m.Room == "" {
+		return s.appendPrivate(seg, m)
+	}
+	record, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	record = append(record, '\n')
+	offset, err := seg.data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = seg.data.Write(record)
+	if err != nil {
+		return err
+	}
+	e := &entry{m.ID, offset, len(record), m.Time.UnixNano(), m.Room, seg}
+	err = seg.writeEntry(e)
+	if err != nil {
+		return err
+	}
+	s.rooms[m.Room] = append(s.rooms[m.Room], e)
+	s.lastID = m.ID
+	return nil
+}
+
+// appendPrivate appends an index entry without a record for a private
+// message to seg (but does not lock any shared state; it should only be
+// used if you already hold the appropriate locks).
+func (s *Store) appendPrivate(seg *segment, m *chat.Message) error {
+	offset, err := seg.data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	err = seg.writeEntry(&entry{m.ID, offset, 0, m.Time.UnixNano(), noRoom, seg})
+	if err != nil {
+		return err
+	}
+	s.lastID = m.ID
+	return nil
+}
+
+// activeSegment returns the segment that the message with id should be
+// appended to, rolling a new segment if the last one is full or expired (so
+// that retention can delete it).
+func (s *Store) activeSegment(id uint64) (*segment, error) {
+	if len(s.segments) > 0 {
+		seg := s.segments[len(s.segments)-1]
+		if len(seg.entries) < s.segmentSize && !s.expired(seg) {
+			return seg, nil
+		}
+		err := seg.data.Sync()
+		if err != nil {
+			return nil, err
+		}
+	}
+	seg, err := s.openSegment(id)
+	if err != nil {
+		return nil, err
+	}
+	s.addSegment(seg)
+	return seg, nil
+}
+
+// Before returns up to n of a room's unexpired messages with IDs lower than
+// id, oldest first.
+func (s *Store) Before(room string, id uint64, n int) ([]*chat.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ClosedErr
+	}
+	if n <= 0 {
+		return []*chat.Message{}, nil
+	}
+	entries := s.unexpired(s.rooms[room])
+	if n > len(entries) {
+		n = len(entries)
+	}
+	end := sort.Search(len(entries), func(i int) bool { return entries[i].id >= id })
+	start := end - n
+	if start < 0 {
+		start = 0
+	}
+	msgs := make([]*chat.Message, 0, end-start)
+	for _, e := range entries[start:end] {
+		m, err := e.seg.read(e)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// After returns up to n of a room's unexpired messages with IDs greater
+// than id, oldest first.
+func (s *Store) After(room string, id uint64, n int) ([]*chat.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ClosedErr
+	}
+	if n <= 0 {
+		return []*chat.Message{}, nil
+	}
+	entries := s.unexpired(s.rooms[room])
+	if n > len(entries) {
+		n = len(entries)
+	}
+	start := sort.Search(len(entries), func(i int) bool { return entries[i].id > id })
+	end := start + n
+	if end > len(entries) {
+		end = len(entries)
+	}
+	msgs := make([]*chat.Message, 0, end-start)
+	for _, e := range entries[start:end] {
+		m, err := e.seg.read(e)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// Last returns up to n of a room's newest messages, oldest first.
+func (s *Store) Last(room string, n int) ([]*chat.Message, error) {
+	return s.Before(room, math.MaxUint64, n)
+}
+
+// Rooms returns the sorted names of the rooms that have stored messages.
+func (s *Store) Rooms() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.rooms))
+	for name := range s.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LastID returns the ID of the newest appended message, private or not (0
+// if there is none).
+func (s *Store) LastID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastID
+}
+
+// Close syncs and closes the store's files.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	var err error
+	for _, seg := range s.segments {
+		if syncErr := seg.data.Sync(); err == nil {
+			err = syncErr
+		}
+		if closeErr := seg.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
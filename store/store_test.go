@@ -0,0 +1,383 @@
+package store
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+var testNow = time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+
+// tempDir returns a new temporary directory and a function that removes it.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gochatd-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// appendN appends messages with IDs first through last to room.
+func appendN(t *testing.T, s *Store, room string, first uint64, last uint64) {
+	for id := first; id <= last; id++ {
+		err := s.Append(&chat.Message{
+			ID:     id,
+			Time:   testNow,
+			Sender: "testuser",
+			Room:   room,
+			Kind:   chat.KindChat,
+			Body:   strconv.FormatUint(id, 10),
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+}
+
+// bodies returns the bodies of msgs, separated by spaces.
+func bodies(msgs []*chat.Message) string {
+	out := ""
+	for i, m := range msgs {
+		if i > 0 {
+			out += " "
+		}
+		out += m.Body
+	}
+	return out
+}
+
+func TestAppendReopen(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := Open(dir, 3, Retention{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	appendN(t, s, "lobby", 1, 4)
+	appendN(t, s, "dev", 5, 5)
+	appendN(t, s, "lobby", 6, 7)
+	s.Close()
+
+	s, err = Open(dir, 3, Retention{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+	if s.LastID() != 7 {
+		t.Errorf("LastID() = %d, want: 7", s.LastID())
+	}
+	msgs, err := s.Last("lobby", 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(msgs) != "1 2 3 4 6 7" {
+		t.Errorf("lobby = %s, want: 1 2 3 4 6 7", bodies(msgs))
+	}
+	msgs, err = s.Before("lobby", 6, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(msgs) != "3 4" {
+		t.Errorf("lobby before 6 = %s, want: 3 4", bodies(msgs))
+	}
+	after, err := s.After("lobby", 3, 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(after) != "4 6 7" {
+		t.Errorf("lobby after 3 = %s, want: 4 6 7", bodies(after))
+	}
+	if rooms := s.Rooms(); len(rooms) != 2 || rooms[0] != "dev" || rooms[1] != "lobby" {
+		t.Errorf("Rooms() = %v, want: [dev lobby]", rooms)
+	}
+	if !msgs[0].Time.Equal(testNow) || msgs[0].Kind != chat.KindChat {
+		t.Errorf("Unexpected message: %+v", msgs[0])
+	}
+}
+
+// TestBadCount makes sure that counts that are out of range don't break
+// the slice arithmetic.
+func TestBadCount(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := Open(dir, 3, Retention{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+	appendN(t, s, "lobby", 1, 4)
+	for _, n := range []int{math.MinInt64, -1, 0} {
+		if msgs, err := s.Before("lobby", 3, n); err != nil || len(msgs) != 0 {
+			t.Errorf("Before(%d) = (%v, %v), want nothing", n, msgs, err)
+		}
+		if msgs, err := s.After("lobby", 1, n); err != nil || len(msgs) != 0 {
+			t.Errorf("After(%d) = (%v, %v), want nothing", n, msgs, err)
+		}
+	}
+	n := math.MaxInt64
+	if msgs, err := s.Before("lobby", 3, n); err != nil || bodies(msgs) != "1 2" {
+		t.Errorf("Before(%d) = (%s, %v), want: 1 2", n, bodies(msgs), err)
+	}
+	if msgs, err := s.After("lobby", 1, n); err != nil || bodies(msgs) != "2 3 4" {
+		t.Errorf("After(%d) = (%s, %v), want: 2 3 4", n, bodies(msgs), err)
+	}
+}
+
+func TestAppendOutOfOrder(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := Open(dir, 3, Retention{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+	appendN(t, s, "lobby", 2, 2)
+	err = s.Append(&chat.Message{ID: 1, Room: "lobby"})
+	if err == nil {
+		t.Error("Expected error appending an old message")
+	}
+}
+
+func TestAppendPrivate(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := Open(dir, 3, Retention{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+	appendN(t, s, "lobby", 1, 2)
+	err = s.Append(&chat.Message{ID: 3, Kind: chat.KindPrivate, To: "bob"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s.LastID() != 3 {
+		t.Errorf("LastID() = %d, want: 3", s.LastID())
+	}
+	msgs, err := s.After("lobby", 0, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(msgs) != "1 2" || len(s.Rooms()) != 1 {
+		t.Errorf("lobby = %s, rooms = %v; want the private message not to be stored",
+			bodies(msgs), s.Rooms())
+	}
+}
+
+// TestAppendPrivateReopen makes sure that the ID of a private message that
+// was appended last survives a restart.
+func TestAppendPrivateReopen(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := Open(dir, 2, Retention{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	appendN(t, s, "lobby", 1, 2)
+	// The private message rolls a new segment of its own
+	err = s.Append(&chat.Message{ID: 3, Time: testNow, Kind: chat.KindPrivate, To: "bob"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	s.Close()
+
+	s, err = Open(dir, 2, Retention{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+	if s.LastID() != 3 {
+		t.Errorf("LastID() = %d, want: 3", s.LastID())
+	}
+	appendN(t, s, "lobby", 4, 4)
+	msgs, err := s.Last("lobby", 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(msgs) != "1 2 4" {
+		t.Errorf("lobby = %s, want: 1 2 4", bodies(msgs))
+	}
+}
+
+func TestRetentionMaxMessages(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := Open(dir, 2, Retention{MaxMessages: 3})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+	appendN(t, s, "lobby", 1, 7)
+	msgs, err := s.Last("lobby", 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Retention is applied when [7] is rolled: [3 4] [5 6] are needed to
+	// keep three messages, [1 2] is not.
+	if bodies(msgs) != "3 4 5 6 7" {
+		t.Errorf("lobby = %s, want: 3 4 5 6 7", bodies(msgs))
+	}
+	segs, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(segs) != 3 {
+		t.Errorf("segments = %v, want three", segs)
+	}
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	defer func() { chat.Now = time.Now }()
+	chat.Now = func() time.Time { return testNow.Add(48 * time.Hour) }
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := Open(dir, 2, Retention{MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	appendN(t, s, "lobby", 1, 3)
+	s.Close()
+
+	// The active segment is kept even though it has expired, but its
+	// messages aren't returned
+	s, err = Open(dir, 2, Retention{MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+	msgs, err := s.Last("lobby", 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(msgs) != "" {
+		t.Errorf("lobby = %s, want nothing", bodies(msgs))
+	}
+	if s.LastID() != 3 {
+		t.Errorf("LastID() = %d, want: 3", s.LastID())
+	}
+	segs, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(segs) != 1 {
+		t.Errorf("segments = %v, want one", segs)
+	}
+}
+
+// TestRetentionMaxAgeQuiet makes sure that messages expire even if their
+// segment never fills up.
+func TestRetentionMaxAgeQuiet(t *testing.T) {
+	defer func() { chat.Now = time.Now }()
+	chat.Now = func() time.Time { return testNow }
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := Open(dir, 10, Retention{MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+	appendN(t, s, "lobby", 1, 3)
+
+	chat.Now = func() time.Time { return testNow.Add(12 * time.Hour) }
+	msgs, _ := s.Last("lobby", 10)
+	if bodies(msgs) != "1 2 3" {
+		t.Errorf("lobby = %s, want: 1 2 3", bodies(msgs))
+	}
+
+	chat.Now = func() time.Time { return testNow.Add(48 * time.Hour) }
+	msgs, _ = s.Last("lobby", 10)
+	if bodies(msgs) != "" {
+		t.Errorf("lobby = %s, want nothing", bodies(msgs))
+	}
+	msgs, _ = s.After("lobby", 0, 10)
+	if bodies(msgs) != "" {
+		t.Errorf("lobby after 0 = %s, want nothing", bodies(msgs))
+	}
+
+	// The next message rolls a new segment and the expired one is deleted
+	err = s.Append(&chat.Message{
+		ID:     4,
+		Time:   chat.Now(),
+		Sender: "testuser",
+		Room:   "lobby",
+		Kind:   chat.KindChat,
+		Body:   "4",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	msgs, _ = s.Last("lobby", 10)
+	if bodies(msgs) != "4" {
+		t.Errorf("lobby = %s, want: 4", bodies(msgs))
+	}
+	segs, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(segs) != 1 || filepath.Base(segs[0]) != filepath.Base(s.segmentPath(4, segmentExt)) {
+		t.Errorf("segments = %v, want only the segment of 4", segs)
+	}
+}
+
+// TestRecover makes sure that records missing from the index are indexed
+// and that a partially written record is dropped.
+func TestRecover(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := Open(dir, 10, Retention{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	appendN(t, s, "lobby", 1, 3)
+	s.Close()
+
+	// Lose the last index entry and half write a fourth record
+	idx := filepath.Join(dir, "00000000000000000001"+indexExt)
+	data, err := ioutil.ReadFile(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(idx, data[:len(data)-5], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, err := os.OpenFile(filepath.Join(dir, "00000000000000000001"+segmentExt),
+		os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg.Write([]byte(`{"id":4,"body":`))
+	seg.Close()
+
+	s, err = Open(dir, 10, Retention{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer s.Close()
+	msgs, err := s.Last("lobby", 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(msgs) != "1 2 3" {
+		t.Errorf("lobby = %s, want: 1 2 3", bodies(msgs))
+	}
+	appendN(t, s, "lobby", 4, 4)
+	msgs, err = s.Last("lobby", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if bodies(msgs) != "4" {
+		t.Errorf("lobby = %s, want: 4", bodies(msgs))
+	}
+}
+
+func TestClosed(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := Open(dir, 10, Retention{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	s.Close()
+	err = s.Append(&chat.Message{ID: 1, Room: "lobby"})
+	if err != ClosedErr {
+		t.Errorf("err = %v, want: %v", err, ClosedErr)
+	}
+}
@@ -0,0 +1,152 @@
+// Package tlsconf builds the TLS configuration of the chat listeners.
+//
+// The certificate and key are read from disk and reloaded when either file
+// changes, so that a renewed certificate is picked up by new connections
+// without a restart.
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// checkInterval is how often the certificate files are checked for changes.
+var checkInterval = time.Second
+
+// versions maps the accepted minimum version names to TLS versions.
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseVersion returns the TLS version named by s (e.g., "1.2").  An empty
+// s means TLS 1.2.
+func ParseVersion(s string) (uint16, error) {
+	if s == "" {
+		return tls.VersionTLS12, nil
+	}
+	v, ok := versions[s]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Unknown TLS version: %s (want 1.0, 1.1, 1.2 or 1.3)", s))
+	}
+	return v, nil
+}
+
+// Certificate is a certificate and key pair loaded from files.  It is
+// reloaded when the files' modification times change.
+type Certificate struct {
+	certPath  string
+	keyPath   string
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+	mu        sync.Mutex
+}
+
+// modTimes returns the modification times of the certificate and key files.
+func (c *Certificate) modTimes() (certMod time.Time, keyMod time.Time, err error) {
+	fi, err := os.Stat(c.certPath)
+	if err != nil {
+		return certMod, keyMod, err
+	}
+	certMod = fi.ModTime()
+	fi, err = os.Stat(c.keyPath)
+	if err != nil {
+		return certMod, keyMod, err
+	}
+	return certMod, fi.ModTime(), nil
+}
+
+// load (re)loads the certificate and key.
+func (c *Certificate) load() error {
+	certMod, keyMod, err := c.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.certMod = certMod
+	c.keyMod = keyMod
+	return nil
+}
+
+// LoadCertificate loads a certificate and key from PEM files.
+func LoadCertificate(certPath string, keyPath string) (*Certificate, error) {
+	c := &Certificate{certPath, keyPath, nil, time.Time{}, time.Time{}, time.Now(), sync.Mutex{}}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the
+// files have changed.  If reloading fails, the previous certificate is kept.
+// It is meant to be used as tls.Config.GetCertificate.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastCheck) < checkInterval {
+		return c.cert, nil
+	}
+	c.lastCheck = now
+	certMod, keyMod, err := c.modTimes()
+	if err == nil && certMod.Equal(c.certMod) && keyMod.Equal(c.keyMod) {
+		return c.cert, nil
+	}
+	if err == nil {
+		err = c.load()
+	}
+	if err != nil {
+		log.Printf("Failed to reload the TLS certificate (keeping the old one): %s", err)
+	} else {
+		log.Printf("Reloaded the TLS certificate %s", c.certPath)
+	}
+	return c.cert, nil
+}
+
+// New returns a TLS server configuration that serves the certificate and key
+// in certPath and keyPath, reloading them when they change.  minVersion is
+// the minimum TLS version (see ParseVersion).  If clientCAPath is set,
+// clients must present a certificate signed by one of the PEM certificates
+// in that file.
+func New(certPath string, keyPath string, minVersion string, clientCAPath string) (*tls.Config, error) {
+	version, err := ParseVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := LoadCertificate(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		GetCertificate: cert.GetCertificate,
+		MinVersion:     version,
+	}
+	if clientCAPath != "" {
+		pem, err := ioutil.ReadFile(clientCAPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("No certificates in %s", clientCAPath))
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
@@ -0,0 +1,232 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a generated certificate and its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newCert generates a certificate for cn, signed by parent (or self-signed if
+// parent is nil).
+func newCert(t *testing.T, cn string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key, der}
+}
+
+// write writes the certificate and key as PEM files in dir and returns their
+// paths.
+func (c *testCert) write(t *testing.T, dir string, name string) (certPath string, keyPath string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath = filepath.Join(dir, name+".crt")
+	keyPath = filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// tlsKeyPair returns the certificate as a tls.Certificate.
+func (c *testCert) tlsKeyPair() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// serve accepts TLS connections on a new local listener until the listener
+// is closed.  Clients that complete the handshake are sent "ok".
+func serve(t *testing.T, cfg *tls.Config) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = tls.NewListener(ln, cfg)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if conn.(*tls.Conn).Handshake() == nil {
+					conn.Write([]byte("ok"))
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+// dial connects to ln, trusting roots, and returns the server's certificate
+// once the server has accepted the handshake.
+func dial(ln net.Listener, roots *x509.CertPool, clientCerts ...tls.Certificate) (*x509.Certificate, error) {
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		Certificates: clientCerts,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// With TLS 1.3, the server checks the client's certificate after the
+	// client considers the handshake done, so wait for the server's word.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = ioutil.ReadAll(conn); err != nil {
+		return nil, err
+	}
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestParseVersion(t *testing.T) {
+	if v, err := ParseVersion(""); err != nil || v != tls.VersionTLS12 {
+		t.Errorf("ParseVersion(\"\") = (%x, %v), want: (%x, nil)", v, err, tls.VersionTLS12)
+	}
+	if v, err := ParseVersion("1.3"); err != nil || v != tls.VersionTLS13 {
+		t.Errorf("ParseVersion(1.3) = (%x, %v), want: (%x, nil)", v, err, tls.VersionTLS13)
+	}
+	if _, err := ParseVersion("2.0"); err == nil {
+		t.Error("Expected an error for an unknown version")
+	}
+}
+
+func TestReload(t *testing.T) {
+	checkInterval = 0
+	defer func() { checkInterval = time.Second }()
+	dir, err := ioutil.TempDir("", "gochatd-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := newCert(t, "first", false, nil)
+	certPath, keyPath := first.write(t, dir, "server")
+	cfg, err := New(certPath, keyPath, "1.2", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ln := serve(t, cfg)
+	defer ln.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(first.cert)
+	got, err := dial(ln, roots)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got.Subject.CommonName != "first" {
+		t.Errorf("Server certificate = %s, want: first", got.Subject.CommonName)
+	}
+
+	second := newCert(t, "second", false, nil)
+	second.write(t, dir, "server")
+	// Make sure that the change is seen on file systems with coarse
+	// modification times
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+	roots.AddCert(second.cert)
+	got, err = dial(ln, roots)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got.Subject.CommonName != "second" {
+		t.Errorf("Server certificate after reload = %s, want: second", got.Subject.CommonName)
+	}
+
+	// A broken certificate file keeps the old certificate
+	ioutil.WriteFile(certPath, []byte("garbage"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+	got, err = dial(ln, roots)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got.Subject.CommonName != "second" {
+		t.Errorf("Server certificate after a failed reload = %s, want: second", got.Subject.CommonName)
+	}
+}
+
+func TestClientCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gochatd-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := newCert(t, "server", false, nil)
+	certPath, keyPath := server.write(t, dir, "server")
+	ca := newCert(t, "ca", true, nil)
+	caPath, _ := ca.write(t, dir, "ca")
+	cfg, err := New(certPath, keyPath, "", caPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ln := serve(t, cfg)
+	defer ln.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.cert)
+
+	if _, err = dial(ln, roots); err == nil {
+		t.Error("Expected a client without a certificate to be refused")
+	}
+	stranger := newCert(t, "stranger", false, nil)
+	if _, err = dial(ln, roots, stranger.tlsKeyPair()); err == nil {
+		t.Error("Expected a client with an unknown certificate to be refused")
+	}
+	client := newCert(t, "client", false, ca)
+	if _, err = dial(ln, roots, client.tlsKeyPair()); err != nil {
+		t.Errorf("Unexpected error for a client signed by the CA: %s", err)
+	}
+}
@@ -0,0 +1,137 @@
+// Package tokens keeps the API tokens of chat users in a JSON file.
+//
+// Tokens are never stored; the file maps the SHA-256 hash of each token to
+// the name and permissions it grants, so that a leaked file can't be used to
+// post as anyone.
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+// tokenSize is the number of random bytes in a token.
+const tokenSize = 32
+
+var _ chat.Tokens = (*Tokens)(nil)
+
+// grant is what a token allows.
+type grant struct {
+	Name        string            `json:"name"`
+	Permissions []chat.Permission `json:"permissions"`
+	Created     time.Time         `json:"created"`
+}
+
+// hashToken returns the key a token is stored under.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Tokens is a set of API tokens backed by a file.
+type Tokens struct {
+	path   string
+	grants map[string]*grant
+	mu     sync.Mutex
+}
+
+// Open loads the tokens file at path.  A missing file holds no tokens; it
+// is created when the first token is issued.
+func Open(path string) (*Tokens, error) {
+	t := &Tokens{path, map[string]*grant{}, sync.Mutex{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &t.grants); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid tokens file %s: %s", path, err))
+	}
+	return t, nil
+}
+
+// save writes the tokens file.  The file is replaced atomically so that a
+// crash can't leave it half written.
+func (t *Tokens) save() error {
+	data, err := json.MarshalIndent(t.grants, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(t.path), ".tokens")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), t.path)
+}
+
+// Issue returns a new token for name with the given permissions.
+func (t *Tokens) Issue(name string, perms []chat.Permission) (string, error) {
+	b := make([]byte, tokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	key := hashToken(token)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.grants[key] = &grant{name, perms, time.Now().UTC()}
+	if err := t.save(); err != nil {
+		delete(t.grants, key)
+		return "", err
+	}
+	return token, nil
+}
+
+// Lookup returns the name and permissions of a token.
+func (t *Tokens) Lookup(token string) (name string, perms []chat.Permission, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	g, ok := t.grants[hashToken(token)]
+	if !ok {
+		return "", nil, false
+	}
+	return g.Name, g.Permissions, true
+}
+
+// Revoke revokes all of name's tokens and returns how many there were.
+func (t *Tokens) Revoke(name string) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	revoked := map[string]*grant{}
+	for key, g := range t.grants {
+		if g.Name == name {
+			revoked[key] = g
+			delete(t.grants, key)
+		}
+	}
+	if len(revoked) == 0 {
+		return 0, nil
+	}
+	if err := t.save(); err != nil {
+		for key, g := range revoked {
+			t.grants[key] = g
+		}
+		return 0, err
+	}
+	return len(revoked), nil
+}
@@ -0,0 +1,73 @@
+package tokens
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bgmerrell/gochatd/chat"
+)
+
+// tempPath returns the path of a tokens file in a new temporary directory
+// and a function that removes the directory.
+func tempPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gochatd-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "tokens.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestIssueLookupRevoke(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+	tk, err := Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	perms := []chat.Permission{chat.PermRead, chat.PermPost}
+	token, err := tk.Issue("alice", perms)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err = tk.Issue("alice", []chat.Permission{chat.PermRead}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	bobToken, err := tk.Issue("bob", perms)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	tk, err = Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	name, got, ok := tk.Lookup(token)
+	if !ok || name != "alice" || !reflect.DeepEqual(got, perms) {
+		t.Errorf("Lookup = (%s, %v, %t), want: (alice, %v, true)", name, got, ok, perms)
+	}
+	if _, _, ok = tk.Lookup("bogus"); ok {
+		t.Error("Expected a bogus token to be unknown")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), token) {
+		t.Error("Expected the tokens file not to contain tokens")
+	}
+
+	n, err := tk.Revoke("alice")
+	if err != nil || n != 2 {
+		t.Errorf("Revoke(alice) = (%d, %v), want: (2, nil)", n, err)
+	}
+	if _, _, ok = tk.Lookup(token); ok {
+		t.Error("Expected a revoked token to be unknown")
+	}
+	if _, _, ok = tk.Lookup(bobToken); !ok {
+		t.Error("Expected bob's token to survive")
+	}
+}